@@ -1,57 +1,286 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
+	"io"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"time"
+
+	"lenslocked.com/middleware"
+	"lenslocked.com/models"
+	"lenslocked.com/s3"
 )
 
-type PostgresConfig struct {
+// DatabaseConfig is the database the app keeps its data in
+// Dialect is "postgres" (the default) or "sqlite3"; SQLite keeps everything in SQLiteFile,
+// so that the app can be run for development without a Postgres server
+type DatabaseConfig struct {
+	Dialect    string `json:"dialect"`
+	Host       string `json:"host"`
+	Port       int    `json:"port"`
+	User       string `json:"user"`
+	Password   string `json:"password"`
+	Name       string `json:"name"`
+	SQLiteFile string `json:"sqlite_file"`
+}
+
+func DefaultDatabaseConfig() DatabaseConfig {
+	return DatabaseConfig{
+		Dialect:    "postgres",
+		Host:       "localhost",
+		Port:       5432,
+		User:       "postgres",
+		Password:   "",
+		Name:       "lenslocked_dev",
+		SQLiteFile: "lenslocked_dev.db",
+	}
+}
+
+func (d DatabaseConfig) Connection() string {
+
+	if d.Dialect == "sqlite3" {
+		// wait for a lock instead of failing with "database is locked" right away
+		return d.SQLiteFile + "?_busy_timeout=5000"
+	}
+
+	if d.Password == "" {
+		return fmt.Sprintf("host=%s port=%d user=%s dbname=%s sslmode=disable", d.Host, d.Port, d.User, d.Name)
+	}
+
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", d.Host, d.Port, d.User, d.Password, d.Name)
+}
+
+// MailConfig is the SMTP server used to send emails
+// When no host is provided, emails are printed to the log instead, which is only allowed in development
+// since the emails carry the reset and verification links
+type MailConfig struct {
 	Host     string `json:"host"`
 	Port     int    `json:"port"`
-	User     string `json:"user"`
+	Username string `json:"username"`
 	Password string `json:"password"`
-	Name     string `json:"name"`
+	From     string `json:"from"`
+}
+
+func DefaultMailConfig() MailConfig {
+	return MailConfig{
+		Port: 1025,
+		From: "support@lenslocked.com",
+	}
+}
+
+// StorageConfig is where the uploaded images are kept
+// Backend is either "local" (the LocalDir directory) or "s3" (a private bucket)
+// Either way browsers ask the app for /images/..., which checks who may see the image
+// and then sends the file or redirects to a presigned S3 url
+type StorageConfig struct {
+	Backend  string   `json:"backend"`
+	LocalDir string   `json:"local_dir"`
+	S3       S3Config `json:"s3"`
+
+	// ImageSizes are the derived sizes generated for every uploaded image
+	ImageSizes []ImageSizeConfig `json:"image_sizes"`
+
+	// MaxImagePixels is the largest width×height accepted on upload,
+	// since decoding an image takes 4 bytes of memory per pixel
+	MaxImagePixels int `json:"max_image_pixels"`
+}
+
+// ImageSizeConfig is a derived image size, e.g. {"name": "thumb", "width": 320}
+type ImageSizeConfig struct {
+	Name  string `json:"name"`
+	Width int    `json:"width"`
+}
+
+// S3Config is an S3 bucket, or a bucket on any S3-compatible server
+// For a local MinIO server use e.g. "endpoint": "http://localhost:9000"
+type S3Config struct {
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+
+	// PresignMinutes is how long the presigned urls the app redirects browsers to stay valid
+	// A new url is made for every request, so this can be short
+	PresignMinutes int `json:"presign_minutes"`
 }
 
-func DefaultPostgresConfig() PostgresConfig {
-	return PostgresConfig{
-		Host:     "localhost",
-		Port:     5432,
-		User:     "postgres",
-		Password: "",
-		Name:     "lenslocked_dev",
+func DefaultStorageConfig() StorageConfig {
+	var sizes []ImageSizeConfig
+	for _, size := range models.DefaultImageSizes {
+		sizes = append(sizes, ImageSizeConfig{Name: size.Name, Width: size.Width})
+	}
+
+	return StorageConfig{
+		Backend:        "local",
+		LocalDir:       "images",
+		ImageSizes:     sizes,
+		MaxImagePixels: models.DefaultMaxImagePixels,
+		S3: S3Config{
+			Endpoint:       "https://s3.us-east-1.amazonaws.com",
+			Region:         "us-east-1",
+			PresignMinutes: 5,
+		},
 	}
 }
 
-func (p PostgresConfig) Connection() string {
+func (s StorageConfig) Sizes() []models.ImageSize {
+	sizes := make([]models.ImageSize, len(s.ImageSizes))
+	for i, size := range s.ImageSizes {
+		sizes[i] = models.ImageSize{Name: size.Name, Width: size.Width}
+	}
+	return sizes
+}
 
-	if p.Password == "" {
-		return fmt.Sprintf("host=%s port=%d user=%s dbname=%s sslmode=disable", p.Host, p.Port, p.User, p.Name)
+// BlobStore returns the store of the configured backend
+func (s StorageConfig) BlobStore() (models.BlobStore, error) {
+	switch s.Backend {
+	case "local":
+		return models.NewLocalBlobStore(s.LocalDir), nil
+	case "s3":
+		return models.NewS3BlobStore(s3.Config{
+			Endpoint:  s.S3.Endpoint,
+			Region:    s.S3.Region,
+			Bucket:    s.S3.Bucket,
+			AccessKey: s.S3.AccessKey,
+			SecretKey: s.S3.SecretKey,
+		}, time.Duration(s.S3.PresignMinutes)*time.Minute)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", s.Backend)
 	}
+}
 
-	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", p.Host, p.Port, p.User, p.Password, p.Name)
+// ServerConfig holds the timeouts of the http server, in seconds
+// ReadTimeout covers reading a whole request, including the uploads of images,
+// and WriteTimeout covers writing a whole response, including large images
+// ShutdownTimeout is how long the requests in flight may take to finish on SIGINT or SIGTERM
+type ServerConfig struct {
+	ReadHeaderTimeout int `json:"read_header_timeout"`
+	ReadTimeout       int `json:"read_timeout"`
+	WriteTimeout      int `json:"write_timeout"`
+	IdleTimeout       int `json:"idle_timeout"`
+	ShutdownTimeout   int `json:"shutdown_timeout"`
 }
 
-func (p PostgresConfig) Dialect() string {
-	return "postgres"
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		ReadHeaderTimeout: 10,
+		ReadTimeout:       120,
+		WriteTimeout:      120,
+		IdleTimeout:       120,
+		ShutdownTimeout:   30,
+	}
+}
+
+// CSRFConfig holds the keys that sign the CSRF cookie of the forms
+// The first key signs new cookies; the others are previous keys, still accepted for GraceMinutes
+// after the app starts so that forms opened before a key rotation can be submitted
+// To rotate, put the new key first and keep the old one after it until every instance has restarted
+type CSRFConfig struct {
+	Keys         []string `json:"keys"`
+	GraceMinutes int      `json:"grace_minutes"`
+}
+
+// KeyBytes returns the keys in the form the CSRF middleware takes them
+func (c CSRFConfig) KeyBytes() [][]byte {
+	keys := make([][]byte, len(c.Keys))
+	for i, key := range c.Keys {
+		keys[i] = []byte(key)
+	}
+	return keys
+}
+
+// SecurityConfig holds the security headers sent with every response, see middleware.SecurityHeaders
+// CSP lists the sources of each Content-Security-Policy directive; a nonce is added to script-src
+// and style-src for every request. Hosts without a scheme match the scheme of the page,
+// like the protocol-relative urls of the CDN files in views/layout/bootstrap.gohtml
+type SecurityConfig struct {
+	HSTSMaxAge        int                 `json:"hsts_max_age"`
+	FrameOptions      string              `json:"frame_options"`
+	ReferrerPolicy    string              `json:"referrer_policy"`
+	PermissionsPolicy string              `json:"permissions_policy"`
+	CSP               map[string][]string `json:"csp"`
+	CSPReportOnly     bool                `json:"csp_report_only"`
+}
+
+func DefaultSecurityConfig() SecurityConfig {
+	return SecurityConfig{
+		HSTSMaxAge:        365 * 24 * 60 * 60,
+		FrameOptions:      "DENY",
+		ReferrerPolicy:    "strict-origin-when-cross-origin",
+		PermissionsPolicy: "camera=(), microphone=(), geolocation=(), payment=()",
+		CSP: map[string][]string{
+			"default-src":     {"'self'"},
+			"script-src":      {"'self'", "ajax.googleapis.com", "maxcdn.bootstrapcdn.com"},
+			"style-src":       {"'self'", "maxcdn.bootstrapcdn.com"},
+			"font-src":        {"'self'", "maxcdn.bootstrapcdn.com"},
+			"img-src":         {"'self'", "data:"},
+			"object-src":      {"'none'"},
+			"base-uri":        {"'self'"},
+			"form-action":     {"'self'"},
+			"frame-ancestors": {"'none'"},
+		},
+	}
 }
 
 type Config struct {
 	Port     int            `json:"port"`
 	Env      string         `json:"env"`
+	BaseURL  string         `json:"base_url"`
 	Pepper   string         `json:"pepper"`
 	HMACKey  string         `json:"hmac_key"`
-	Database PostgresConfig `json:"database"`
+	Database DatabaseConfig `json:"database"`
+	Mail     MailConfig     `json:"mail"`
+	Storage  StorageConfig  `json:"storage"`
+	Server   ServerConfig   `json:"server"`
+	CSRF     CSRFConfig     `json:"csrf"`
+	Security SecurityConfig `json:"security"`
+
+	// PwResetMinutes is how long a password reset link stays valid
+	PwResetMinutes int `json:"pw_reset_minutes"`
+
+	// VerifyHours is how long an email verification link stays valid
+	VerifyHours int `json:"verify_hours"`
+
+	// SessionDays is how long a user stays logged in on a device
+	SessionDays int `json:"session_days"`
+
+	// LogFormat is "text" for logfmt lines, easy to read in a terminal,
+	// or "json" for log collectors
+	LogFormat string `json:"log_format"`
+
+	// FromDisk reads the templates, assets and migrations from the views, assets and migrations
+	// directories (so the app has to run from the root of the repo) instead of the copies embedded
+	// in the binary. The templates are then parsed again for every request, so that edits to them
+	// show up without a restart. For development only
+	FromDisk bool `json:"from_disk"`
+
+	// AttemptStore is where failed login counters are kept: "memory" or "database"
+	// Use "database" when more than one instance of the app is running
+	AttemptStore string `json:"attempt_store"`
 }
 
 func DefaultConfig() Config {
 	return Config{
-		Port:     3000,
-		Env:      "dev",
-		Pepper:   "secret-random-string",
-		HMACKey:  "secret-hmac-key",
-		Database: DefaultPostgresConfig(),
+		Port:           3000,
+		Env:            "dev",
+		BaseURL:        "http://localhost:3000",
+		Pepper:         defaultPepper,
+		HMACKey:        defaultHMACKey,
+		Database:       DefaultDatabaseConfig(),
+		Mail:           DefaultMailConfig(),
+		Storage:        DefaultStorageConfig(),
+		Server:         DefaultServerConfig(),
+		CSRF:           CSRFConfig{Keys: []string{defaultCSRFKey}, GraceMinutes: 12 * 60},
+		Security:       DefaultSecurityConfig(),
+		PwResetMinutes: 12 * 60,
+		VerifyHours:    48,
+		SessionDays:    30,
+		AttemptStore:   "memory",
+		LogFormat:      "text",
 	}
 }
 
@@ -59,24 +288,161 @@ func (c Config) IsProd() bool {
 	return c.Env == "prod"
 }
 
-func LoadConfig(configReq bool) Config {
+// The secrets of DefaultConfig are only good enough for development
+const (
+	defaultPepper  = "secret-random-string"
+	defaultHMACKey = "secret-hmac-key"
+	defaultCSRFKey = "secret-csrf-key-for-development-only"
+)
 
-	f, err := os.Open(".config")
-	if err != nil {
-		if configReq {
-			panic(err)
+// minCSRFKeyLength is the shortest CSRF key accepted, 32 bytes as gorilla/csrf recommends
+const minCSRFKeyLength = 32
+
+// Validate checks the settings before the app uses them
+// Every problem is reported at once, so that a broken config only takes one round to fix
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
 		}
-		fmt.Println("Using the default config...")
-		return DefaultConfig()
 	}
 
-	var c Config
-	dec := json.NewDecoder(f)
-	err = dec.Decode(&c)
-	if err != nil {
-		panic(err)
+	check(c.Env == "dev" || c.Env == "prod", "env must be \"dev\" or \"prod\", not %q", c.Env)
+	check(c.Port > 0 && c.Port < 65536, "port must be between 1 and 65535")
+	if u, err := url.Parse(c.BaseURL); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("base_url must be an absolute url, e.g. https://lenslocked.com"))
+	}
+
+	check(c.Pepper != "", "pepper is required")
+	check(c.HMACKey != "", "hmac_key is required")
+	if c.IsProd() {
+		check(c.Pepper != defaultPepper, "pepper must be changed from its default value in production")
+		check(c.HMACKey != defaultHMACKey, "hmac_key must be changed from its default value in production")
+	}
+
+	check(len(c.CSRF.Keys) > 0, "csrf.keys needs at least one key")
+	csrfKeys := map[string]bool{}
+	for i, key := range c.CSRF.Keys {
+		check(len(key) >= minCSRFKeyLength, "csrf.keys[%d] must be at least %d characters long", i, minCSRFKeyLength)
+		check(!csrfKeys[key], "csrf.keys[%d] is listed more than once", i)
+		check(!c.IsProd() || key != defaultCSRFKey, "csrf.keys[%d] must be changed from its default value in production", i)
+		csrfKeys[key] = true
 	}
+	check(c.CSRF.GraceMinutes >= 0, "csrf.grace_minutes must not be negative")
+
+	check(c.Security.HSTSMaxAge >= 0, "security.hsts_max_age must not be negative")
+	check(c.Security.FrameOptions == "" || c.Security.FrameOptions == "DENY" || c.Security.FrameOptions == "SAMEORIGIN",
+		"security.frame_options must be \"DENY\", \"SAMEORIGIN\" or empty, not %q", c.Security.FrameOptions)
+	for name := range c.Security.CSP {
+		check(cspDirective.MatchString(name), "security.csp has an invalid directive %q", name)
+	}
+
+	switch c.Database.Dialect {
+	case "postgres":
+		check(c.Database.Host != "", "database.host is required")
+		check(c.Database.Port > 0 && c.Database.Port < 65536, "database.port must be between 1 and 65535")
+		check(c.Database.Name != "", "database.name is required")
+	case "sqlite3":
+		check(c.Database.SQLiteFile != "", "database.sqlite_file is required for the sqlite3 dialect")
+	default:
+		errs = append(errs, fmt.Errorf("database.dialect must be \"postgres\" or \"sqlite3\", not %q", c.Database.Dialect))
+	}
+
+	check(!c.IsProd() || c.Mail.Host != "", "mail.host is required in production, otherwise the emails and their links are printed to the log")
+	if c.Mail.Host != "" {
+		check(c.Mail.Port > 0 && c.Mail.Port < 65536, "mail.port must be between 1 and 65535")
+		check(c.Mail.From != "", "mail.from is required when mail.host is set")
+	}
+
+	switch c.Storage.Backend {
+	case "local":
+		check(c.Storage.LocalDir != "", "storage.local_dir is required for the local backend")
+	case "s3":
+		check(c.Storage.S3.Bucket != "", "storage.s3.bucket is required for the s3 backend")
+		check(c.Storage.S3.AccessKey != "" && c.Storage.S3.SecretKey != "",
+			"storage.s3.access_key and storage.s3.secret_key are required for the s3 backend")
+		check(c.Storage.S3.PresignMinutes > 0, "storage.s3.presign_minutes must be positive")
+	default:
+		errs = append(errs, fmt.Errorf("storage.backend must be \"local\" or \"s3\", not %q", c.Storage.Backend))
+	}
+	names := map[string]bool{}
+	for _, size := range c.Storage.ImageSizes {
+		check(size.Name != "" && size.Width > 0, "storage.image_sizes need a name and a positive width")
+		check(!names[size.Name], "storage.image_sizes has %q more than once", size.Name)
+		names[size.Name] = true
+	}
+	check(c.Storage.MaxImagePixels > 0, "storage.max_image_pixels must be positive")
+
+	check(c.Server.ReadHeaderTimeout > 0 && c.Server.ReadTimeout > 0 && c.Server.WriteTimeout > 0 &&
+		c.Server.IdleTimeout > 0 && c.Server.ShutdownTimeout > 0, "the server timeouts must be positive")
 
-	fmt.Println("Successfully loaded config.")
+	check(c.PwResetMinutes > 0, "pw_reset_minutes must be positive")
+	check(c.VerifyHours > 0, "verify_hours must be positive")
+	check(c.SessionDays > 0, "session_days must be positive")
+	check(c.AttemptStore == "memory" || c.AttemptStore == "database",
+		"attempt_store must be \"memory\" or \"database\", not %q", c.AttemptStore)
+
+	check(!c.IsProd() || !c.FromDisk, "from_disk is for development only, production uses the files embedded in the binary")
+
+	check(c.LogFormat == "text" || c.LogFormat == "json", "log_format must be \"text\" or \"json\", not %q", c.LogFormat)
+
+	return errors.Join(errs...)
+}
+
+// cspDirective is the form of the names of the Content-Security-Policy directives, e.g. img-src
+var cspDirective = regexp.MustCompile(`^[a-z]+(-[a-z]+)*$`)
+
+// SecurityHeaders returns the middleware that sets the security headers
+// Strict-Transport-Security is only sent in production, where the app is served over HTTPS,
+// and with the s3 backend the images come from the bucket, which img-src has to allow
+func (c Config) SecurityHeaders() *middleware.SecurityHeaders {
+	csp := make(map[string][]string, len(c.Security.CSP))
+	for name, sources := range c.Security.CSP {
+		csp[name] = append([]string(nil), sources...)
+	}
+	if c.Storage.Backend == "s3" {
+		if u, err := url.Parse(c.Storage.S3.Endpoint); err == nil && u.Host != "" {
+			csp["img-src"] = append(csp["img-src"], u.Scheme+"://"+u.Host)
+		}
+	}
+
+	mw := &middleware.SecurityHeaders{
+		FrameOptions:      c.Security.FrameOptions,
+		ReferrerPolicy:    c.Security.ReferrerPolicy,
+		PermissionsPolicy: c.Security.PermissionsPolicy,
+		CSP:               csp,
+		CSPReportOnly:     c.Security.CSPReportOnly,
+	}
+	if c.IsProd() {
+		mw.HSTSMaxAge = c.Security.HSTSMaxAge
+	}
+	return mw
+}
+
+// Redacted returns a copy of the config without its secrets, to print it
+func (c Config) Redacted() Config {
+	redact := func(s *string) {
+		if *s != "" {
+			*s = "REDACTED"
+		}
+	}
+	redact(&c.Pepper)
+	redact(&c.HMACKey)
+	redact(&c.Database.Password)
+	redact(&c.Mail.Password)
+	redact(&c.Storage.S3.SecretKey)
+	c.CSRF.Keys = append([]string(nil), c.CSRF.Keys...)
+	for i := range c.CSRF.Keys {
+		redact(&c.CSRF.Keys[i])
+	}
 	return c
 }
+
+// Logger returns the logger of the app, writing to w in the LogFormat
+func (c Config) Logger(w io.Writer) *slog.Logger {
+	if c.LogFormat == "json" {
+		return slog.New(slog.NewJSONHandler(w, nil))
+	}
+	return slog.New(slog.NewTextHandler(w, nil))
+}
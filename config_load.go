@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultConfigFile is read when no -config flag is given, if it exists
+const defaultConfigFile = ".config"
+
+// envPrefix starts the name of every environment variable that sets a config value
+const envPrefix = "LENSLOCKED_"
+
+// LoadConfig builds the config in layers, each one overriding the one before:
+//  1. the values of DefaultConfig
+//  2. the config file at path, in JSON, YAML or TOML (see decodeConfigFile)
+//  3. the LENSLOCKED_* environment variables (see applyEnv)
+//
+// When path is "" the .config file is used if there is one
+// fileRequired makes a missing config file an error, e.g. with the -prod flag
+// The result is validated, so an error is returned rather than starting with a broken config
+func LoadConfig(path string, fileRequired bool) (Config, error) {
+	c := DefaultConfig()
+
+	explicit := path != ""
+	if !explicit {
+		path = defaultConfigFile
+	}
+
+	b, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := decodeConfigFile(path, b, &c); err != nil {
+			return c, fmt.Errorf("config file %s: %w", path, err)
+		}
+		slog.Info("loaded the config file", "path", path)
+	case errors.Is(err, fs.ErrNotExist) && !explicit && !fileRequired:
+		slog.Info("no config file found, using the default config")
+	default:
+		return c, err
+	}
+
+	if err := applyEnv(&c, os.Environ()); err != nil {
+		return c, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return c, fmt.Errorf("invalid config:\n%w", err)
+	}
+	return c, nil
+}
+
+// decodeConfigFile reads the file into c, picking the format from its extension:
+// .yaml or .yml for YAML, .toml for TOML and JSON for anything else (like .config)
+//
+// YAML and TOML are converted to JSON first, so that the settings have the same names
+// (the json tags of Config) in every format, and unknown settings are rejected the same way
+func decodeConfigFile(path string, b []byte, c *Config) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		var m map[string]interface{}
+		if err := yaml.Unmarshal(b, &m); err != nil {
+			return err
+		}
+		return decodeConfigMap(m, c)
+	case ".toml":
+		var m map[string]interface{}
+		if err := toml.Unmarshal(b, &m); err != nil {
+			return err
+		}
+		return decodeConfigMap(m, c)
+	default:
+		return decodeConfigJSON(b, c)
+	}
+}
+
+func decodeConfigMap(m map[string]interface{}, c *Config) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return decodeConfigJSON(b, c)
+}
+
+// decodeConfigJSON only overrides the settings present in b
+// A misspelled setting is an error instead of being silently ignored
+func decodeConfigJSON(b []byte, c *Config) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	return dec.Decode(c)
+}
+
+// applyEnv overrides the settings with the LENSLOCKED_* variables of environ (as in os.Environ)
+// A variable is named after the json names of the setting, upper cased and joined by "_",
+// e.g. LENSLOCKED_PORT=8080, LENSLOCKED_DATABASE_HOST=db or LENSLOCKED_STORAGE_S3_SECRET_KEY=...
+// Settings that are lists take a JSON value, e.g.
+// LENSLOCKED_STORAGE_IMAGE_SIZES='[{"name": "thumb", "width": 320}]'
+func applyEnv(c *Config, environ []string) error {
+	env := map[string]string{}
+	for _, kv := range environ {
+		if k, v, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(k, envPrefix) {
+			env[k] = v
+		}
+	}
+
+	if err := applyEnvStruct(reflect.ValueOf(c).Elem(), envPrefix, env); err != nil {
+		return err
+	}
+
+	// applyEnvStruct removes the variables it used, so anything left is a typo
+	for k := range env {
+		return fmt.Errorf("unknown config environment variable %s", k)
+	}
+	return nil
+}
+
+func applyEnvStruct(v reflect.Value, prefix string, env map[string]string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		key := prefix + strings.ToUpper(name)
+		field := v.Field(i)
+
+		if field.Kind() == reflect.Struct {
+			if err := applyEnvStruct(field, key+"_", env); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := env[key]
+		if !ok {
+			continue
+		}
+		delete(env, key)
+		if err := setEnvValue(field, value); err != nil {
+			return fmt.Errorf("environment variable %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func setEnvValue(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	default:
+		return json.Unmarshal([]byte(value), field.Addr().Interface())
+	}
+	return nil
+}
+
+// logConfig logs the config the app runs with, without its secrets
+func logConfig(c Config) {
+	slog.Info("effective config", "config", c.Redacted())
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// prodConfig returns a production configuration that passes Validate
+func prodConfig() Config {
+	c := DefaultConfig()
+	c.Env = "prod"
+	c.BaseURL = "https://lenslocked.com"
+	c.Pepper = "production-pepper"
+	c.HMACKey = "production-hmac-key"
+	c.CSRF.Keys = []string{"production-csrf-key-of-32-characters"}
+	c.Mail.Host = "smtp.lenslocked.com"
+	c.Mail.Port = 587
+	return c
+}
+
+// writeConfigFile writes content to a file with the name in a temporary directory and returns its path
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// The same settings in every format that decodeConfigFile reads
+var configFiles = []struct {
+	name    string
+	content string
+}{
+	{".config", `{
+		"port": 8080,
+		"database": {"host": "db"},
+		"storage": {"image_sizes": [{"name": "small", "width": 200}]}
+	}`},
+	{"config.json", `{"port": 8080, "database": {"host": "db"}, "storage": {"image_sizes": [{"name": "small", "width": 200}]}}`},
+	{"config.yaml", "port: 8080\ndatabase:\n  host: db\nstorage:\n  image_sizes:\n    - name: small\n      width: 200\n"},
+	{"config.yml", "port: 8080\ndatabase:\n  host: db\nstorage:\n  image_sizes:\n    - {name: small, width: 200}\n"},
+	{"config.toml", "port = 8080\n\n[database]\nhost = \"db\"\n\n[[storage.image_sizes]]\nname = \"small\"\nwidth = 200\n"},
+}
+
+func TestLoadConfigFormats(t *testing.T) {
+	for _, tt := range configFiles {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := LoadConfig(writeConfigFile(t, tt.name, tt.content), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Port != 8080 || c.Database.Host != "db" {
+				t.Errorf("port = %d, database.host = %q; want 8080 and db", c.Port, c.Database.Host)
+			}
+			if len(c.Storage.ImageSizes) != 1 || c.Storage.ImageSizes[0] != (ImageSizeConfig{Name: "small", Width: 200}) {
+				t.Errorf("storage.image_sizes = %v, want the single size of the file", c.Storage.ImageSizes)
+			}
+			// the settings the file leaves out keep their defaults
+			if c.Database.Port != 5432 || c.Storage.Backend != "local" {
+				t.Errorf("database.port = %d, storage.backend = %q; want the defaults", c.Database.Port, c.Storage.Backend)
+			}
+		})
+	}
+}
+
+func TestLoadConfigUnknownSetting(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"config.json", `{"database": {"hots": "db"}}`},
+		{"config.yaml", "database:\n  hots: db\n"},
+		{"config.toml", "[database]\nhots = \"db\"\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(writeConfigFile(t, tt.name, tt.content), true)
+			if err == nil || !strings.Contains(err.Error(), "hots") {
+				t.Errorf("LoadConfig() err = %v, want the unknown setting hots", err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.json"), false); err == nil {
+		t.Error("LoadConfig() of a file that doesn't exist was not an error")
+	}
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		check func(c Config) bool
+		err   string
+	}{
+		{
+			name:  "overrides the file",
+			env:   map[string]string{"LENSLOCKED_PORT": "9090"},
+			check: func(c Config) bool { return c.Port == 9090 && c.Database.Host == "db" },
+		},
+		{
+			name:  "nested setting",
+			env:   map[string]string{"LENSLOCKED_STORAGE_S3_SECRET_KEY": "s3-secret", "LENSLOCKED_DATABASE_HOST": "db2"},
+			check: func(c Config) bool { return c.Storage.S3.SecretKey == "s3-secret" && c.Database.Host == "db2" },
+		},
+		{
+			name: "list as JSON",
+			env:  map[string]string{"LENSLOCKED_STORAGE_IMAGE_SIZES": `[{"name": "thumb", "width": 320}, {"name": "large", "width": 1600}]`},
+			check: func(c Config) bool {
+				return len(c.Storage.ImageSizes) == 2 && c.Storage.ImageSizes[1] == ImageSizeConfig{Name: "large", Width: 1600}
+			},
+		},
+		{
+			name:  "bool",
+			env:   map[string]string{"LENSLOCKED_FROM_DISK": "true"},
+			check: func(c Config) bool { return c.FromDisk },
+		},
+		{
+			name: "unknown variable",
+			env:  map[string]string{"LENSLOCKED_DATABASE_HOTS": "db"},
+			err:  "unknown config environment variable LENSLOCKED_DATABASE_HOTS",
+		},
+		{
+			name: "not a number",
+			env:  map[string]string{"LENSLOCKED_PORT": "eighty"},
+			err:  "environment variable LENSLOCKED_PORT",
+		},
+		{
+			name: "invalid JSON list",
+			env:  map[string]string{"LENSLOCKED_CSRF_KEYS": "not-json"},
+			err:  "environment variable LENSLOCKED_CSRF_KEYS",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			path := writeConfigFile(t, "config.json", `{"port": 8080, "database": {"host": "db"}}`)
+
+			c, err := LoadConfig(path, true)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("LoadConfig() err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(c) {
+				t.Errorf("the config does not have the values of %v", tt.env)
+			}
+		})
+	}
+}
+
+func TestValidateProd(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		err    string
+	}{
+		{"valid", func(c *Config) {}, ""},
+		{"default pepper", func(c *Config) { c.Pepper = defaultPepper }, "pepper must be changed"},
+		{"default hmac key", func(c *Config) { c.HMACKey = defaultHMACKey }, "hmac_key must be changed"},
+		{"default csrf key", func(c *Config) { c.CSRF.Keys = append(c.CSRF.Keys, defaultCSRFKey) }, "csrf.keys[1] must be changed"},
+		{"no mail host", func(c *Config) { c.Mail.Host = "" }, "mail.host is required in production"},
+		{"templates from disk", func(c *Config) { c.FromDisk = true }, "from_disk is for development only"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := prodConfig()
+			tt.change(&c)
+			err := c.Validate()
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("Validate() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("Validate() = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// TestValidateDevDefaults checks that the app starts for development without any config
+func TestValidateDevDefaults(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Errorf("Validate() of DefaultConfig() = %v", err)
+	}
+}
+
+// secretSetting matches the names of the settings that Redacted must hide
+var secretSetting = regexp.MustCompile(`password|secret|pepper|hmac_key`)
+
+// setSecrets sets every secret string setting of v to "secret-" and its name, and returns how many it set
+func setSecrets(v reflect.Value) int {
+	n := 0
+	for i := 0; i < v.NumField(); i++ {
+		name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+		field := v.Field(i)
+		switch {
+		case field.Kind() == reflect.Struct:
+			n += setSecrets(field)
+		case field.Kind() == reflect.String && secretSetting.MatchString(name):
+			field.SetString("secret-" + name)
+			n++
+		}
+	}
+	return n
+}
+
+func TestRedacted(t *testing.T) {
+	c := prodConfig()
+	if n := setSecrets(reflect.ValueOf(&c).Elem()); n < 5 {
+		t.Fatalf("only %d secret settings found", n)
+	}
+	c.CSRF.Keys = []string{"secret-csrf-key-one-of-32-characters", "secret-csrf-key-two-of-32-characters"}
+
+	b, err := json.Marshal(c.Redacted())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "secret-") {
+		t.Errorf("the redacted config still holds a secret: %s", b)
+	}
+	if c.CSRF.Keys[0] != "secret-csrf-key-one-of-32-characters" {
+		t.Error("Redacted() changed the keys of the config it was called on")
+	}
+}
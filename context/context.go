@@ -2,12 +2,17 @@ package context
 
 import (
 	"context"
+	"log/slog"
 
 	"lenslocked.com/models"
 )
 
 const (
-	userKey privateKey = "user"
+	userKey     privateKey = "user"
+	sessionKey  privateKey = "session"
+	apiTokenKey privateKey = "api_token"
+	requestKey  privateKey = "request"
+	cspNonceKey privateKey = "csp_nonce"
 )
 
 // create a new type call privateKey that takes in a string
@@ -18,6 +23,9 @@ type privateKey string
 // The context is of type 'privateKey'
 
 func WithUser(cxt context.Context, user *models.User) context.Context {
+	if info := Request(cxt); info != nil && user != nil {
+		info.UserID = user.ID
+	}
 	return context.WithValue(cxt, userKey, user)
 }
 
@@ -34,3 +42,96 @@ func User(cxt context.Context) *models.User {
 	}
 	return nil
 }
+
+// WithSession stores the session that was used to look up the user
+// so that it can be revoked when the user logs out
+
+func WithSession(cxt context.Context, session *models.Session) context.Context {
+	return context.WithValue(cxt, sessionKey, session)
+}
+
+// Session returns the current session, or nil when the user is not logged in
+
+func Session(cxt context.Context) *models.Session {
+	if temp := cxt.Value(sessionKey); temp != nil {
+		if session, ok := temp.(*models.Session); ok {
+			return session
+		}
+	}
+	return nil
+}
+
+// WithAPIToken stores the API token that was used to look up the user
+// so that the API can check the token's scopes
+
+func WithAPIToken(cxt context.Context, token *models.APIToken) context.Context {
+	return context.WithValue(cxt, apiTokenKey, token)
+}
+
+// APIToken returns the API token of the request, or nil when the user
+// was looked up through their session cookie (or is not logged in)
+
+func APIToken(cxt context.Context) *models.APIToken {
+	if temp := cxt.Value(apiTokenKey); temp != nil {
+		if token, ok := temp.(*models.APIToken); ok {
+			return token
+		}
+	}
+	return nil
+}
+
+// RequestInfo describes the request in the request log (see middleware.RequestLog)
+// It is shared by every context derived from the request's, so that the values
+// filled in further down the chain (the route and the user) can be logged once the request is done
+
+type RequestInfo struct {
+	ID     string
+	Route  string
+	UserID uint
+}
+
+func WithRequest(cxt context.Context, info *RequestInfo) context.Context {
+	return context.WithValue(cxt, requestKey, info)
+}
+
+// Request returns the request info, or nil outside of a request
+
+func Request(cxt context.Context) *RequestInfo {
+	if temp := cxt.Value(requestKey); temp != nil {
+		if info, ok := temp.(*RequestInfo); ok {
+			return info
+		}
+	}
+	return nil
+}
+
+// WithCSPNonce stores the nonce of the request's Content-Security-Policy
+// so that the templates can mark their scripts with it (see middleware.SecurityHeaders)
+
+func WithCSPNonce(cxt context.Context, nonce string) context.Context {
+	return context.WithValue(cxt, cspNonceKey, nonce)
+}
+
+// CSPNonce returns the nonce of the request's Content-Security-Policy, or "" when there is none
+
+func CSPNonce(cxt context.Context) string {
+	if nonce, ok := cxt.Value(cspNonceKey).(string); ok {
+		return nonce
+	}
+	return ""
+}
+
+// Logger returns the logger of the app with the request ID and the user ID of the request,
+// so that everything logged while handling a request can be found by its X-Request-ID
+// Never log models or forms as a whole, since they can hold passwords, hashes and tokens
+
+func Logger(cxt context.Context) *slog.Logger {
+	logger := slog.Default()
+	if info := Request(cxt); info != nil {
+		logger = logger.With("request_id", info.ID)
+		if info.UserID != 0 {
+			logger = logger.With("user_id", info.UserID)
+		}
+	}
+	return logger
+}
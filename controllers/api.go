@@ -0,0 +1,528 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+	"lenslocked.com/views"
+)
+
+// maxJSONBytes is the largest JSON body the API accepts
+const maxJSONBytes = 1 << 20 //1MB
+
+// API is the JSON version of the pages for the current user, their galleries and their images
+// Every route is under /api/v1 and every response uses the envelope in views/json.go
+type API struct {
+	us  models.UserService
+	gs  models.GalleryService
+	is  models.ImageService
+	sls models.ShareLinkService
+}
+
+func NewAPI(us models.UserService, gs models.GalleryService, is models.ImageService, sls models.ShareLinkService) *API {
+	return &API{
+		us:  us,
+		gs:  gs,
+		is:  is,
+		sls: sls,
+	}
+}
+
+// ************** THIS SECTION CONTAINS THE API RESOURCES **************
+
+// The resources only expose what API clients need,
+// so that no password hash or secret of the models ends up in a response
+
+type apiUser struct {
+	ID        uint      `json:"id"`
+	Name      string    `json:"name"`
+	Age       uint      `json:"age"`
+	Email     string    `json:"email"`
+	Verified  bool      `json:"verified"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type apiGallery struct {
+	ID         uint       `json:"id"`
+	Title      string     `json:"title"`
+	Visibility string     `json:"visibility"`
+	Slug       string     `json:"slug"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	Images     []apiImage `json:"images"`
+}
+
+type apiImage struct {
+	ID        uint              `json:"id"`
+	GalleryID uint              `json:"gallery_id"`
+	Filename  string            `json:"filename"`
+	Caption   string            `json:"caption"`
+	Position  int               `json:"position"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	URL       string            `json:"url"`
+	Variants  []apiImageVariant `json:"variants"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+type apiImageVariant struct {
+	Name  string `json:"name"`
+	Width int    `json:"width"`
+	URL   string `json:"url"`
+}
+
+func newAPIUser(user *models.User) apiUser {
+	return apiUser{
+		ID:        user.ID,
+		Name:      user.Name,
+		Age:       user.Age,
+		Email:     user.Email,
+		Verified:  user.Verified(),
+		CreatedAt: user.CreatedAt,
+	}
+}
+
+func newAPIGallery(gallery *models.Gallery) apiGallery {
+	images := make([]apiImage, len(gallery.Images))
+	for i := range gallery.Images {
+		images[i] = newAPIImage(&gallery.Images[i])
+	}
+	return apiGallery{
+		ID:         gallery.ID,
+		Title:      gallery.Title,
+		Visibility: gallery.Visibility,
+		Slug:       gallery.Slug,
+		CreatedAt:  gallery.CreatedAt,
+		UpdatedAt:  gallery.UpdatedAt,
+		Images:     images,
+	}
+}
+
+func newAPIImage(image *models.Image) apiImage {
+	variants := make([]apiImageVariant, len(image.Variants))
+	for i, v := range image.Variants {
+		variants[i] = apiImageVariant{Name: v.Name, Width: v.Width, URL: v.URL}
+	}
+	return apiImage{
+		ID:        image.ID,
+		GalleryID: image.GalleryID,
+		Filename:  image.Filename,
+		Caption:   image.Caption,
+		Position:  image.Position,
+		Width:     image.Width,
+		Height:    image.Height,
+		URL:       image.URL,
+		Variants:  variants,
+		CreatedAt: image.CreatedAt,
+	}
+}
+
+// The request bodies of the PATCH routes use pointers,
+// so that the fields that are left out are not changed
+
+type apiUserUpdate struct {
+	Name *string `json:"name"`
+	Age  *uint   `json:"age"`
+}
+
+type apiGalleryCreate struct {
+	Title      string `json:"title"`
+	Visibility string `json:"visibility"`
+}
+
+type apiGalleryUpdate struct {
+	Title      *string `json:"title"`
+	Visibility *string `json:"visibility"`
+}
+
+type apiImageUpdate struct {
+	Caption  *string `json:"caption"`
+	Position *int    `json:"position"`
+}
+
+// ************** THIS SECTION CONTAINS THE CURRENT USER **************
+
+// GET /api/v1/me
+
+func (a *API) Me(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	views.RenderJSON(w, r, http.StatusOK, newAPIUser(user))
+}
+
+// PATCH /api/v1/me
+// data: name, age
+// The email address and the password are changed through the website,
+// since they need a verification email and the current password
+// None of the scopes covers the profile, so API tokens cannot use this route
+
+func (a *API) UpdateMe(w http.ResponseWriter, r *http.Request) {
+	if context.APIToken(r.Context()) != nil {
+		views.RenderJSONMessage(w, http.StatusForbidden, "The profile cannot be changed with an API token.")
+		return
+	}
+	user := context.User(r.Context())
+
+	var body apiUserUpdate
+	if err := parseJSON(w, r, &body); err != nil {
+		return
+	}
+	if body.Name != nil {
+		user.Name = strings.TrimSpace(*body.Name)
+	}
+	if body.Age != nil {
+		user.Age = *body.Age
+	}
+
+	if err := a.us.Update(user); err != nil {
+		renderAPIError(w, r, err)
+		return
+	}
+	views.RenderJSON(w, r, http.StatusOK, newAPIUser(user))
+}
+
+// ************** THIS SECTION CONTAINS THE GALLERIES **************
+
+// GET /api/v1/galleries
+// Lists the galleries of the current user, along with their images
+
+func (a *API) Galleries(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	galleries, err := a.gs.ByUserID(user.ID)
+	if err != nil {
+		renderAPIError(w, r, err)
+		return
+	}
+
+	resources := make([]apiGallery, len(galleries))
+	for i := range galleries {
+		images, err := a.is.ByGalleryID(galleries[i].ID)
+		if err != nil {
+			renderAPIError(w, r, err)
+			return
+		}
+		galleries[i].Images = images
+		resources[i] = newAPIGallery(&galleries[i])
+	}
+	views.RenderJSON(w, r, http.StatusOK, resources)
+}
+
+// POST /api/v1/galleries
+// data: title, visibility (private by default)
+
+func (a *API) CreateGallery(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	var body apiGalleryCreate
+	if err := parseJSON(w, r, &body); err != nil {
+		return
+	}
+
+	gallery := models.Gallery{
+		Title:      strings.TrimSpace(body.Title),
+		UserID:     user.ID,
+		Visibility: body.Visibility,
+	}
+	if err := a.gs.Create(&gallery); err != nil {
+		renderAPIError(w, r, err)
+		return
+	}
+	views.RenderJSON(w, r, http.StatusCreated, newAPIGallery(&gallery))
+}
+
+// GET /api/v1/galleries/:id
+// Like the gallery page, private and unlisted galleries are only returned to their owner
+
+func (a *API) Gallery(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.galleryByID(w, r, false)
+	if err != nil {
+		return
+	}
+	views.RenderJSON(w, r, http.StatusOK, newAPIGallery(gallery))
+}
+
+// PATCH /api/v1/galleries/:id
+// data: title, visibility
+
+func (a *API) UpdateGallery(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.galleryByID(w, r, true)
+	if err != nil {
+		return
+	}
+
+	var body apiGalleryUpdate
+	if err := parseJSON(w, r, &body); err != nil {
+		return
+	}
+	if body.Title != nil {
+		gallery.Title = strings.TrimSpace(*body.Title)
+	}
+	if body.Visibility != nil {
+		gallery.Visibility = *body.Visibility
+	}
+
+	if err := a.gs.Update(gallery); err != nil {
+		renderAPIError(w, r, err)
+		return
+	}
+	views.RenderJSON(w, r, http.StatusOK, newAPIGallery(gallery))
+}
+
+// DELETE /api/v1/galleries/:id
+// The share links and the images of the gallery are removed as well
+
+func (a *API) DeleteGallery(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.galleryByID(w, r, true)
+	if err != nil {
+		return
+	}
+
+	if err := deleteGallery(a.gs, a.is, a.sls, gallery); err != nil {
+		renderAPIError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ************** THIS SECTION CONTAINS THE IMAGES **************
+
+// GET /api/v1/galleries/:id/images
+
+func (a *API) Images(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.galleryByID(w, r, false)
+	if err != nil {
+		return
+	}
+	views.RenderJSON(w, r, http.StatusOK, newAPIGallery(gallery).Images)
+}
+
+// POST /api/v1/galleries/:id/images
+// A multipart/form-data body with one or more files named "images", like the upload form
+// The images are only created when every file is accepted; otherwise the files that
+// were accepted are removed again and the error lists the rejected files
+
+func (a *API) UploadImages(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.galleryByID(w, r, true)
+	if err != nil {
+		return
+	}
+
+	user := context.User(r.Context())
+	if !user.Verified() {
+		views.RenderJSONMessage(w, http.StatusForbidden, "Please confirm your email address before uploading images.")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+	if err := r.ParseMultipartForm(maxMultipartMem); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			views.RenderJSONMessage(w, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("The upload is too large. Please upload at most %d megabytes at a time.", maxUploadBytes>>20))
+			return
+		}
+		views.RenderJSONMessage(w, http.StatusBadRequest, "The body must be multipart/form-data with files named \"images\".")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	files := r.MultipartForm.File["images"]
+	if len(files) == 0 {
+		views.RenderJSONMessage(w, http.StatusBadRequest, "Please provide at least one file named \"images\".")
+		return
+	}
+
+	var uploaded []*models.Image
+	var rejected models.ImageErrors
+	for _, f := range files {
+		image, err := uploadImage(a.is, gallery, user, f)
+		if err != nil {
+			rejected = append(rejected, &models.ImageError{Filename: f.Filename, Err: err})
+			continue
+		}
+		uploaded = append(uploaded, image)
+	}
+
+	if len(rejected) > 0 {
+		for _, image := range uploaded {
+			if err := a.is.Delete(image); err != nil {
+				logError(r, "removing an uploaded image", err)
+			}
+		}
+		renderAPIError(w, r, rejected)
+		return
+	}
+
+	resources := make([]apiImage, len(uploaded))
+	for i, image := range uploaded {
+		resources[i] = newAPIImage(image)
+	}
+	views.RenderJSON(w, r, http.StatusCreated, resources)
+}
+
+// GET /api/v1/galleries/:id/images/:image_id
+
+func (a *API) Image(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.galleryByID(w, r, false)
+	if err != nil {
+		return
+	}
+	image, err := a.imageByID(w, r, gallery)
+	if err != nil {
+		return
+	}
+	views.RenderJSON(w, r, http.StatusOK, newAPIImage(image))
+}
+
+// PATCH /api/v1/galleries/:id/images/:image_id
+// data: caption, position
+
+func (a *API) UpdateImage(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.galleryByID(w, r, true)
+	if err != nil {
+		return
+	}
+	image, err := a.imageByID(w, r, gallery)
+	if err != nil {
+		return
+	}
+
+	var body apiImageUpdate
+	if err := parseJSON(w, r, &body); err != nil {
+		return
+	}
+	if body.Caption != nil {
+		image.Caption = strings.TrimSpace(*body.Caption)
+	}
+	if body.Position != nil {
+		image.Position = *body.Position
+	}
+
+	if err := a.is.Update(image); err != nil {
+		renderAPIError(w, r, err)
+		return
+	}
+	views.RenderJSON(w, r, http.StatusOK, newAPIImage(image))
+}
+
+// DELETE /api/v1/galleries/:id/images/:image_id
+
+func (a *API) DeleteImage(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.galleryByID(w, r, true)
+	if err != nil {
+		return
+	}
+	image, err := a.imageByID(w, r, gallery)
+	if err != nil {
+		return
+	}
+
+	if err := a.is.Delete(image); err != nil {
+		renderAPIError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ************** THIS SECTION CONTAINS THE API HELPERS **************
+
+// NotFound is used for the /api/ urls that do not match any route
+func (a *API) NotFound(w http.ResponseWriter, r *http.Request) {
+	views.RenderJSONMessage(w, http.StatusNotFound, "There is no such API endpoint.")
+}
+
+// galleryByID looks up the gallery in the url along with its images,
+// writing the error response when it cannot be found or may not be seen
+// Galleries that the user may see but not change are reported as not found when owner is true
+func (a *API) galleryByID(w http.ResponseWriter, r *http.Request, owner bool) (*models.Gallery, error) {
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		views.RenderJSONMessage(w, http.StatusNotFound, "Gallery not found.")
+		return nil, err
+	}
+
+	gallery, err := a.gs.ByID(uint(id))
+	if err != nil {
+		if err == models.ErrNotFound {
+			views.RenderJSONMessage(w, http.StatusNotFound, "Gallery not found.")
+		} else {
+			renderAPIError(w, r, err)
+		}
+		return nil, err
+	}
+
+	user := context.User(r.Context())
+	if (owner && !gallery.IsOwner(user)) || !gallery.CanView(user) {
+		views.RenderJSONMessage(w, http.StatusNotFound, "Gallery not found.")
+		return nil, models.ErrNotFound
+	}
+
+	images, err := a.is.ByGalleryID(gallery.ID)
+	if err != nil {
+		renderAPIError(w, r, err)
+		return nil, err
+	}
+	gallery.Images = images
+
+	return gallery, nil
+}
+
+// imageByID looks up the image in the url among the images of the gallery
+func (a *API) imageByID(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) (*models.Image, error) {
+
+	id, err := strconv.Atoi(mux.Vars(r)["image_id"])
+	if err == nil {
+		for i := range gallery.Images {
+			if gallery.Images[i].ID == uint(id) {
+				return &gallery.Images[i], nil
+			}
+		}
+	}
+
+	views.RenderJSONMessage(w, http.StatusNotFound, "Image not found.")
+	return nil, models.ErrNotFound
+}
+
+// parseJSON decodes the JSON body of the request into destination,
+// writing a 400 response when the body is not valid JSON or has unknown fields
+func parseJSON(w http.ResponseWriter, r *http.Request, destination interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBytes))
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(destination)
+	if err == io.EOF {
+		err = errors.New("the body is empty")
+	}
+	if err != nil {
+		views.RenderJSONMessage(w, http.StatusBadRequest, "The body is not valid JSON: "+err.Error())
+		return err
+	}
+	return nil
+}
+
+// renderAPIError picks the status code for an error returned by the models:
+// errors that can be shown to the user are caused by the request, anything else is on us
+func renderAPIError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err.(type) {
+	case *models.LockoutError:
+		views.RenderJSONError(w, r, http.StatusTooManyRequests, err)
+	case views.PublicError:
+		if err == models.ErrNotFound {
+			views.RenderJSONError(w, r, http.StatusNotFound, err)
+			return
+		}
+		views.RenderJSONError(w, r, http.StatusUnprocessableEntity, err)
+	default:
+		views.RenderJSONError(w, r, http.StatusInternalServerError, err)
+	}
+}
@@ -0,0 +1,229 @@
+package controllers
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"lenslocked.com/models"
+	"lenslocked.com/openapi"
+	"lenslocked.com/views"
+)
+
+// ************** THIS SECTION CONTAINS THE API DOCUMENTATION **************
+
+// APIEndpoints documents every route of the API, by method and path template
+// The OpenAPI document is generated from these and the route registrations (see openapi.Generate),
+// and the routes take the scope they need from here, so the docs always say what the routes do
+// The Request and Response values are only used for their types,
+// so a change to a request or response type shows up in the document
+var APIEndpoints = map[string]openapi.Endpoint{
+	"GET /api/v1/me": {
+		ID:       "getMe",
+		Summary:  "Get the current user",
+		Tag:      "Users",
+		Status:   http.StatusOK,
+		Response: apiUser{},
+	},
+	"PATCH /api/v1/me": {
+		ID:          "updateMe",
+		Summary:     "Update the current user",
+		Description: "Only available with the session cookie, requests made with an API token are forbidden.",
+		Tag:         "Users",
+		Request:     apiUserUpdate{},
+		Status:      http.StatusOK,
+		Response:    apiUser{},
+	},
+	"GET /api/v1/galleries": {
+		ID:       "listGalleries",
+		Summary:  "List the galleries of the current user",
+		Tag:      "Galleries",
+		Scope:    models.ScopeGalleriesRead,
+		Status:   http.StatusOK,
+		Response: []apiGallery{},
+	},
+	"POST /api/v1/galleries": {
+		ID:       "createGallery",
+		Summary:  "Create a gallery",
+		Tag:      "Galleries",
+		Scope:    models.ScopeGalleriesWrite,
+		Request:  apiGalleryCreate{},
+		Status:   http.StatusCreated,
+		Response: apiGallery{},
+	},
+	"GET /api/v1/galleries/{id:[0-9]+}": {
+		ID:          "getGallery",
+		Summary:     "Get a gallery",
+		Description: "Public galleries and galleries of the current user can be read.",
+		Tag:         "Galleries",
+		Scope:       models.ScopeGalleriesRead,
+		Status:      http.StatusOK,
+		Response:    apiGallery{},
+	},
+	"PATCH /api/v1/galleries/{id:[0-9]+}": {
+		ID:       "updateGallery",
+		Summary:  "Update a gallery",
+		Tag:      "Galleries",
+		Scope:    models.ScopeGalleriesWrite,
+		Request:  apiGalleryUpdate{},
+		Status:   http.StatusOK,
+		Response: apiGallery{},
+	},
+	"DELETE /api/v1/galleries/{id:[0-9]+}": {
+		ID:      "deleteGallery",
+		Summary: "Delete a gallery and its images",
+		Tag:     "Galleries",
+		Scope:   models.ScopeGalleriesWrite,
+		Status:  http.StatusNoContent,
+	},
+	"GET /api/v1/galleries/{id:[0-9]+}/images": {
+		ID:       "listImages",
+		Summary:  "List the images of a gallery",
+		Tag:      "Images",
+		Scope:    models.ScopeGalleriesRead,
+		Status:   http.StatusOK,
+		Response: []apiImage{},
+	},
+	"POST /api/v1/galleries/{id:[0-9]+}/images": {
+		ID:          "uploadImages",
+		Summary:     "Upload images to a gallery",
+		Description: "Needs a verified email address. Either every image is added or none is.",
+		Tag:         "Images",
+		Scope:       models.ScopeImagesUpload,
+		Upload:      "images",
+		Status:      http.StatusCreated,
+		Response:    []apiImage{},
+	},
+	"GET /api/v1/galleries/{id:[0-9]+}/images/{image_id:[0-9]+}": {
+		ID:       "getImage",
+		Summary:  "Get an image",
+		Tag:      "Images",
+		Scope:    models.ScopeGalleriesRead,
+		Status:   http.StatusOK,
+		Response: apiImage{},
+	},
+	"PATCH /api/v1/galleries/{id:[0-9]+}/images/{image_id:[0-9]+}": {
+		ID:       "updateImage",
+		Summary:  "Update the caption or position of an image",
+		Tag:      "Images",
+		Scope:    models.ScopeGalleriesWrite,
+		Request:  apiImageUpdate{},
+		Status:   http.StatusOK,
+		Response: apiImage{},
+	},
+	"DELETE /api/v1/galleries/{id:[0-9]+}/images/{image_id:[0-9]+}": {
+		ID:      "deleteImage",
+		Summary: "Delete an image",
+		Tag:     "Images",
+		Scope:   models.ScopeGalleriesWrite,
+		Status:  http.StatusNoContent,
+	},
+}
+
+// APIDocs serves the OpenAPI document of the API and a page that shows it
+// The document never changes while the app runs, so both are prepared once
+type APIDocs struct {
+	DocsView *views.View
+	json     []byte
+	yield    apiDocsYield
+}
+
+func NewAPIDocs(doc *openapi.Document) (*APIDocs, error) {
+	b, err := doc.JSON()
+	if err != nil {
+		return nil, err
+	}
+	return &APIDocs{
+		DocsView: views.NewView("bootstrap", "api/docs"),
+		json:     b,
+		yield:    newAPIDocsYield(doc),
+	}, nil
+}
+
+type apiDocsYield struct {
+	Info       openapi.Info
+	Operations []apiDocsOperation
+	Schemas    []apiDocsSchema
+}
+
+type apiDocsSchema struct {
+	Name   string
+	Schema *openapi.Schema
+}
+
+// apiDocsOperation is an operation with the request and response bodies
+// already described in a few words, e.g. "array of Image"
+type apiDocsOperation struct {
+	Method    string
+	Path      string
+	Operation *openapi.Operation
+	Request   string
+	Status    string
+	Response  string
+}
+
+// GET /api/openapi.json
+
+func (d *APIDocs) OpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(d.json)
+}
+
+// GET /api/docs
+
+func (d *APIDocs) Docs(w http.ResponseWriter, r *http.Request) {
+	d.DocsView.Render(w, r, d.yield)
+}
+
+// newAPIDocsYield lists the operations and schemas of the document in the order the page shows them
+func newAPIDocsYield(doc *openapi.Document) apiDocsYield {
+	yield := apiDocsYield{Info: doc.Info}
+
+	for path, item := range doc.Paths {
+		for method, op := range *item {
+			o := apiDocsOperation{
+				Method:    strings.ToUpper(method),
+				Path:      path,
+				Operation: op,
+			}
+			if body := op.RequestBody; body != nil {
+				for contentType, media := range body.Content {
+					o.Request = media.Schema.TypeName()
+					if contentType != "application/json" {
+						o.Request = contentType
+					}
+				}
+			}
+			for status, resp := range op.Responses {
+				if status == "default" {
+					continue
+				}
+				o.Status = status
+				o.Response = "no content"
+				if media, ok := resp.Content["application/json"]; ok {
+					o.Response = media.Schema.Properties["data"].TypeName()
+				}
+			}
+			yield.Operations = append(yield.Operations, o)
+		}
+	}
+
+	// list the operations by path, and the same way the API routes are registered within a path
+	methods := "GET POST PATCH DELETE"
+	sort.Slice(yield.Operations, func(i, j int) bool {
+		a, b := yield.Operations[i], yield.Operations[j]
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		return strings.Index(methods, a.Method) < strings.Index(methods, b.Method)
+	})
+
+	for name, schema := range doc.Components.Schemas {
+		yield.Schemas = append(yield.Schemas, apiDocsSchema{Name: name, Schema: schema})
+	}
+	sort.Slice(yield.Schemas, func(i, j int) bool {
+		return yield.Schemas[i].Name < yield.Schemas[j].Name
+	})
+
+	return yield
+}
@@ -0,0 +1,144 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+	"lenslocked.com/views"
+)
+
+// APITokens is the settings page where users manage their personal access tokens
+type APITokens struct {
+	IndexView *views.View
+	ats       models.APITokenService
+}
+
+func NewAPITokens(ats models.APITokenService) *APITokens {
+	return &APITokens{
+		IndexView: views.NewView("bootstrap", "users/api_tokens"),
+		ats:       ats,
+	}
+}
+
+// APITokenForm is the form on the tokens page
+// Scopes holds the values of the checked scope checkboxes; ExpiresInDays is 0 for tokens that do not expire
+type APITokenForm struct {
+	Name          string   `schema:"name"`
+	Scopes        []string `schema:"scopes"`
+	ExpiresInDays int      `schema:"expires_in_days"`
+}
+
+type apiTokensYield struct {
+	Tokens []models.APIToken
+	Scopes []string
+
+	// Created is the token that was just created, the only time its raw Token is known
+	Created *models.APIToken
+}
+
+// GET /tokens
+
+func (t *APITokens) Index(w http.ResponseWriter, r *http.Request) {
+	t.render(w, r, views.Data{}, nil)
+}
+
+// POST /tokens
+
+func (t *APITokens) Create(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	user := context.User(r.Context())
+
+	var form APITokenForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		t.render(w, r, vd, nil)
+		return
+	}
+
+	token := models.APIToken{
+		UserID: user.ID,
+		Name:   form.Name,
+		Scopes: strings.Join(form.Scopes, " "),
+	}
+	if form.ExpiresInDays != 0 {
+		expiresAt := time.Now().Add(time.Duration(form.ExpiresInDays) * 24 * time.Hour)
+		token.ExpiresAt = &expiresAt
+	}
+
+	if err := t.ats.Create(&token); err != nil {
+		vd.SetAlert(err)
+		t.render(w, r, vd, nil)
+		return
+	}
+
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "API token created! Copy it now, it will not be shown again.",
+	}
+	t.render(w, r, vd, &token)
+}
+
+// POST /tokens/:id/delete
+
+func (t *APITokens) Revoke(w http.ResponseWriter, r *http.Request) {
+
+	user := context.User(r.Context())
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid token ID", http.StatusNotFound)
+		return
+	}
+
+	// Only tokens that belong to the user can be revoked
+	tokens, err := t.ats.ByUserID(user.ID)
+	if err != nil {
+		logError(r, "listing the API tokens", err)
+		http.Error(w, "Whoops. Something went wrong!", http.StatusInternalServerError)
+		return
+	}
+
+	for _, token := range tokens {
+		if token.ID != uint(id) {
+			continue
+		}
+
+		if err := t.ats.Delete(token.ID); err != nil {
+			var vd views.Data
+			vd.SetAlert(err)
+			t.render(w, r, vd, nil)
+			return
+		}
+
+		views.RedirectAlert(w, r, "/tokens", http.StatusFound, views.Alert{
+			Level:   views.AlertLvlSuccess,
+			Message: "API token revoked.",
+		})
+		return
+	}
+
+	http.Error(w, "Token not found", http.StatusNotFound)
+}
+
+// render shows the tokens page, listing the user's tokens
+func (t *APITokens) render(w http.ResponseWriter, r *http.Request, vd views.Data, created *models.APIToken) {
+	user := context.User(r.Context())
+
+	tokens, err := t.ats.ByUserID(user.ID)
+	if err != nil && vd.Alert == nil {
+		vd.SetAlert(err)
+	}
+
+	vd.Yield = apiTokensYield{
+		Tokens:  tokens,
+		Scopes:  models.APIScopes,
+		Created: created,
+	}
+	t.IndexView.Render(w, r, vd)
+}
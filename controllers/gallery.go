@@ -1,11 +1,13 @@
 package controllers
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"mime/multipart"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"lenslocked.com/context"
@@ -16,38 +18,66 @@ import (
 const (
 	ShowGallery     = "show_gallery"
 	EditGallery     = "edit_gallery"
-	maxMultipartMem = 1 << 20 //1MB
+	maxMultipartMem = 1 << 20  //1MB
+	maxUploadBytes  = 50 << 20 //50MB for all the files of an upload
+
+	// publicGalleriesLimit is the number of galleries shown on the public listing
+	publicGalleriesLimit = 50
+
+	// embedURLTTL is how long the embed links shown on the edit page work
+	embedURLTTL = 24 * time.Hour
 )
 
 type Galleries struct {
-	New       *views.View
-	ShowView  *views.View
-	EditView  *views.View
-	IndexView *views.View
-	gs        models.GalleryService
-	is        models.ImageService
-	r         *mux.Router
+	New        *views.View
+	ShowView   *views.View
+	EditView   *views.View
+	IndexView  *views.View
+	PublicView *views.View
+
+	// SharePasswordView asks for the password of a share link
+	SharePasswordView *views.View
+
+	gs  models.GalleryService
+	is  models.ImageService
+	sls models.ShareLinkService
+	as  models.AttemptService
+	r   *mux.Router
+
+	// baseURL is where the app is reached from outside, e.g. "https://lenslocked.com", for the embed links
+	baseURL string
 }
 
 // NewGalleries is used to create a Galleries controller
 // and should only be used during initial setup
 // Update: pased in the mux router so as to create named routes for the Create method
-func NewGalleries(gs models.GalleryService, is models.ImageService, r *mux.Router) *Galleries {
+// baseURL is the base_url of the config, see Galleries.baseURL
+func NewGalleries(gs models.GalleryService, is models.ImageService, sls models.ShareLinkService, as models.AttemptService, r *mux.Router, baseURL string) *Galleries {
 	return &Galleries{
-		New:       views.NewView("bootstrap", "galleries/new"),
-		ShowView:  views.NewView("bootstrap", "galleries/show"),
-		EditView:  views.NewView("bootstrap", "galleries/edit"),
-		IndexView: views.NewView("bootstrap", "galleries/index"),
-		gs:        gs,
-		is:        is,
-		r:         r,
+		New:               views.NewView("bootstrap", "galleries/new"),
+		ShowView:          views.NewView("bootstrap", "galleries/show"),
+		EditView:          views.NewView("bootstrap", "galleries/edit").WithPartials("galleryImages"),
+		IndexView:         views.NewView("bootstrap", "galleries/index"),
+		PublicView:        views.NewView("bootstrap", "galleries/public"),
+		SharePasswordView: views.NewView("bootstrap", "galleries/share_password"),
+		gs:                gs,
+		is:                is,
+		sls:               sls,
+		as:                as,
+		r:                 r,
+		baseURL:           strings.TrimSuffix(baseURL, "/"),
 	}
 }
 
 // we are going to use struct tag which are meta data to handle incoming requests
 // for the galleryForm this is easier to manage if the form has a lot of data
 type GalleryForm struct {
-	Title string `schema:"title"`
+	Title      string `schema:"title"`
+	Visibility string `schema:"visibility"`
+}
+
+type ImageForm struct {
+	Caption string `schema:"caption"`
 }
 
 // GET /galleries/:id
@@ -60,12 +90,74 @@ func (g *Galleries) Show(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Private and unlisted galleries are only shown to their owner here,
+	// everyone else gets the same response as for a gallery that does not exist
+	if !gallery.CanView(context.User(r.Context())) {
+		http.Error(w, "Gallery not found.", http.StatusNotFound)
+		return
+	}
+
 	vd := views.Data{}
 	vd.Yield = gallery // If the gallery exists, store it in the Yield property of views.Data
 
 	g.ShowView.Render(w, r, vd) //render the view with the data (temporary)
 }
 
+// GET /g/:slug
+// Unlisted galleries are shared with this link
+
+func (g *Galleries) ShowBySlug(w http.ResponseWriter, r *http.Request) {
+
+	gallery, err := g.gs.BySlug(mux.Vars(r)["slug"])
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Gallery not found.", http.StatusNotFound)
+		default:
+			logError(r, "looking up the gallery", err)
+			http.Error(w, "Whoops. Something went wrong!", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if !gallery.CanViewBySlug(context.User(r.Context())) {
+		http.Error(w, "Gallery not found.", http.StatusNotFound)
+		return
+	}
+
+	if err := g.loadImages(w, r, gallery); err != nil {
+		return
+	}
+
+	vd := views.Data{}
+	vd.Yield = gallery
+	g.ShowView.Render(w, r, vd)
+}
+
+// GET /explore
+// Lists the most recent public galleries
+
+func (g *Galleries) Public(w http.ResponseWriter, r *http.Request) {
+
+	galleries, err := g.gs.Public(publicGalleriesLimit)
+	if err != nil {
+		logError(r, "listing the public galleries", err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	// Load the images so that the listing can show a cover for every gallery
+	for i := range galleries {
+		if err := g.loadImages(w, r, &galleries[i]); err != nil {
+			return
+		}
+	}
+
+	vd := views.Data{}
+	vd.Yield = galleries
+	g.PublicView.Render(w, r, vd)
+}
+
 // GET /galleries/
 
 func (g *Galleries) Index(w http.ResponseWriter, r *http.Request) {
@@ -107,7 +199,7 @@ func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 	vd.Yield = gallery // If the gallery exists, store it in the Yield property of views.Data
 	// vd.User = user //Just for testing, DO NOT pass in user here. It's done in require_user middleware
 
-	g.EditView.Render(w, r, vd) //render the view with the data (temporary)
+	g.renderEdit(w, r, vd) //render the view with the data (temporary)
 }
 
 // POST /galleries/:id/images
@@ -135,36 +227,43 @@ func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 	// 2. Include the gallery data (with or w/o errors) to be sent
 	var vd views.Data
 	vd.Yield = gallery
+
+	// 3. Limit the size of the whole request; the size of each file is checked by the ImageService
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
 	err = r.ParseMultipartForm(maxMultipartMem)
 	if err != nil {
-		vd.SetAlert(err)
-		g.EditView.Render(w, r, vd)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			vd.AlertError(fmt.Sprintf("The upload is too large. Please upload at most %d megabytes at a time.", maxUploadBytes>>20))
+		} else {
+			vd.SetAlert(err)
+		}
+		g.renderEdit(w, r, vd)
 		return
 	}
+	defer r.MultipartForm.RemoveAll()
 
 	// 4. Obtain the files uploaded
 	//"images" is the name of the upload input in the html
+	// A rejected file does not stop the rest of the files from being uploaded
 
+	var rejected models.ImageErrors
 	files := r.MultipartForm.File["images"]
 	for _, f := range files {
-		// Open the uploaded file
-		file, err := f.Open()
-		if err != nil {
-			vd.SetAlert(err)
-			g.EditView.Render(w, r, vd)
-			return
+		if _, err := uploadImage(g.is, gallery, user, f); err != nil {
+			logError(r, "uploading an image", err)
+			rejected = append(rejected, &models.ImageError{Filename: f.Filename, Err: err})
 		}
+	}
 
-		defer file.Close()
-
-		trimmedFilename := strings.Replace(f.Filename, " ", "", -1)
-
-		err = g.is.Create(gallery.ID, file, trimmedFilename)
-		if err != nil {
-			vd.SetAlert(err)
-			g.EditView.Render(w, r, vd)
-			return
+	if len(rejected) > 0 {
+		images, err := g.is.ByGalleryID(gallery.ID)
+		if err == nil {
+			gallery.Images = images
 		}
+		vd.SetAlert(rejected)
+		g.renderEdit(w, r, vd)
+		return
 	}
 
 	//After uploading the image, get the edit_gallery named route
@@ -172,7 +271,7 @@ func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 
 	//If there's an error, route to the gallery as the image has been uploaded
 	if err != nil {
-		log.Print(err)
+		logError(r, "building the edit gallery url", err)
 		http.Redirect(w, r, "/galleries", http.StatusFound)
 		return
 	}
@@ -182,8 +281,27 @@ func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 
 }
 
-// POST /galleries/:id/images/:filename/delete
-// data: gallery_id, filename
+// uploadImage stores a single file of an upload
+// It is shared by the upload form and the API
+func uploadImage(is models.ImageService, gallery *models.Gallery, user *models.User, f *multipart.FileHeader) (*models.Image, error) {
+	// Open the uploaded file
+	file, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	image := models.Image{
+		GalleryID: gallery.ID,
+		UserID:    user.ID,
+	}
+	if err := is.Upload(&image, file); err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+// POST /galleries/:id/images/:image_id/delete
 
 func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
 
@@ -202,28 +320,25 @@ func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	filename := mux.Vars(r)["filename"]
-	// fmt.Fprintln(w, filename) //Check if the filename is retrieved from the url
-
-	i := models.Image{
-		Filename:  filename,
-		GalleryID: gallery.ID,
+	image, err := g.imageByID(w, r, gallery)
+	if err != nil {
+		return
 	}
 
-	err = g.is.Delete(&i)
+	err = g.is.Delete(image)
 
 	if err != nil {
 		var vd views.Data
 		vd.Yield = gallery
 		vd.SetAlert(err)
-		g.EditView.Render(w, r, vd)
+		g.renderEdit(w, r, vd)
 		return
 	}
 
 	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
 
 	if err != nil {
-		log.Print(err)
+		logError(r, "building the edit gallery url", err)
 		http.Redirect(w, r, "/galleries", http.StatusFound)
 		return
 	}
@@ -232,6 +347,56 @@ func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// POST /galleries/:id/images/:image_id/update
+// data: caption
+
+func (g *Galleries) ImageUpdate(w http.ResponseWriter, r *http.Request) {
+
+	gallery, err := g.galleryByID(w, r)
+
+	if err != nil {
+		return
+	}
+
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+
+	image, err := g.imageByID(w, r, gallery)
+	if err != nil {
+		return
+	}
+
+	vd := views.Data{}
+	vd.Yield = gallery
+
+	var form ImageForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+
+	image.Caption = strings.TrimSpace(form.Caption)
+	if err := g.is.Update(image); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+
+	// reload the images so that the new caption is displayed
+	images, _ := g.is.ByGalleryID(gallery.ID)
+	gallery.Images = images
+
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Caption successfully updated!",
+	}
+	g.renderEdit(w, r, vd)
+}
+
 // POST /galleries/:id/update
 
 func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
@@ -258,14 +423,15 @@ func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
 
 	if err := parseForm(r, &form); err != nil {
 		vd.SetAlert(err)
-		g.EditView.Render(w, r, vd)
+		g.renderEdit(w, r, vd)
 		return
 	}
 
 	gallery.Title = form.Title
+	gallery.Visibility = form.Visibility
 	if err := g.gs.Update(gallery); err != nil {
 		vd.SetAlert(err)
-		g.EditView.Render(w, r, vd)
+		g.renderEdit(w, r, vd)
 		return
 	}
 
@@ -273,7 +439,7 @@ func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
 		Level:   views.AlertLvlSuccess,
 		Message: "Gallery successfully updated!",
 	}
-	g.EditView.Render(w, r, vd)
+	g.renderEdit(w, r, vd)
 }
 
 // Create is used to process the signup form when a user submits it.
@@ -294,8 +460,9 @@ func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 	user := context.User(r.Context())
 
 	var gallery = models.Gallery{
-		Title:  form.Title,
-		UserID: user.ID,
+		Title:      form.Title,
+		UserID:     user.ID,
+		Visibility: form.Visibility,
 	}
 
 	if err := g.gs.Create(&gallery); err != nil {
@@ -310,8 +477,6 @@ func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 	// e.g.: "/gallery/123"
 	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
 
-	fmt.Println(url)
-
 	if err != nil {
 		// Redirect the users to the galleries page
 		http.Redirect(w, r, "/galleries", http.StatusFound)
@@ -345,16 +510,31 @@ func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 
 	vd := views.Data{}
 
-	if err := g.gs.Delete(gallery); err != nil {
+	if err := deleteGallery(g.gs, g.is, g.sls, gallery); err != nil {
 		vd.SetAlert(err)
 		vd.Yield = gallery // If the gallery DOES NOT exists, store it in the Yield property of views.Data
-		g.EditView.Render(w, r, vd)
+		g.renderEdit(w, r, vd)
 		return
 	}
 
 	http.Redirect(w, r, "/galleries", http.StatusFound)
 }
 
+// deleteGallery removes the share links and the images (records and files) before the gallery itself
+// The gallery's images must be loaded
+// It is shared by the delete button and the API
+func deleteGallery(gs models.GalleryService, is models.ImageService, sls models.ShareLinkService, gallery *models.Gallery) error {
+	if err := sls.DeleteByGalleryID(gallery.ID); err != nil {
+		return err
+	}
+	for i := range gallery.Images {
+		if err := is.Delete(&gallery.Images[i]); err != nil {
+			return err
+		}
+	}
+	return gs.Delete(gallery)
+}
+
 func (g *Galleries) galleryByID(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
 
 	vars := mux.Vars(r)            // Use mux's Vars to obtain all variables sent via request
@@ -362,7 +542,7 @@ func (g *Galleries) galleryByID(w http.ResponseWriter, r *http.Request) (*models
 	id, err := strconv.Atoi(idStr) // And convert the id to integer
 
 	if err != nil {
-		log.Print(err)
+		logError(r, "parsing the gallery id", err)
 		http.Error(w, "Invalid gallery ID", http.StatusNotFound)
 		return nil, err
 	}
@@ -373,14 +553,66 @@ func (g *Galleries) galleryByID(w http.ResponseWriter, r *http.Request) (*models
 		case models.ErrNotFound:
 			http.Error(w, "Gallery not found.", http.StatusNotFound)
 		default:
-			log.Print(err)
+			logError(r, "looking up the gallery", err)
 			http.Error(w, "Whoops. Something went wrong!", http.StatusInternalServerError)
 		}
 		return nil, err
 	}
 
-	images, _ := g.is.ByGalleryID(gallery.ID)
-	gallery.Images = images
+	if err := g.loadImages(w, r, gallery); err != nil {
+		return nil, err
+	}
 
 	return gallery, nil
 }
+
+// loadImages sets the gallery's images, writing an error response if they cannot be loaded
+func (g *Galleries) loadImages(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+	images, err := g.is.ByGalleryID(gallery.ID)
+	if err != nil {
+		logError(r, "listing the images", err)
+		http.Error(w, "Whoops. Something went wrong!", http.StatusInternalServerError)
+		return err
+	}
+	gallery.Images = images
+	return nil
+}
+
+// imageByID looks up the image in the url and makes sure that it belongs to the gallery
+func (g *Galleries) imageByID(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) (*models.Image, error) {
+
+	id, err := strconv.Atoi(mux.Vars(r)["image_id"])
+	if err != nil {
+		logError(r, "parsing the image id", err)
+		http.Error(w, "Invalid image ID", http.StatusNotFound)
+		return nil, err
+	}
+
+	for i := range gallery.Images {
+		if gallery.Images[i].ID == uint(id) {
+			return &gallery.Images[i], nil
+		}
+	}
+
+	http.Error(w, "Image not found", http.StatusNotFound)
+	return nil, models.ErrNotFound
+}
+
+// renderEdit renders the edit page, loading the gallery's share links for the management section
+// and signing the embed links of its images
+func (g *Galleries) renderEdit(w http.ResponseWriter, r *http.Request, vd views.Data) {
+	if gallery, ok := vd.Yield.(*models.Gallery); ok {
+		if gallery.ShareLinks == nil {
+			links, err := g.sls.ByGalleryID(gallery.ID)
+			if err != nil {
+				logError(r, "listing the share links", err)
+			}
+			gallery.ShareLinks = links
+		}
+		for i := range gallery.Images {
+			image := &gallery.Images[i]
+			image.EmbedURL = g.baseURL + g.is.SignedURL(image, "medium", embedURLTTL)
+		}
+	}
+	g.EditView.Render(w, r, vd)
+}
@@ -0,0 +1,56 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// readyTimeout is how long /readyz waits for the database and the image store
+const readyTimeout = 3 * time.Second
+
+// ReadyChecker reports whether the app can serve requests, see models.Services.Ready
+type ReadyChecker interface {
+	Ready(ctx context.Context) error
+}
+
+// Health answers the probes of the orchestrator that runs the app
+type Health struct {
+	rc ReadyChecker
+}
+
+func NewHealth(rc ReadyChecker) *Health {
+	return &Health{
+		rc: rc,
+	}
+}
+
+// GET /healthz
+// The app is alive as long as it answers at all, so this never looks at the database:
+// a database outage should not get every instance restarted
+
+func (h *Health) Live(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte("ok\n"))
+}
+
+// GET /readyz
+// The app is ready when the database answers and the image store works (see models.Services.Ready);
+// until then the orchestrator keeps sending the requests to other instances
+
+func (h *Health) Ready(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Cache-Control", "no-store")
+
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	if err := h.rc.Ready(ctx); err != nil {
+		logError(r, "not ready", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("not ready\n"))
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
@@ -1,11 +1,20 @@
 package controllers
 
 import (
+	"net"
 	"net/http"
+	"net/url"
 
 	"github.com/gorilla/schema"
+	"lenslocked.com/context"
 )
 
+// logError logs an error that the user does not get to see,
+// with the ID of the request it happened in (see context.Logger)
+func logError(r *http.Request, msg string, err error) {
+	context.Logger(r.Context()).Error(msg, "err", err)
+}
+
 func parseForm(r *http.Request, destination interface{}) error {
 
 	// try to test the error for parsing the form when creating a user
@@ -20,11 +29,32 @@ func parseForm(r *http.Request, destination interface{}) error {
 	// fmt.Fprintln(w, r.PostForm["email"]) // r.Postform = map[string][]string
 
 	//use gorilla schema to handle the form request
+	return parseValues(r.PostForm, destination)
+}
+
+// parseURLParams works like parseForm but reads the values from the url query,
+// e.g. the token in /reset?token=abc
+func parseURLParams(r *http.Request, destination interface{}) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	return parseValues(r.Form, destination)
+}
+
+func parseValues(values url.Values, destination interface{}) error {
 	dec := schema.NewDecoder()
 	dec.IgnoreUnknownKeys(true)
-	if err := dec.Decode(destination, r.PostForm); err != nil {
+	if err := dec.Decode(destination, values); err != nil {
 		panic(err)
 	}
-
 	return nil
 }
+
+// clientIP returns the IP address of the client without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
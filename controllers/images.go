@@ -0,0 +1,115 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+)
+
+// Images serves the image files
+// Every request resolves the gallery the image belongs to and applies the gallery's access rules,
+// so the files of a private gallery cannot be fetched by someone who merely knows their url
+type Images struct {
+	gs  models.GalleryService
+	is  models.ImageService
+	sls models.ShareLinkService
+}
+
+func NewImages(gs models.GalleryService, is models.ImageService, sls models.ShareLinkService) *Images {
+	return &Images{
+		gs:  gs,
+		is:  is,
+		sls: sls,
+	}
+}
+
+// GET /images/galleries/:id/:filename
+// GET /images/galleries/:id/:size/:filename
+// The file is sent when one of these holds:
+//   - the url carries a valid signature (see ImageService.SignedURL), e.g. for an image embedded elsewhere
+//   - the gallery may be seen: private galleries by their owner, unlisted and public galleries by anyone
+//     (the filenames of uploaded and backfilled images are random, so they cannot be guessed from an unlisted gallery's ID)
+//   - the visitor has opened one of the gallery's share links (see ShowShared)
+//
+// Anything else is a 404, so that the request does not reveal whether the image exists
+// Range requests and conditional requests (If-None-Match, If-Modified-Since) are handled by http.ServeContent
+
+func (i *Images) Serve(w http.ResponseWriter, r *http.Request) {
+
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	gallery, err := i.gs.ByID(uint(id))
+	if err != nil {
+		if err != models.ErrNotFound {
+			logError(r, "looking up the gallery", err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	image, err := i.is.ByFilename(gallery.ID, vars["filename"])
+	if err != nil {
+		if err != models.ErrNotFound {
+			logError(r, "looking up the image", err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	size := vars["size"]
+	sig := r.URL.Query().Get("sig")
+	signed := sig != "" && i.is.ValidSignature(image, size, sig)
+	if !signed && !gallery.CanViewBySlug(context.User(r.Context())) && !i.shareImagesAllowed(r, gallery) {
+		http.NotFound(w, r)
+		return
+	}
+
+	file, err := i.is.Open(image, size)
+	if err != nil {
+		if err != models.ErrNotFound {
+			logError(r, "opening the image", err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	// The presigned url expires, so the redirect itself is only briefly cached
+	if file.RedirectURL != "" {
+		w.Header().Set("Cache-Control", "private, max-age=60")
+		http.Redirect(w, r, file.RedirectURL, http.StatusFound)
+		return
+	}
+	defer file.Content.Close()
+
+	// Images of public galleries may be kept by shared caches
+	// Everything else must be revalidated, so that the access rules are applied again;
+	// thanks to the ETag that is a cheap 304 when the browser already has the file
+	if gallery.Visibility == models.VisibilityPublic {
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+	} else {
+		w.Header().Set("Cache-Control", "private, no-cache")
+	}
+
+	// Uploaded files never change, so the image, the size and the file's size and time identify the content
+	w.Header().Set("ETag", fmt.Sprintf(`"%d-%s-%d-%x"`, image.ID, size, file.Size, file.ModTime.UnixNano()))
+
+	http.ServeContent(w, r, image.Filename, file.ModTime, file.Content)
+}
+
+// shareImagesAllowed reports whether the request carries the cookie set by ShowShared for the gallery
+func (i *Images) shareImagesAllowed(r *http.Request, gallery *models.Gallery) bool {
+	cookie, err := r.Cookie(shareImagesCookie)
+	if err != nil {
+		return false
+	}
+	return i.sls.ImagesAllowed(gallery.ID, cookie.Value)
+}
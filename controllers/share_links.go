@@ -0,0 +1,272 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+	"lenslocked.com/views"
+)
+
+const (
+	// shareUnlockCookie remembers that the visitor entered the password of a share link
+	shareUnlockCookie = "share_unlock"
+
+	// shareImagesCookie lets the visitor of a share link fetch the gallery's images
+	shareImagesCookie = "share_images"
+)
+
+// ShareLinkForm is the form in the share links section of the edit page
+// ExpiresInDays and MaxViews are optional, 0 means no expiry and no view limit
+type ShareLinkForm struct {
+	Label         string `schema:"label"`
+	ExpiresInDays int    `schema:"expires_in_days"`
+	MaxViews      int    `schema:"max_views"`
+	Password      string `schema:"password" json:"-"`
+}
+
+type SharePasswordForm struct {
+	Password string `schema:"password" json:"-"`
+}
+
+// POST /galleries/:id/share
+
+func (g *Galleries) CreateShareLink(w http.ResponseWriter, r *http.Request) {
+
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+
+	vd := views.Data{}
+	vd.Yield = gallery
+
+	var form ShareLinkForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+
+	link := models.ShareLink{
+		GalleryID: gallery.ID,
+		Label:     strings.TrimSpace(form.Label),
+		MaxViews:  form.MaxViews,
+		Password:  form.Password,
+	}
+	if form.ExpiresInDays != 0 {
+		expiresAt := time.Now().Add(time.Duration(form.ExpiresInDays) * 24 * time.Hour)
+		link.ExpiresAt = &expiresAt
+	}
+
+	if err := g.sls.Create(&link); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+
+	// The raw token is only known now, so the new link is put in the list
+	// with its Token set for the page to show it this one time
+	links, err := g.sls.ByGalleryID(gallery.ID)
+	if err != nil {
+		logError(r, "listing the share links", err)
+	}
+	for i := range links {
+		if links[i].ID == link.ID {
+			links[i].Token = link.Token
+		}
+	}
+	gallery.ShareLinks = links
+
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Share link created! Copy it now, it will not be shown again.",
+	}
+	g.renderEdit(w, r, vd)
+}
+
+// POST /galleries/:id/share/:link_id/delete
+
+func (g *Galleries) RevokeShareLink(w http.ResponseWriter, r *http.Request) {
+
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["link_id"])
+	if err != nil {
+		http.Error(w, "Invalid share link ID", http.StatusNotFound)
+		return
+	}
+
+	// Make sure the link belongs to this gallery before removing it
+	link, err := g.sls.ByID(uint(id))
+	if err != nil || link.GalleryID != gallery.ID {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+
+	vd := views.Data{}
+	vd.Yield = gallery
+
+	if err := g.sls.Delete(link.ID); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, vd)
+		return
+	}
+
+	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
+	if err != nil {
+		logError(r, "building the edit gallery url", err)
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+
+	views.RedirectAlert(w, r, url.Path, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Share link revoked.",
+	})
+}
+
+// GET /s/:token
+// Shows the gallery to anyone who has the link, without a login
+
+func (g *Galleries) ShowShared(w http.ResponseWriter, r *http.Request) {
+
+	link, gallery, err := g.sharedGallery(w, r)
+	if err != nil {
+		return
+	}
+
+	if link.HasPassword() {
+		cookie, err := r.Cookie(shareUnlockCookie)
+		if err != nil || !g.sls.Unlocked(link, cookie.Value) {
+			g.SharePasswordView.Render(w, r, views.Data{})
+			return
+		}
+	}
+
+	if err := g.sls.AddView(link); err != nil {
+		g.renderShareErr(w, r, err)
+		return
+	}
+
+	if err := g.loadImages(w, r, gallery); err != nil {
+		return
+	}
+
+	// The images of a private gallery are only served to visitors that have this cookie
+	http.SetCookie(w, &http.Cookie{
+		Name:     shareImagesCookie,
+		Value:    g.sls.ImagesToken(link),
+		Path:     fmt.Sprintf("/images/galleries/%d/", gallery.ID),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	vd := views.Data{}
+	vd.Yield = gallery
+	g.ShowView.Render(w, r, vd)
+}
+
+// POST /s/:token
+// Checks the password of a share link
+
+func (g *Galleries) UnlockShared(w http.ResponseWriter, r *http.Request) {
+
+	link, _, err := g.sharedGallery(w, r)
+	if err != nil {
+		return
+	}
+
+	vd := views.Data{}
+
+	// Passwords are throttled per link like logins, see AttemptService
+	subject := fmt.Sprintf("share:link:%d", link.ID)
+	if err := g.as.Check(subject); err != nil {
+		if lockErr, ok := err.(*models.LockoutError); ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(lockErr.RetryAfter.Seconds())+1))
+		}
+		vd.SetAlert(err)
+		g.SharePasswordView.Render(w, r, vd)
+		return
+	}
+
+	var form SharePasswordForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.SharePasswordView.Render(w, r, vd)
+		return
+	}
+
+	if err := g.sls.CheckPassword(link, form.Password); err != nil {
+		if err := g.as.Fail(subject); err != nil {
+			logError(r, "recording a failed attempt", err)
+		}
+		vd.SetAlert(err)
+		g.SharePasswordView.Render(w, r, vd)
+		return
+	}
+
+	if err := g.as.Reset(subject); err != nil {
+		logError(r, "resetting the failed attempts", err)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     shareUnlockCookie,
+		Value:    g.sls.UnlockToken(link),
+		Path:     r.URL.Path,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, r.URL.Path, http.StatusFound)
+}
+
+// sharedGallery looks up the share link in the url and its gallery,
+// writing the error response when either cannot be found
+func (g *Galleries) sharedGallery(w http.ResponseWriter, r *http.Request) (*models.ShareLink, *models.Gallery, error) {
+
+	link, err := g.sls.ByToken(mux.Vars(r)["token"])
+	if err != nil {
+		g.renderShareErr(w, r, err)
+		return nil, nil, err
+	}
+
+	gallery, err := g.gs.ByID(link.GalleryID)
+	if err != nil {
+		g.renderShareErr(w, r, err)
+		return nil, nil, err
+	}
+
+	return link, gallery, nil
+}
+
+func (g *Galleries) renderShareErr(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case models.ErrNotFound:
+		http.Error(w, "Gallery not found.", http.StatusNotFound)
+	case models.ErrShareLinkExpired:
+		http.Error(w, "This link has expired.", http.StatusGone)
+	default:
+		logError(r, "looking up the share link", err)
+		http.Error(w, "Whoops. Something went wrong!", http.StatusInternalServerError)
+	}
+}
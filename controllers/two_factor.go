@@ -0,0 +1,220 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+	"lenslocked.com/views"
+)
+
+// pendingTOTPCookie holds the signed token given to a user that
+// has entered their password but not yet their two-factor code
+const pendingTOTPCookie = "pending_2fa"
+
+// TOTPForm is used for every form that asks for a two-factor code
+type TOTPForm struct {
+	Code string `schema:"code" json:"-"`
+}
+
+// totpSetupYield is the data rendered by the two-factor settings page
+type totpSetupYield struct {
+	Enabled       bool
+	Secret        string
+	URI           string
+	QRCode        template.URL
+	RecoveryCodes []string
+}
+
+// POST /login/2fa
+// CompleteTOTP is the second step of the login for users with two-factor authentication
+// The user is only signed in once a valid code has been provided
+func (u *Users) CompleteTOTP(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form TOTPForm
+
+	cookie, err := r.Cookie(pendingTOTPCookie)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	user, err := u.us.ByPendingTOTPToken(cookie.Value)
+	if err != nil {
+		alert := views.Alert{
+			Level:   views.AlertLvlWarning,
+			Message: "Your login has expired, please log in again.",
+		}
+		views.RedirectAlert(w, r, "/login", http.StatusFound, alert)
+		return
+	}
+
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.TOTPView.Render(w, r, vd)
+		return
+	}
+
+	// Codes are guessed against the same counters as passwords
+	subjects := loginSubjects(r, user.Email)
+	if err := u.as.Check(subjects...); err != nil {
+		u.renderAttemptErr(w, r, u.TOTPView, vd, err)
+		return
+	}
+
+	if err := u.us.ValidateTOTP(user, form.Code); err != nil {
+		if err == models.ErrTOTPInvalid {
+			u.failAttempt(r, subjects...)
+		}
+		vd.SetAlert(err)
+		u.TOTPView.Render(w, r, vd)
+		return
+	}
+
+	if err := u.as.Reset(subjects...); err != nil {
+		logError(r, "resetting the failed attempts", err)
+	}
+
+	u.clearPendingTOTP(w)
+
+	if err := u.signIn(w, r, user); err != nil {
+		vd.SetAlert(err)
+		u.LoginView.Render(w, r, vd)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Welcome to Lenslocked.com",
+	}
+	views.RedirectAlert(w, r, "/galleries", http.StatusFound, alert)
+}
+
+// GET /2fa
+// TOTPSettings shows whether two-factor authentication is enabled
+func (u *Users) TOTPSettings(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	var vd views.Data
+	vd.Yield = totpSetupYield{Enabled: user.TwoFactorEnabled()}
+	u.TOTPSetup.Render(w, r, vd)
+}
+
+// POST /2fa/enroll
+// EnrollTOTP generates a new secret and shows the QR code to scan
+func (u *Users) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	var vd views.Data
+
+	uri, err := u.us.EnrollTOTP(user)
+	if err != nil {
+		vd.SetAlert(err)
+		vd.Yield = totpSetupYield{Enabled: user.TwoFactorEnabled()}
+		u.TOTPSetup.Render(w, r, vd)
+		return
+	}
+
+	yield := totpSetupYield{
+		Secret: user.TOTPSecret,
+		URI:    uri,
+	}
+
+	// The QR code is embedded as a data URI so that the secret is never sent to a third party
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		logError(r, "encoding the QR code", err)
+	} else {
+		yield.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	}
+
+	vd.Yield = yield
+	u.TOTPSetup.Render(w, r, vd)
+}
+
+// POST /2fa/confirm
+// ConfirmTOTP enables two-factor authentication and shows the recovery codes once
+func (u *Users) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	var vd views.Data
+	var form TOTPForm
+	vd.Yield = totpSetupYield{Enabled: user.TwoFactorEnabled()}
+
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.TOTPSetup.Render(w, r, vd)
+		return
+	}
+
+	codes, err := u.us.EnableTOTP(user, form.Code)
+	if err != nil {
+		vd.SetAlert(err)
+		u.TOTPSetup.Render(w, r, vd)
+		return
+	}
+
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Two-factor authentication has been enabled. Store your recovery codes somewhere safe, they will not be shown again.",
+	}
+	vd.Yield = totpSetupYield{
+		Enabled:       true,
+		RecoveryCodes: codes,
+	}
+	u.TOTPSetup.Render(w, r, vd)
+}
+
+// POST /2fa/disable
+func (u *Users) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	var vd views.Data
+	var form TOTPForm
+	vd.Yield = totpSetupYield{Enabled: user.TwoFactorEnabled()}
+
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.TOTPSetup.Render(w, r, vd)
+		return
+	}
+
+	if err := u.us.DisableTOTP(user, form.Code); err != nil {
+		vd.SetAlert(err)
+		u.TOTPSetup.Render(w, r, vd)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Two-factor authentication has been disabled.",
+	}
+	views.RedirectAlert(w, r, "/2fa", http.StatusFound, alert)
+}
+
+func (u *Users) setPendingTOTP(w http.ResponseWriter, user *models.User) {
+	cookie := http.Cookie{
+		Name:     pendingTOTPCookie,
+		Value:    u.us.PendingTOTPToken(user),
+		Path:     "/login",
+		Expires:  time.Now().Add(5 * time.Minute),
+		HttpOnly: true,
+	}
+	http.SetCookie(w, &cookie)
+}
+
+func (u *Users) clearPendingTOTP(w http.ResponseWriter) {
+	cookie := http.Cookie{
+		Name:     pendingTOTPCookie,
+		Value:    "",
+		Path:     "/login",
+		Expires:  time.Now(),
+		HttpOnly: true,
+	}
+	http.SetCookie(w, &cookie)
+}
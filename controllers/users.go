@@ -2,28 +2,49 @@ package controllers
 
 import (
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/gorilla/mux"
 	"lenslocked.com/context"
+	"lenslocked.com/email"
 	"lenslocked.com/models"
-	"lenslocked.com/rand"
 	"lenslocked.com/views"
 )
 
 type Users struct {
-	NewView   *views.View
-	LoginView *views.View
-	us        models.UserService
+	NewView      *views.View
+	LoginView    *views.View
+	ForgotPwView *views.View
+	ResetPwView  *views.View
+	VerifyView   *views.View
+	SessionsView *views.View
+	TOTPView     *views.View
+	TOTPSetup    *views.View
+	us           models.UserService
+	ss           models.SessionService
+	as           models.AttemptService
+	emailer      *email.Client
 }
 
 // NewUsers is used to create a Users controller
 // This function will panic if the templates are not parsed correctly
 // and should only be used during initial setup
-func NewUsers(us models.UserService) *Users {
+func NewUsers(us models.UserService, ss models.SessionService, as models.AttemptService, emailer *email.Client) *Users {
 	return &Users{
-		NewView:   views.NewView("bootstrap", "users/new"),
-		LoginView: views.NewView("bootstrap", "users/login"),
-		us:        us,
+		NewView:      views.NewView("bootstrap", "users/new"),
+		LoginView:    views.NewView("bootstrap", "users/login"),
+		ForgotPwView: views.NewView("bootstrap", "users/forgot_pw"),
+		ResetPwView:  views.NewView("bootstrap", "users/reset_pw"),
+		VerifyView:   views.NewView("bootstrap", "users/verify"),
+		SessionsView: views.NewView("bootstrap", "users/sessions"),
+		TOTPView:     views.NewView("bootstrap", "users/totp"),
+		TOTPSetup:    views.NewView("bootstrap", "users/totp_setup"),
+		us:           us,
+		ss:           ss,
+		as:           as,
+		emailer:      emailer,
 	}
 }
 
@@ -36,7 +57,7 @@ func (u *Users) New(w http.ResponseWriter, r *http.Request) {
 type SignupForm struct {
 	Name     string `schema:"name"`
 	Email    string `schema:"email"`
-	Password string `schema:"password"`
+	Password string `schema:"password" json:"-"`
 	Age      uint   `schema:"age"`
 }
 
@@ -57,6 +78,14 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Failed signups are counted per IP, as the form could otherwise be used
+	// to find out which email addresses have an account
+	subjects := []string{"signup:ip:" + clientIP(r)}
+	if err := u.as.Check(subjects...); err != nil {
+		u.renderAttemptErr(w, r, u.NewView, vd, err)
+		return
+	}
+
 	var user = models.User{
 		Name:     form.Name,
 		Email:    form.Email,
@@ -65,12 +94,20 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := u.us.Create(&user); err != nil {
+		if err := u.as.Fail(subjects...); err != nil {
+			logError(r, "recording a failed attempt", err)
+		}
 		vd.SetAlert(err)
 		u.NewView.Render(w, r, vd)
 		return
 	}
 
-	err := u.signIn(w, &user)
+	// A failed email is not fatal as the user can ask for the link to be resent
+	if err := u.sendVerification(&user); err != nil {
+		logError(r, "sending the verification email", err)
+	}
+
+	err := u.signIn(w, r, &user)
 
 	if err != nil {
 		http.Redirect(w, r, "login", http.StatusFound)
@@ -86,7 +123,7 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 
 type LoginForm struct {
 	Email    string `schema:"email"`
-	Password string `schema:"password"`
+	Password string `schema:"password" json:"-"`
 }
 
 func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
@@ -100,12 +137,23 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Locked out clients are turned away before bcrypt is run
+	subjects := loginSubjects(r, form.Email)
+	if err := u.as.Check(subjects...); err != nil {
+		u.renderAttemptErr(w, r, u.LoginView, vd, err)
+		return
+	}
+
 	user, err := u.us.Authenticate(form.Email, form.Password)
 
 	if err != nil {
 		switch err {
 		case models.ErrNotFound:
+			u.failAttempt(r, subjects...)
 			vd.AlertError("Invalid Email Address .")
+		case models.ErrInvalidPassword:
+			u.failAttempt(r, subjects...)
+			vd.SetAlert(err)
 		default:
 			vd.SetAlert(err)
 		}
@@ -113,7 +161,20 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = u.signIn(w, user)
+	// Users with two-factor authentication are only signed in
+	// once they have provided a code on the /login/2fa page,
+	// so the counters are not reset until then
+	if user.TwoFactorEnabled() {
+		u.setPendingTOTP(w, user)
+		http.Redirect(w, r, "/login/2fa", http.StatusFound)
+		return
+	}
+
+	if err := u.as.Reset(subjects...); err != nil {
+		logError(r, "resetting the failed attempts", err)
+	}
+
+	err = u.signIn(w, r, user)
 
 	if err != nil {
 		vd.SetAlert(err)
@@ -129,50 +190,343 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// loginSubjects are the attempt counters used for a login: one for the client's IP
+// and one for the account, so that neither a single IP guessing many passwords
+// nor many IPs guessing one account's password get unlimited tries
+func loginSubjects(r *http.Request, email string) []string {
+	return []string{
+		"login:ip:" + clientIP(r),
+		"login:email:" + strings.ToLower(strings.TrimSpace(email)),
+	}
+}
+
+// failAttempt records a failed attempt; a failure to record it is only logged
+// as the user should still see the original error
+func (u *Users) failAttempt(r *http.Request, subjects ...string) {
+	if err := u.as.Fail(subjects...); err != nil {
+		logError(r, "recording a failed attempt", err)
+	}
+}
+
+// renderAttemptErr renders the error from AttemptService.Check,
+// telling the client when to retry if it is locked out
+func (u *Users) renderAttemptErr(w http.ResponseWriter, r *http.Request, view *views.View, vd views.Data, err error) {
+	if lockErr, ok := err.(*models.LockoutError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(lockErr.RetryAfter.Seconds())+1))
+	}
+	vd.SetAlert(err)
+	view.Render(w, r, vd)
+}
+
 // Logout deletes a user's session cookie (remember_token)
-// and then will update the user resource with a new member token
+// and then revokes the session so that only this device is signed out
 // POST/logout
 func (u *Users) Logout(w http.ResponseWriter, r *http.Request) {
 
 	cookie := http.Cookie{
 		Name:     "remember_token",
 		Value:    "",
+		Path:     "/",
 		Expires:  time.Now(),
 		HttpOnly: true,
 	}
 
 	http.SetCookie(w, &cookie)
 
+	if session := context.Session(r.Context()); session != nil {
+		if err := u.ss.Delete(session.ID); err != nil {
+			logError(r, "deleting the session", err)
+		}
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+
+}
+
+// sessionsYield is the data rendered by the active sessions page
+type sessionsYield struct {
+	Sessions  []models.Session
+	CurrentID uint
+}
+
+// GET /sessions
+// Sessions lists the devices that the user is logged in on
+func (u *Users) Sessions(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
 	user := context.User(r.Context())
-	token, _ := rand.RememberToken()
 
-	user.Remember = token
-	u.us.Update(user)
-	http.Redirect(w, r, "/", http.StatusFound)
+	sessions, err := u.ss.ByUserID(user.ID)
+	if err != nil {
+		vd.SetAlert(err)
+		u.SessionsView.Render(w, r, vd)
+		return
+	}
 
+	yield := sessionsYield{Sessions: sessions}
+	if current := context.Session(r.Context()); current != nil {
+		yield.CurrentID = current.ID
+	}
+	vd.Yield = yield
+
+	u.SessionsView.Render(w, r, vd)
 }
 
-// SignIn is used to sign the given user in via cookies
+// POST /sessions/:id/delete
+// RevokeSession signs the user out of a single device
+func (u *Users) RevokeSession(w http.ResponseWriter, r *http.Request) {
 
-func (u *Users) signIn(w http.ResponseWriter, user *models.User) error {
+	user := context.User(r.Context())
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid session ID", http.StatusNotFound)
+		return
+	}
+
+	// Only sessions that belong to the user can be revoked
+	sessions, err := u.ss.ByUserID(user.ID)
+	if err != nil {
+		logError(r, "listing the sessions", err)
+		http.Error(w, "Whoops. Something went wrong!", http.StatusInternalServerError)
+		return
+	}
+
+	for _, session := range sessions {
+		if session.ID != uint(id) {
+			continue
+		}
+
+		if err := u.ss.Delete(session.ID); err != nil {
+			var vd views.Data
+			vd.SetAlert(err)
+			u.SessionsView.Render(w, r, vd)
+			return
+		}
+
+		alert := views.Alert{
+			Level:   views.AlertLvlSuccess,
+			Message: "The session has been signed out.",
+		}
+		views.RedirectAlert(w, r, "/sessions", http.StatusFound, alert)
+		return
+	}
+
+	http.Error(w, "Session not found", http.StatusNotFound)
+}
+
+// ResetPwForm is used for both the forgot password form (email only)
+// and the reset password form (token and new password)
+type ResetPwForm struct {
+	Email    string `schema:"email"`
+	Token    string `schema:"token" json:"-"`
+	Password string `schema:"password" json:"-"`
+}
+
+// POST /forgot
+// InitiateReset creates a reset token and emails it to the user
+func (u *Users) InitiateReset(w http.ResponseWriter, r *http.Request) {
 
-	if user.Remember == "" {
-		remember, err := rand.RememberToken()
+	var vd views.Data
+	var form ResetPwForm
+	vd.Yield = &form
 
-		if err != nil {
-			return err
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.ForgotPwView.Render(w, r, vd)
+		return
+	}
+
+	token, err := u.us.InitiateReset(form.Email)
+
+	// An unknown email gets the same response as a known one
+	// so that the form cannot be used to find out who has an account
+	switch err {
+	case nil:
+		if err := u.emailer.ResetPw(form.Email, token); err != nil {
+			vd.SetAlert(err)
+			u.ForgotPwView.Render(w, r, vd)
+			return
 		}
+	case models.ErrNotFound:
+	default:
+		vd.SetAlert(err)
+		u.ForgotPwView.Render(w, r, vd)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "If an account exists for that email address, instructions for resetting your password have been sent to it.",
+	}
+	views.RedirectAlert(w, r, "/reset", http.StatusFound, alert)
+}
+
+// GET /reset
+// ResetPw renders the reset password form, prefilling the token from the url if there is one
+func (u *Users) ResetPw(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form ResetPwForm
+	vd.Yield = &form
+
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+	}
+
+	u.ResetPwView.Render(w, r, vd)
+}
+
+// POST /reset
+// CompleteReset sets the new password and signs the user in
+func (u *Users) CompleteReset(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form ResetPwForm
+	vd.Yield = &form
+
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.ResetPwView.Render(w, r, vd)
+		return
+	}
+
+	user, err := u.us.CompleteReset(form.Token, form.Password)
+	if err != nil {
+		vd.SetAlert(err)
+		u.ResetPwView.Render(w, r, vd)
+		return
+	}
+
+	// Whoever knew the old password should no longer be logged in anywhere
+	if err := u.ss.DeleteByUserID(user.ID); err != nil {
+		logError(r, "deleting the sessions", err)
+	}
 
-		user.Remember = remember
-		err = u.us.Update(user)
-		if err != nil {
-			return err
+	// The reset link only proves access to the inbox, so users with two-factor
+	// authentication still have to provide a code, just like in Login
+	if user.TwoFactorEnabled() {
+		u.setPendingTOTP(w, user)
+		alert := views.Alert{
+			Level:   views.AlertLvlSuccess,
+			Message: "Your password has been reset. Please enter the code from your authenticator app to log in.",
 		}
+		views.RedirectAlert(w, r, "/login/2fa", http.StatusFound, alert)
+		return
+	}
+
+	if err := u.signIn(w, r, user); err != nil {
+		logError(r, "signing in", err)
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your password has been reset and you have been logged in!",
+	}
+	views.RedirectAlert(w, r, "/galleries", http.StatusFound, alert)
+}
+
+// VerifyForm holds the token from the link in the verification email
+type VerifyForm struct {
+	Token string `schema:"token" json:"-"`
+}
+
+// GET /verify
+// Verify confirms the user's email address when a token is provided
+// Without a token, it renders the page that allows the link to be resent
+func (u *Users) Verify(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	var form VerifyForm
+
+	if err := parseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.VerifyView.Render(w, r, vd)
+		return
+	}
+
+	if form.Token == "" {
+		u.VerifyView.Render(w, r, vd)
+		return
+	}
+
+	if _, err := u.us.Verify(form.Token); err != nil {
+		vd.SetAlert(err)
+		u.VerifyView.Render(w, r, vd)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Thanks for confirming your email address!",
+	}
+	views.RedirectAlert(w, r, "/galleries", http.StatusFound, alert)
+}
+
+// POST /verify/resend
+// ResendVerification sends a new verification link to the logged in user
+func (u *Users) ResendVerification(w http.ResponseWriter, r *http.Request) {
+
+	var vd views.Data
+	user := context.User(r.Context())
+
+	if user.Verified() {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+
+	// Every resend counts as an attempt, so that the form cannot be used to flood an inbox
+	// The counter is never reset; it expires on its own (see AttemptService)
+	subjects := []string{"verify:user:" + strconv.FormatUint(uint64(user.ID), 10), "verify:ip:" + clientIP(r)}
+	if err := u.as.Check(subjects...); err != nil {
+		u.renderAttemptErr(w, r, u.VerifyView, vd, err)
+		return
+	}
+	u.failAttempt(r, subjects...)
+
+	if err := u.sendVerification(user); err != nil {
+		vd.SetAlert(err)
+		u.VerifyView.Render(w, r, vd)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "A new verification link has been sent to " + user.Email + ".",
+	}
+	views.RedirectAlert(w, r, "/verify", http.StatusFound, alert)
+}
+
+// sendVerification emails a new verification link, which replaces the ones sent before
+func (u *Users) sendVerification(user *models.User) error {
+	token, err := u.us.VerificationToken(user)
+	if err != nil {
+		return err
+	}
+	return u.emailer.Verify(user.Email, token)
+}
+
+// SignIn is used to sign the given user in via cookies
+// Every sign in creates a new session, recording the device's user agent and IP
+
+func (u *Users) signIn(w http.ResponseWriter, r *http.Request, user *models.User) error {
+
+	session := models.Session{
+		UserID:    user.ID,
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
+	}
+
+	if err := u.ss.Create(&session); err != nil {
+		return err
 	}
 
 	cookie := http.Cookie{
 		Name:     "remember_token",
-		Value:    user.Remember,
+		Value:    session.Token,
+		Path:     "/", // without it, a cookie set by POST /login/2fa would only be sent to /login
+		Expires:  session.ExpiresAt,
 		HttpOnly: true,
 	}
 
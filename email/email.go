@@ -0,0 +1,149 @@
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultFrom is used when a sender is not given a from address
+	DefaultFrom = "support@lenslocked.com"
+
+	resetSubject = "Instructions for resetting your password."
+	resetText    = `Hi there!
+
+It appears that you have requested a password reset. If this was you, please follow the link below to update your password:
+
+%s
+
+If you are asked for a token, please use the following value:
+
+%s
+
+If you didn't request a password reset you can safely ignore this email and your account will not be changed.
+
+Best,
+LensLocked Support
+`
+
+	verifySubject = "Please confirm your email address."
+	verifyText    = `Hi there!
+
+Thanks for signing up to LensLocked. Please follow the link below to confirm your email address:
+
+%s
+
+The link will expire, but you can request a new one from the site at any time.
+
+Best,
+LensLocked Support
+`
+)
+
+// Sender is the interface our application uses to deliver emails
+// This allows the delivery mechanism to be swapped out,
+// e.g. a real SMTP server in production and a local stand-in during development
+type Sender interface {
+	Send(to, subject, text string) error
+}
+
+// Client wraps a Sender and knows how to compose the emails our application sends
+type Client struct {
+	sender  Sender
+	baseURL string
+}
+
+// NewClient creates a Client that sends email through the provided sender
+// baseURL is used to construct links, e.g. "http://localhost:3000"
+func NewClient(sender Sender, baseURL string) *Client {
+	return &Client{
+		sender:  sender,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+// ResetPw sends the password reset email with a link containing the token
+func (c *Client) ResetPw(toEmail, token string) error {
+	v := url.Values{}
+	v.Set("token", token)
+	link := c.baseURL + "/reset?" + v.Encode()
+	return c.sender.Send(toEmail, resetSubject, fmt.Sprintf(resetText, link, token))
+}
+
+// Verify sends the email verification link containing the signed token
+func (c *Client) Verify(toEmail, token string) error {
+	v := url.Values{}
+	v.Set("token", token)
+	link := c.baseURL + "/verify?" + v.Encode()
+	return c.sender.Send(toEmail, verifySubject, fmt.Sprintf(verifyText, link))
+}
+
+// ************** THIS SECTION CONTAINS THE SENDER IMPLEMENTATIONS **************
+
+// SMTPConfig is the connection information for an SMTP server
+// A local stand-in such as MailHog can be used by pointing this at localhost:1025
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+// SMTPSender delivers emails through an SMTP server
+type SMTPSender struct {
+	cfg SMTPConfig
+}
+
+var _ Sender = &SMTPSender{}
+
+func NewSMTPSender(cfg SMTPConfig) *SMTPSender {
+	if cfg.From == "" {
+		cfg.From = DefaultFrom
+	}
+	return &SMTPSender{cfg: cfg}
+}
+
+// Send writes a plain text email to the SMTP server
+// Authentication is only used when a username is provided
+func (s *SMTPSender) Send(to, subject, text string) error {
+	addr := fmt.Sprintf("%s:%d", s.cfg.Host, s.cfg.Port)
+
+	var auth smtp.Auth
+	if s.cfg.Username != "" {
+		auth = smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, s.cfg.Host)
+	}
+
+	return smtp.SendMail(addr, auth, s.cfg.From, []string{to}, message(s.cfg.From, to, subject, text))
+}
+
+// LogSender prints emails to the log instead of sending them, through the app's slog handler
+// It is used in development when no SMTP server is configured
+// IMPORTANT: the whole email is logged, tokens included, so it must never be used in production
+type LogSender struct{}
+
+var _ Sender = LogSender{}
+
+func (LogSender) Send(to, subject, text string) error {
+	slog.Info("email", "to", to, "subject", subject, "body", text)
+	return nil
+}
+
+// message builds the raw RFC 5322 message for the SMTP DATA command
+func message(from, to, subject, text string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=\"utf-8\"\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(text, "\n", "\r\n"))
+	return buf.Bytes()
+}
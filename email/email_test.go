@@ -0,0 +1,240 @@
+package email
+
+import (
+	"bufio"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// sentEmail is an email as a Sender was asked to deliver it
+type sentEmail struct {
+	To, Subject, Text string
+}
+
+// recordingSender keeps the emails instead of sending them
+type recordingSender struct {
+	sent []sentEmail
+}
+
+func (s *recordingSender) Send(to, subject, text string) error {
+	s.sent = append(s.sent, sentEmail{To: to, Subject: subject, Text: text})
+	return nil
+}
+
+// linkToken finds the link starting with prefix in text and returns its token parameter
+func linkToken(t *testing.T, text, prefix string) string {
+	t.Helper()
+	for _, field := range strings.Fields(text) {
+		if !strings.HasPrefix(field, prefix) {
+			continue
+		}
+		u, err := url.Parse(field)
+		if err != nil {
+			t.Fatalf("parsing the link %q: %v", field, err)
+		}
+		return u.Query().Get("token")
+	}
+	t.Fatalf("no link starting with %s in:\n%s", prefix, text)
+	return ""
+}
+
+func TestClientEmails(t *testing.T) {
+	tests := []struct {
+		name    string
+		send    func(c *Client) error
+		to      string
+		subject string
+		link    string
+		token   string
+	}{
+		{
+			name:    "reset",
+			send:    func(c *Client) error { return c.ResetPw("jon@example.com", "reset+token/=") },
+			to:      "jon@example.com",
+			subject: resetSubject,
+			link:    "http://localhost:3000/reset?",
+			token:   "reset+token/=",
+		},
+		{
+			name:    "verify",
+			send:    func(c *Client) error { return c.Verify("ann@example.com", "verify.token") },
+			to:      "ann@example.com",
+			subject: verifySubject,
+			link:    "http://localhost:3000/verify?",
+			token:   "verify.token",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := &recordingSender{}
+			// the trailing slash of the base url must not end up in the link
+			c := NewClient(sender, "http://localhost:3000/")
+
+			if err := tt.send(c); err != nil {
+				t.Fatal(err)
+			}
+			if len(sender.sent) != 1 {
+				t.Fatalf("sent %d emails, want 1", len(sender.sent))
+			}
+			got := sender.sent[0]
+			if got.To != tt.to {
+				t.Errorf("To = %q, want %q", got.To, tt.to)
+			}
+			if got.Subject != tt.subject {
+				t.Errorf("Subject = %q, want %q", got.Subject, tt.subject)
+			}
+			if token := linkToken(t, got.Text, tt.link); token != tt.token {
+				t.Errorf("the link carries the token %q, want %q", token, tt.token)
+			}
+		})
+	}
+}
+
+// ************** THIS SECTION CONTAINS THE LOCAL SMTP STAND-IN **************
+
+// smtpMessage is a message received by fakeSMTP
+type smtpMessage struct {
+	From string
+	To   []string
+	Data string
+}
+
+// fakeSMTP is an in-process SMTP server that keeps the messages it receives
+// It speaks just enough SMTP for net/smtp.SendMail, without TLS or authentication
+type fakeSMTP struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	messages []smtpMessage
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTP{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTP) config() SMTPConfig {
+	addr := s.ln.Addr().(*net.TCPAddr)
+	return SMTPConfig{Host: addr.IP.String(), Port: addr.Port}
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost fake SMTP")
+
+	var msg smtpMessage
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.Fields(line + " ")[0])
+		switch cmd {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250 localhost")
+		case "MAIL":
+			msg = smtpMessage{From: smtpAddress(line)}
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			msg.To = append(msg.To, smtpAddress(line))
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.Data = string(data)
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("250 OK")
+		}
+	}
+}
+
+// smtpAddress returns the address between the angle brackets of MAIL FROM:<...> or RCPT TO:<...>
+func smtpAddress(line string) string {
+	start, end := strings.Index(line, "<"), strings.Index(line, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+	return line[start+1 : end]
+}
+
+func (s *fakeSMTP) received() []smtpMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]smtpMessage(nil), s.messages...)
+}
+
+func TestSMTPSenderResetEmail(t *testing.T) {
+	server := newFakeSMTP(t)
+	cfg := server.config()
+	cfg.From = "noreply@lenslocked.com"
+	c := NewClient(NewSMTPSender(cfg), "https://lenslocked.com")
+
+	if err := c.ResetPw("jon@example.com", "abc123"); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := server.received()
+	if len(messages) != 1 {
+		t.Fatalf("the server received %d messages, want 1", len(messages))
+	}
+	msg := messages[0]
+	if msg.From != "noreply@lenslocked.com" {
+		t.Errorf("MAIL FROM = %q", msg.From)
+	}
+	if len(msg.To) != 1 || msg.To[0] != "jon@example.com" {
+		t.Errorf("RCPT TO = %q", msg.To)
+	}
+
+	header, err := textproto.NewReader(bufio.NewReader(strings.NewReader(msg.Data))).ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := header.Get("To"); got != "jon@example.com" {
+		t.Errorf("To header = %q", got)
+	}
+	if got := header.Get("Subject"); got != resetSubject {
+		t.Errorf("Subject header = %q", got)
+	}
+	if token := linkToken(t, msg.Data, "https://lenslocked.com/reset?"); token != "abc123" {
+		t.Errorf("the link carries the token %q, want %q", token, "abc123")
+	}
+}
+
+func TestNewSMTPSenderDefaultFrom(t *testing.T) {
+	s := NewSMTPSender(SMTPConfig{Host: "localhost", Port: 1025})
+	if s.cfg.From != DefaultFrom {
+		t.Errorf("From = %q, want %q", s.cfg.From, DefaultFrom)
+	}
+}
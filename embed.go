@@ -0,0 +1,40 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"os"
+
+	"lenslocked.com/views"
+)
+
+// The assets and the migrations are embedded in the binary along with the templates
+// (see views.UseDir), so that it runs from any directory
+// The uploaded images are not part of the binary, they are kept where storage.local_dir
+// (or the S3 bucket) says, which can be an absolute path
+var (
+	//go:embed assets
+	embeddedAssets embed.FS
+
+	//go:embed migrations
+	embeddedMigrations embed.FS
+)
+
+// appFiles returns the directory dir of the app, either from the disk
+// (relative to the working directory) or from the copy embedded in the binary
+func appFiles(fromDisk bool, embedded embed.FS, dir string) fs.FS {
+	if fromDisk {
+		return os.DirFS(dir)
+	}
+	sub, err := fs.Sub(embedded, dir)
+	must(err)
+	return sub
+}
+
+// useDiskFiles makes the templates read from the views directory, so that they
+// are parsed again for every request and edits show up without a restart
+func useDiskFiles(fromDisk bool) {
+	if fromDisk {
+		views.UseDir("views")
+	}
+}
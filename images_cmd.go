@@ -0,0 +1,25 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"lenslocked.com/models"
+)
+
+const imagesUsage = `usage: lenslocked.com images <command>
+
+commands:
+  backfill      create records for the files in images/galleries/<id>/ that are not in the database yet,
+                moving each file to a random filename`
+
+// runImages handles the "images backfill" subcommand
+func runImages(services *models.Services, args []string) error {
+	if len(args) != 2 || args[1] != "backfill" {
+		return errors.New(imagesUsage)
+	}
+
+	n, err := services.BackfillImages()
+	fmt.Printf("Imported %d images\n", n)
+	return err
+}
@@ -3,14 +3,19 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
 	"lenslocked.com/controllers"
+	"lenslocked.com/email"
 	"lenslocked.com/middleware"
 	"lenslocked.com/models"
-	"lenslocked.com/rand"
+	"lenslocked.com/views"
 )
 
 func notFound(w http.ResponseWriter, r *http.Request) {
@@ -20,49 +25,141 @@ func notFound(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// csrfFailed is used when a POST request does not carry a valid CSRF token
+// API clients get the error in the JSON envelope, see views/json.go
+func csrfFailed(w http.ResponseWriter, r *http.Request) {
+	msg := "Forbidden - " + csrf.FailureReason(r).Error()
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		views.RenderJSONMessage(w, http.StatusForbidden, msg)
+		return
+	}
+	http.Error(w, msg, http.StatusForbidden)
+}
+
 func main() {
 
 	// Use: go run *.go --help to view the instruction
 	// Use: go build . && ./lenslocked.com -prod to run for production
 	// Use: go build . && ./lenslocked.com to run in development
+	// Use: go build . && ./lenslocked.com migrate up|down|status|new to manage the database schema
+	// Use: go build . && ./lenslocked.com images backfill to import images uploaded before they were kept in the database
+	// Use: go build . && ./lenslocked.com openapi check|write to compare or update docs/openapi.json
+	// Use: go build . && ./lenslocked.com -config lenslocked.yaml to read the config from another file (JSON, YAML or TOML)
+	// Any setting can also be given as a LENSLOCKED_* environment variable, see config_load.go
 	boolPtr := flag.Bool("prod", false, "Provide this flag in production to ensure that a config file is provided before the application starts.")
+	configPath := flag.String("config", "", "The config file, in JSON, YAML (.yaml, .yml) or TOML (.toml). Defaults to .config when it exists.")
 	flag.Parse()
 
+	// Creating a migration only writes files, so it is done before connecting to the database
+	if isMigrateNew(flag.Args()) {
+		must(migrateNew(flag.Args()))
+		return
+	}
+
+	// The OpenAPI document only depends on the code
+	if isOpenAPI(flag.Args()) {
+		must(runOpenAPI(flag.Args()))
+		return
+	}
+
 	// Setup the connection string to the database "lenslocked_dev"
-	cfg := LoadConfig(*boolPtr)
+	cfg, err := LoadConfig(*configPath, *boolPtr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// Everything logged from here on uses the log format of the config,
+	// with the request ID and user ID when it happens while handling a request (see context.Logger)
+	slog.SetDefault(cfg.Logger(os.Stdout))
+	logConfig(cfg)
+
+	// With from_disk the templates, assets and migrations are read from the repo
+	// instead of the binary; this has to happen before the views are created below
+	useDiskFiles(cfg.FromDisk)
 	dbCfg := cfg.Database
 
+	// Uploaded images go to the local disk or to an S3 bucket
+	blobStore, err := cfg.Storage.BlobStore()
+	must(err)
+
 	// Connect to the database using the above connection string
 	services, err := models.NewServices(
-		models.WithGorm(dbCfg.Dialect(), dbCfg.Connection()),
+		models.WithGorm(dbCfg.Dialect, dbCfg.Connection()),
+		models.WithMigrations(appFiles(cfg.FromDisk, embeddedMigrations, migrationsDir)),
 		models.WithLogMode(!cfg.IsProd()),
-		models.WithUser(cfg.Pepper, cfg.HMACKey),
+		models.WithUser(cfg.Pepper, cfg.HMACKey,
+			time.Duration(cfg.PwResetMinutes)*time.Minute,
+			time.Duration(cfg.VerifyHours)*time.Hour,
+		),
+		models.WithSession(cfg.HMACKey, time.Duration(cfg.SessionDays)*24*time.Hour),
+		models.WithAttempts(cfg.AttemptStore != "database"),
+		models.WithAPIToken(cfg.HMACKey),
+		models.WithShareLink(cfg.Pepper, cfg.HMACKey),
 		models.WithGallery(),
-		models.WithImage(),
+		models.WithImage(blobStore, cfg.Storage.Sizes(), cfg.Storage.MaxImagePixels, cfg.HMACKey),
 	)
 
 	// Print a panic statement if the database cannot be connected
 	must(err)
 
-	// TO FIX: Close and Automigrate
+	// The database connection is closed when main returns,
+	// which is after the server has finished the requests in flight (see serve)
 	defer services.Close()
-	services.AutoMigrate()
+
+	if args := flag.Args(); len(args) > 0 {
+		switch args[0] {
+		case "migrate":
+			must(runMigrate(services, args))
+		case "images":
+			// the images table has to exist before it can be filled
+			must(checkMigrations(services, cfg.IsProd()))
+			must(runImages(services, args))
+		default:
+			must(fmt.Errorf("unknown command %q", args[0]))
+		}
+		return
+	}
+
+	must(checkMigrations(services, cfg.IsProd()))
+
+	// Emails are printed to the log unless an SMTP server is configured, which Validate requires in production
+	var sender email.Sender = email.LogSender{}
+	if mailCfg := cfg.Mail; mailCfg.Host != "" {
+		sender = email.NewSMTPSender(email.SMTPConfig{
+			Host:     mailCfg.Host,
+			Port:     mailCfg.Port,
+			Username: mailCfg.Username,
+			Password: mailCfg.Password,
+			From:     mailCfg.From,
+		})
+	}
+	emailer := email.NewClient(sender, cfg.BaseURL)
 
 	r := mux.NewRouter() //instantiate a variable r which stores the gorilla mux router
-	usersC := controllers.NewUsers(services.User)
-	galleriesC := controllers.NewGalleries(services.Gallery, services.Image, r) //Update: pass the mux router to NewGalleries controller to create named routes
+	usersC := controllers.NewUsers(services.User, services.Session, services.Attempts, emailer)
+	galleriesC := controllers.NewGalleries(services.Gallery, services.Image, services.Share, services.Attempts, r, cfg.BaseURL) //Update: pass the mux router to NewGalleries controller to create named routes
+	imagesC := controllers.NewImages(services.Gallery, services.Image, services.Share)
+	apiC := controllers.NewAPI(services.User, services.Gallery, services.Image, services.Share)
+	apiTokensC := controllers.NewAPITokens(services.APIToken)
 	staticC := controllers.NewStatic()
 
 	// CSRF middleware
-	bytes, err := rand.Bytes(32)
-	must(err)
-	csrfMw := csrf.Protect(bytes, csrf.Secure(cfg.IsProd()))
+	// The keys come from the config, so that a restart doesn't break the forms that are open
+	// and every instance accepts the tokens of the others
+	csrfMW := middleware.NewCSRF(cfg.CSRF.KeyBytes(), time.Duration(cfg.CSRF.GraceMinutes)*time.Minute,
+		cfg.IsProd(), http.HandlerFunc(csrfFailed))
 
 	// Testing the RequireUser middleware
 	// Instantiate the middleware
 	// By passing the UseMW to requireUserMW, we know that when requireUserMW is run UserMW is already run
-	userMW := middleware.User{UserService: services.User}
+	userMW := middleware.User{
+		UserService:     services.User,
+		SessionService:  services.Session,
+		APITokenService: services.APIToken,
+	}
 	requireUserMW := middleware.RequireUser{User: userMW}
+	requireVerifiedMW := middleware.RequireVerifiedUser{RequireUser: requireUserMW}
+	requireAPIUserMW := middleware.RequireAPIUser{User: userMW}
 
 	r.Handle("/", staticC.Home).Methods("GET")
 	r.Handle("/contact", staticC.Contact).Methods("GET")
@@ -71,20 +168,38 @@ func main() {
 	r.HandleFunc("/signup", usersC.Create).Methods("POST") //this handler for /signups manages e POST method
 	r.Handle("/login", usersC.LoginView).Methods("GET")    //this handles for /login manages e GET method
 	r.HandleFunc("/login", usersC.Login).Methods("POST")   //this handler for /login manages e POST method
+	r.Handle("/login/2fa", usersC.TOTPView).Methods("GET")
+	r.HandleFunc("/login/2fa", usersC.CompleteTOTP).Methods("POST")
+	r.Handle("/forgot", usersC.ForgotPwView).Methods("GET")
+	r.HandleFunc("/forgot", usersC.InitiateReset).Methods("POST")
+	r.HandleFunc("/reset", usersC.ResetPw).Methods("GET")
+	r.HandleFunc("/reset", usersC.CompleteReset).Methods("POST")
+	r.HandleFunc("/verify", usersC.Verify).Methods("GET")
+	r.HandleFunc("/verify/resend", requireUserMW.ApplyFn(usersC.ResendVerification)).Methods("POST")
 
 	userLogout := requireUserMW.ApplyFn(usersC.Logout)
 	r.HandleFunc("/logout", userLogout).Methods("POST") //this handler for /login manages e POST method
+	r.HandleFunc("/sessions", requireUserMW.ApplyFn(usersC.Sessions)).Methods("GET")
+	r.HandleFunc("/sessions/{id:[0-9]+}/delete", requireUserMW.ApplyFn(usersC.RevokeSession)).Methods("POST")
+	r.HandleFunc("/tokens", requireUserMW.ApplyFn(apiTokensC.Index)).Methods("GET")
+	r.HandleFunc("/tokens", requireUserMW.ApplyFn(apiTokensC.Create)).Methods("POST")
+	r.HandleFunc("/tokens/{id:[0-9]+}/delete", requireUserMW.ApplyFn(apiTokensC.Revoke)).Methods("POST")
+	r.HandleFunc("/2fa", requireUserMW.ApplyFn(usersC.TOTPSettings)).Methods("GET")
+	r.HandleFunc("/2fa/enroll", requireUserMW.ApplyFn(usersC.EnrollTOTP)).Methods("POST")
+	r.HandleFunc("/2fa/confirm", requireUserMW.ApplyFn(usersC.ConfirmTOTP)).Methods("POST")
+	r.HandleFunc("/2fa/disable", requireUserMW.ApplyFn(usersC.DisableTOTP)).Methods("POST")
 	// r.HandleFunc("/cookietest", usersC.CookieTest).Methods("GET")
 
 	// When galleryNew is invoked, it would apply galleriesC.New to be processed
 	galleryNew := requireUserMW.Apply(galleriesC.New)
-	galleryCreate := requireUserMW.ApplyFn(galleriesC.Create)
+	galleryCreate := requireVerifiedMW.ApplyFn(galleriesC.Create)
 	galleryEdit := requireUserMW.ApplyFn(galleriesC.Edit)
 	galleryUpdate := requireUserMW.ApplyFn(galleriesC.Update)
 	galleryDelete := requireUserMW.ApplyFn(galleriesC.Delete)
 	galleryIndex := requireUserMW.ApplyFn(galleriesC.Index)
-	galleryImageUpload := requireUserMW.ApplyFn(galleriesC.ImageUpload)
+	galleryImageUpload := requireVerifiedMW.ApplyFn(galleriesC.ImageUpload)
 	galleryImageDelete := requireUserMW.ApplyFn(galleriesC.ImageDelete)
+	galleryImageUpdate := requireUserMW.ApplyFn(galleriesC.ImageUpdate)
 
 	// galleryRoutes
 	r.HandleFunc("/galleries", galleryIndex).Methods("GET")
@@ -95,22 +210,73 @@ func main() {
 	r.HandleFunc("/galleries/{id:[0-9]+}/delete", galleryDelete).Methods("POST")
 
 	r.HandleFunc("/galleries/{id:[0-9]+}/images", galleryImageUpload).Methods("POST")
-	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/delete", galleryImageDelete).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{image_id:[0-9]+}/delete", galleryImageDelete).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{image_id:[0-9]+}/update", galleryImageUpdate).Methods("POST")
+
+	r.HandleFunc("/galleries/{id:[0-9]+}/share", requireUserMW.ApplyFn(galleriesC.CreateShareLink)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/share/{link_id:[0-9]+}/delete", requireUserMW.ApplyFn(galleriesC.RevokeShareLink)).Methods("POST")
 
 	r.HandleFunc("/galleries/{id:[0-9]+}", galleriesC.Show).Methods("GET").Name(controllers.ShowGallery) // ShowGallery is a named route to construct the requests to a gallery with an id
+	r.HandleFunc("/g/{slug:[A-Za-z0-9_-]+}", galleriesC.ShowBySlug).Methods("GET")
+	r.HandleFunc("/s/{token:[A-Za-z0-9_=-]+}", galleriesC.ShowShared).Methods("GET")
+	r.HandleFunc("/s/{token:[A-Za-z0-9_=-]+}", galleriesC.UnlockShared).Methods("POST")
+	r.HandleFunc("/explore", galleriesC.Public).Methods("GET")
 
 	// //Assets
-	assetHandler := http.FileServer(http.Dir("./assets/"))
+	assetHandler := http.FileServer(http.FS(appFiles(cfg.FromDisk, embeddedAssets, "assets")))
 	r.PathPrefix("/assets/").Handler(http.StripPrefix("/assets/", assetHandler))
 
 	// // Image routes
-	imageHandler := http.FileServer(http.Dir("./images/"))
-	r.PathPrefix("/images/").Handler(http.StripPrefix("/images/", imageHandler))
+	// Images are only sent when the gallery they belong to may be seen
+	// (images kept in S3 are redirected to a short-lived presigned url)
+	r.HandleFunc("/images/galleries/{id:[0-9]+}/{filename}", imagesC.Serve).Methods("GET", "HEAD")
+	r.HandleFunc("/images/galleries/{id:[0-9]+}/{size}/{filename}", imagesC.Serve).Methods("GET", "HEAD")
+
+	// // API routes
+	// The JSON API for scripts and tools, see controllers/api.go and openapi_cmd.go
+	// Requests made with an API token (see /tokens) need the scope of the route
+	api := registerAPIRoutes(r, apiC, requireAPIUserMW)
+
+	// The OpenAPI document is generated from the routes above, so they can never disagree
+	apiDoc, err := apiDocument(api)
+	must(err)
+	apiDocsC, err := controllers.NewAPIDocs(apiDoc)
+	must(err)
+	r.HandleFunc("/api/openapi.json", apiDocsC.OpenAPI).Methods("GET")
+	r.HandleFunc("/api/docs", apiDocsC.Docs).Methods("GET")
+
+	// // Health routes
+	// Probes of the orchestrator: /healthz tells it the app is alive,
+	// /readyz that the database and the image store can be used
+	healthC := controllers.NewHealth(services)
+	r.HandleFunc("/healthz", healthC.Live).Methods("GET", "HEAD")
+	r.HandleFunc("/readyz", healthC.Ready).Methods("GET", "HEAD")
 
 	r.NotFoundHandler = http.HandlerFunc(notFound) //special property to handle notfound errors
 
-	fmt.Printf("Starting the server on: %d ... \n", cfg.Port)
-	http.ListenAndServe(fmt.Sprintf(":%d", cfg.Port), csrfMw(userMW.Apply(r)))
+	// The request log records the route that matched from within the router,
+	// and wraps everything else so that it sees the final status of every request
+	requestLogMW := middleware.RequestLog{}
+	r.Use(requestLogMW.Route)
+
+	// Every view has been created by now, so a broken template stops the app in production
+	// In development the app starts anyway, and the broken page shows what is wrong with it
+	views.ShowErrors(!cfg.IsProd())
+	if err := views.Validate(); err != nil {
+		if cfg.IsProd() {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		slog.Error("broken templates", "err", err)
+	}
+
+	// The security headers come before the user and csrf middleware,
+	// so that the responses they send themselves (e.g. a failed csrf check) have them as well
+	securityMW := cfg.SecurityHeaders()
+
+	srv := newServer(cfg, requestLogMW.Apply(securityMW.Apply(userMW.Apply(csrfMW.Apply(r)))))
+	slog.Info("starting the server", "port", cfg.Port)
+	must(serve(srv, time.Duration(cfg.Server.ShutdownTimeout)*time.Second))
 
 	//add r to ensure gorilla mux handles the routing process
 	// by adding userMW.Apply to r (route), i.e. http.ListenAndServe(":3000", userMW.Apply(r))
@@ -122,6 +288,8 @@ func main() {
 	// 	5. this will apply to every single route
 	// Also, by adding csrf middleware to r (route), it ensures that the routes with POST methods
 	// must be validated with a csrf token
+	// The user middleware runs first, so that it can tell the csrf middleware to skip
+	// the requests to the API that carry an API token (see middleware.User.applyAPIToken)
 
 	// Since all the routes have already applied the 1st pass of checking the cookie
 	// to ensure that a valid remmeber token and its hashed token belongs to a valid user
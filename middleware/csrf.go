@@ -0,0 +1,126 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/securecookie"
+)
+
+// csrfCookie is the cookie gorilla/csrf keeps the real token in
+const csrfCookie = "_gorilla_csrf"
+
+// csrfMaxAge is how long the CSRF cookie, and so an open form, stays valid (12 hours, as in gorilla/csrf)
+const csrfMaxAge = 12 * 60 * 60
+
+// CSRF protects the forms with gorilla/csrf, signing its cookie with the first of the keys
+// The other keys are the previous ones: cookies signed by them are still accepted during the
+// grace window, so that the forms opened before a key rotation (or on another instance
+// that still has the old key) can be submitted
+//
+// The keys come from the config rather than being made at start up,
+// so that restarts and the instances behind a load balancer accept each other's tokens
+type CSRF struct {
+	key        []byte
+	previous   []*securecookie.SecureCookie
+	graceUntil time.Time
+	secure     bool
+	onFailure  http.Handler
+}
+
+// NewCSRF returns the CSRF middleware
+// The previous keys are accepted for grace after the app starts
+// secure marks the cookie as HTTPS only; onFailure handles the requests without a valid token
+func NewCSRF(keys [][]byte, grace time.Duration, secure bool, onFailure http.Handler) *CSRF {
+	mw := &CSRF{
+		key:        keys[0],
+		graceUntil: time.Now().Add(grace),
+		secure:     secure,
+		onFailure:  onFailure,
+	}
+	for _, key := range keys[1:] {
+		mw.previous = append(mw.previous, newCSRFCodec(key))
+	}
+	return mw
+}
+
+// newCSRFCodec reads the cookie the way gorilla/csrf writes it
+func newCSRFCodec(key []byte) *securecookie.SecureCookie {
+	sc := securecookie.New(key, nil)
+	sc.SetSerializer(securecookie.JSONEncoder{})
+	sc.MaxAge(csrfMaxAge)
+	return sc
+}
+
+// Apply Method for CSRF struct
+func (mw *CSRF) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ApplyFn Method for CSRF struct
+func (mw *CSRF) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	protect := csrf.Protect(mw.key,
+		csrf.Secure(mw.secure),
+		csrf.Path("/"),
+		csrf.MaxAge(csrfMaxAge),
+		csrf.ErrorHandler(mw.onFailure),
+	)(next)
+
+	current := newCSRFCodec(mw.key)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(mw.previous) > 0 && time.Now().Before(mw.graceUntil) {
+			r = mw.resign(w, r, current)
+		}
+		protect.ServeHTTP(w, r)
+	})
+}
+
+// resign moves a cookie signed by a previous key over to the current key
+// The token inside stays the same, so the token of an open form still matches it
+// The request is changed for gorilla/csrf, and the browser is sent the new cookie
+func (mw *CSRF) resign(w http.ResponseWriter, r *http.Request, current *securecookie.SecureCookie) *http.Request {
+	cookie, err := r.Cookie(csrfCookie)
+	if err != nil {
+		return r
+	}
+
+	var token []byte
+	if current.Decode(csrfCookie, cookie.Value, &token) == nil {
+		return r
+	}
+
+	for _, previous := range mw.previous {
+		if previous.Decode(csrfCookie, cookie.Value, &token) != nil {
+			continue
+		}
+		encoded, err := current.Encode(csrfCookie, token)
+		if err != nil {
+			return r
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     csrfCookie,
+			Value:    encoded,
+			Path:     "/",
+			MaxAge:   csrfMaxAge,
+			Expires:  time.Now().Add(csrfMaxAge * time.Second),
+			HttpOnly: true,
+			Secure:   mw.secure,
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		var cookies []string
+		for _, c := range r.Cookies() {
+			if c.Name == csrfCookie {
+				c.Value = encoded
+			}
+			cookies = append(cookies, c.String())
+		}
+		r = r.Clone(r.Context())
+		r.Header.Set("Cookie", strings.Join(cookies, "; "))
+		return r
+	}
+	return r
+}
@@ -0,0 +1,107 @@
+package middleware
+
+import (
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/mux"
+	"lenslocked.com/context"
+	"lenslocked.com/rand"
+)
+
+// requestIDHeader carries the request ID, so that a request can be followed
+// from the load balancer to the log lines of the app
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID limits the IDs taken from incoming requests to what can safely be logged
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// RequestLog gives every request an ID and logs a line once the request is done
+// It must be the outermost middleware, so that it sees the final status of every request
+type RequestLog struct{}
+
+// Apply Method for RequestLog struct
+func (mw *RequestLog) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ApplyFn Method for RequestLog struct
+// The ID sent by a proxy in X-Request-ID is kept, otherwise a new one is made;
+// either way it is sent back in the response
+func (mw *RequestLog) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id, _ = rand.String(12)
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		info := &context.RequestInfo{ID: id}
+		r = r.WithContext(context.WithRequest(r.Context(), info))
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+
+		// The route is logged rather than the path, since paths can hold tokens (e.g. /s/{token})
+		// Only requests that match no route are logged by their path
+		attrs := []interface{}{
+			"method", r.Method,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration_ms", time.Since(start).Milliseconds(),
+		}
+		if info.Route != "" {
+			attrs = append(attrs, "route", info.Route)
+		} else {
+			attrs = append(attrs, "path", r.URL.Path)
+		}
+		context.Logger(r.Context()).Info("request", attrs...)
+	})
+}
+
+// Route records the route that matched the request, for the request log
+// It is used as a middleware of the router (router.Use), where the route is known
+func (mw *RequestLog) Route(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if info := context.Request(r.Context()); info != nil {
+			if route := mux.CurrentRoute(r); route != nil {
+				info.Route = route.GetName()
+				if info.Route == "" {
+					info.Route, _ = route.GetPathTemplate()
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// statusRecorder remembers the status code and the size of the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the features of the original ResponseWriter
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
@@ -4,15 +4,24 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/gorilla/csrf"
 	"lenslocked.com/context"
 	"lenslocked.com/models"
+	"lenslocked.com/views"
 )
 
 type User struct {
-	UserService models.UserService
+	UserService     models.UserService
+	SessionService  models.SessionService
+	APITokenService models.APITokenService
 }
 
+// lastSeenInterval limits how often a session's LastSeenAt is written,
+// so that not every request results in an update to the sessions table
+const lastSeenInterval = time.Minute
+
 // Apply function accepts and returns a http Handler method
 // It calls the ApplyFn function by passing to it the Handler function's method: ServeHTTP
 // This is where ServeHTTP passes to ResponseWriter and Request to ApplyFn
@@ -22,8 +31,8 @@ func (mw *User) Apply(next http.Handler) http.HandlerFunc {
 	return mw.ApplyFn(next.ServeHTTP)
 }
 
-// ApplyFn is the MIDDLEWARE that allows us to check if there's a valid remember token
-// ApplyFn then checks if the hased remember token has a valid user
+// ApplyFn is the MIDDLEWARE that allows us to check if there's a valid session token
+// ApplyFn then checks if the hashed session token has a valid session and user
 // It the user cookie is valid, it sets the context and calls the next handler to further process
 // the routing request for the requested page
 
@@ -32,12 +41,20 @@ func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		// Skip user lookup for static assets
+		// Images are not skipped since private galleries need to know who is asking
 		path := r.URL.Path
-		if strings.HasPrefix(path, "/assets/") || strings.HasPrefix(path, "/images/") {
+		if strings.HasPrefix(path, "/assets/") {
 			next(w, r)
 			return
 		}
 
+		// API tokens are only accepted by the API, so that a token cannot be used
+		// for the pages of the website where its scopes are not checked
+		if raw, ok := bearerToken(r); ok && strings.HasPrefix(path, "/api/") {
+			mw.applyAPIToken(w, r, raw, next)
+			return
+		}
+
 		cookie, err := r.Cookie("remember_token")
 
 		if err != nil {
@@ -45,23 +62,84 @@ func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		user, err := mw.UserService.ByRemember(cookie.Value)
+		session, err := mw.SessionService.ByToken(cookie.Value)
+
+		if err != nil {
+			next(w, r)
+			return
+		}
+
+		user, err := mw.UserService.ByID(session.UserID)
 
 		if err != nil {
 			next(w, r)
 			return
 		}
 
-		cxt := r.Context()                // get the context that is part of the request
-		cxt = context.WithUser(cxt, user) // provide the current context of the remember token's user
-		r = r.WithContext(cxt)            // this will update request with the new context that was just created
+		if time.Since(session.LastSeenAt) > lastSeenInterval {
+			session.LastSeenAt = time.Now()
+			if err := mw.SessionService.Update(session); err != nil {
+				context.Logger(r.Context()).Error("updating the session", "session_id", session.ID, "err", err)
+			}
+		}
+
+		cxt := r.Context()                      // get the context that is part of the request
+		cxt = context.WithUser(cxt, user)       // provide the current context of the session token's user
+		cxt = context.WithSession(cxt, session) // and the session itself so that it can be revoked on logout
+		r = r.WithContext(cxt)                  // this will update request with the new context that was just created
 
-		fmt.Println("Found User: ", user)
 		next(w, r)
 
 	})
 }
 
+// applyAPIToken looks up the user of a bearer token
+// A request with a token that is not valid goes on without a user, even if it has a session cookie,
+// so that RequireAPIUser turns it away with a 401
+//
+// The CSRF check protects cookies, which browsers send along on their own
+// A bearer token is only ever sent by a client that holds it, so the check is skipped for these requests only
+// (requests with a token that is not valid are not logged in at all, so they may skip it too)
+// This is why the User middleware has to run before the CSRF middleware (see main.go)
+func (mw *User) applyAPIToken(w http.ResponseWriter, r *http.Request, raw string, next http.HandlerFunc) {
+	r = csrf.UnsafeSkipCheck(r)
+
+	token, err := mw.APITokenService.ByToken(raw)
+	if err != nil {
+		next(w, r)
+		return
+	}
+
+	user, err := mw.UserService.ByID(token.UserID)
+	if err != nil {
+		next(w, r)
+		return
+	}
+
+	if token.LastUsedAt == nil || time.Since(*token.LastUsedAt) > lastSeenInterval {
+		now := time.Now()
+		token.LastUsedAt = &now
+		if err := mw.APITokenService.Update(token); err != nil {
+			context.Logger(r.Context()).Error("updating the API token", "token_id", token.ID, "err", err)
+		}
+	}
+
+	cxt := r.Context()
+	cxt = context.WithUser(cxt, user)
+	cxt = context.WithAPIToken(cxt, token)
+	next(w, r.WithContext(cxt))
+}
+
+// bearerToken returns the token of an "Authorization: Bearer <token>" header
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(auth[7:])
+	return token, token != ""
+}
+
 // RequireUser embeds the User object
 // RequireUser assumes that User middleware has already been run
 // Otherwise, it will not work correctly
@@ -89,3 +167,70 @@ func (mw *RequireUser) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 		next(w, r)
 	})
 }
+
+// RequireVerifiedUser embeds the RequireUser object
+// On top of requiring a logged in user, it requires that
+// the user has confirmed their email address
+type RequireVerifiedUser struct {
+	RequireUser
+}
+
+// Apply Method for RequireVerifiedUser struct
+func (mw *RequireVerifiedUser) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ApplyFn Method for RequireVerifiedUser struct
+// Users that have not verified their email address are sent to the /verify page
+// where they can request a new verification link
+func (mw *RequireVerifiedUser) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return mw.RequireUser.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+		user := context.User(r.Context())
+		if !user.Verified() {
+			alert := views.Alert{
+				Level:   views.AlertLvlWarning,
+				Message: "Please confirm your email address before continuing.",
+			}
+			views.RedirectAlert(w, r, "/verify", http.StatusFound, alert)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// RequireAPIUser works like RequireUser for the JSON API:
+// instead of redirecting to the login page, it responds with a 401 in the JSON envelope
+type RequireAPIUser struct {
+	User
+}
+
+// Apply Method for RequireAPIUser struct
+func (mw *RequireAPIUser) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ApplyFn Method for RequireAPIUser struct
+// Apply assumes that the User middleware has already been run
+func (mw *RequireAPIUser) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if context.User(r.Context()) == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			views.RenderJSONMessage(w, http.StatusUnauthorized, "Please log in or provide a valid API token.")
+			return
+		}
+		next(w, r)
+	})
+}
+
+// ApplyScope works like ApplyFn, and also requires the scope when the user
+// was looked up through an API token
+// Users that are logged in with their session cookie may use every route
+func (mw *RequireAPIUser) ApplyScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return mw.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+		if token := context.APIToken(r.Context()); token != nil && !token.HasScope(scope) {
+			views.RenderJSONMessage(w, http.StatusForbidden, fmt.Sprintf("This API token does not have the %s scope.", scope))
+			return
+		}
+		next(w, r)
+	})
+}
@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"lenslocked.com/context"
+	"lenslocked.com/rand"
+)
+
+// cspNonceBytes is the size of the random nonce, 18 bytes make 24 base64 characters without padding
+const cspNonceBytes = 18
+
+// SecurityHeaders sets the security headers of every response
+// A header left empty is not sent
+type SecurityHeaders struct {
+	// HSTSMaxAge is the max-age of Strict-Transport-Security in seconds, 0 doesn't send it
+	// Only send it when the app is served over HTTPS
+	HSTSMaxAge        int
+	FrameOptions      string
+	ReferrerPolicy    string
+	PermissionsPolicy string
+
+	// CSP holds the sources of each Content-Security-Policy directive, e.g. "img-src": {"'self'", "data:"}
+	// A new nonce is made for every request and added to script-src and style-src,
+	// the templates use it through the cspNonce function (see views.View.Render)
+	CSP map[string][]string
+
+	// CSPReportOnly sends the policy as Content-Security-Policy-Report-Only,
+	// so that the browser reports what it would block without blocking it
+	CSPReportOnly bool
+}
+
+// Apply Method for SecurityHeaders struct
+func (mw *SecurityHeaders) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ApplyFn Method for SecurityHeaders struct
+func (mw *SecurityHeaders) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	cspHeader := "Content-Security-Policy"
+	if mw.CSPReportOnly {
+		cspHeader = "Content-Security-Policy-Report-Only"
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		if mw.HSTSMaxAge > 0 {
+			h.Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d; includeSubDomains", mw.HSTSMaxAge))
+		}
+		setHeader(h, "X-Frame-Options", mw.FrameOptions)
+		setHeader(h, "Referrer-Policy", mw.ReferrerPolicy)
+		setHeader(h, "Permissions-Policy", mw.PermissionsPolicy)
+		h.Set("X-Content-Type-Options", "nosniff")
+
+		if len(mw.CSP) > 0 {
+			nonce, err := rand.String(cspNonceBytes)
+			if err != nil {
+				context.Logger(r.Context()).Error("making the CSP nonce", "err", err)
+				http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+				return
+			}
+			h.Set(cspHeader, mw.policy(nonce))
+			r = r.WithContext(context.WithCSPNonce(r.Context(), nonce))
+		}
+
+		next(w, r)
+	})
+}
+
+// policy writes the CSP directives in order, adding the nonce to script-src and style-src
+func (mw *SecurityHeaders) policy(nonce string) string {
+	directives := make([]string, 0, len(mw.CSP))
+	for name, sources := range mw.CSP {
+		if name == "script-src" || name == "style-src" {
+			sources = append(sources[:len(sources):len(sources)], "'nonce-"+nonce+"'")
+		}
+		directives = append(directives, strings.TrimSpace(name+" "+strings.Join(sources, " ")))
+	}
+	sort.Strings(directives)
+	return strings.Join(directives, "; ")
+}
+
+func setHeader(h http.Header, key, value string) {
+	if value != "" {
+		h.Set(key, value)
+	}
+}
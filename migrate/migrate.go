@@ -0,0 +1,325 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lockKey is the Postgres advisory lock held while migrating,
+// so that two instances starting at the same time don't both run the migrations
+const lockKey int64 = 7209385117
+
+// Migration is a single versioned change to the database schema
+// It is loaded from a pair of files, e.g. 0001_initial_schema.up.sql
+// and 0001_initial_schema.down.sql
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Irreversible reports whether the down file has nothing but comments,
+// e.g. the Postgres baseline, whose tables may have existed before the migrations
+// Down refuses to roll such a migration back instead of reporting that it did
+func (m Migration) Irreversible() bool {
+	for _, line := range strings.Split(m.Down, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "--") {
+			return false
+		}
+	}
+	return true
+}
+
+// ErrIrreversible is returned by Down for a migration that cannot be rolled back, see Migration.Irreversible
+var ErrIrreversible = errors.New("migrate: the migration cannot be rolled back")
+
+// Status is a migration along with when it was applied
+// AppliedAt is nil for pending migrations
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+var fileRegex = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Load reads the migrations from the root of fsys, ordered by version
+// Every migration must have both an up and a down file
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		match := fileRegex.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migrate: version %d is used by both %s and %s", version, m.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			m.Up = string(b)
+		} else {
+			m.Down = string(b)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migrate: %04d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Create writes an empty up and down file for a new migration to dir,
+// using the version after the highest one found in the directory
+func Create(dir, name string) ([]string, error) {
+	if !regexp.MustCompile(`^\w+$`).MatchString(name) {
+		return nil, fmt.Errorf("migrate: name %q may only contain letters, digits and underscores", name)
+	}
+
+	migrations, err := Load(os.DirFS(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	var version int64 = 1
+	if n := len(migrations); n > 0 {
+		version = migrations[n-1].Version + 1
+	}
+
+	var files []string
+	for _, direction := range []string{"up", "down"} {
+		path := filepath.Join(dir, fmt.Sprintf("%04d_%s.%s.sql", version, name, direction))
+		content := fmt.Sprintf("-- %04d_%s (%s)\n", version, name, direction)
+		if direction == "down" {
+			content += "-- Until this file has some SQL, the migration cannot be rolled back\n"
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			return nil, err
+		}
+		files = append(files, path)
+	}
+	return files, nil
+}
+
+// Runner applies and rolls back migrations, keeping track of them in the schema_migrations table
+type Runner struct {
+	db         *sql.DB
+	dialect    string
+	migrations []Migration
+}
+
+func NewRunner(db *sql.DB, dialect string, migrations []Migration) *Runner {
+	return &Runner{
+		db:         db,
+		dialect:    dialect,
+		migrations: migrations,
+	}
+}
+
+// Up applies every pending migration in order and returns the ones that were applied
+func (r *Runner) Up() ([]Migration, error) {
+	var applied []Migration
+	err := r.locked(func(conn *sql.Conn) error {
+		done, err := r.applied(conn)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range r.migrations {
+			if _, ok := done[m.Version]; ok {
+				continue
+			}
+			err := r.exec(conn, m.Up,
+				`INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)`,
+				m.Version, m.Name, time.Now())
+			if err != nil {
+				return fmt.Errorf("migrate: %04d_%s up: %w", m.Version, m.Name, err)
+			}
+			applied = append(applied, m)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down rolls back the most recently applied migration
+// It returns nil if there is nothing to roll back, and ErrIrreversible if it cannot be rolled back
+func (r *Runner) Down() (*Migration, error) {
+	var rolledBack *Migration
+	err := r.locked(func(conn *sql.Conn) error {
+		done, err := r.applied(conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(r.migrations) - 1; i >= 0; i-- {
+			m := r.migrations[i]
+			if _, ok := done[m.Version]; !ok {
+				continue
+			}
+			if m.Irreversible() {
+				return fmt.Errorf("%w: %04d_%s has no down SQL", ErrIrreversible, m.Version, m.Name)
+			}
+			err := r.exec(conn, m.Down,
+				`DELETE FROM schema_migrations WHERE version = $1`,
+				m.Version)
+			if err != nil {
+				return fmt.Errorf("migrate: %04d_%s down: %w", m.Version, m.Name, err)
+			}
+			rolledBack = &m
+			return nil
+		}
+		return nil
+	})
+	return rolledBack, err
+}
+
+// Status returns every known migration along with when it was applied
+func (r *Runner) Status() ([]Status, error) {
+	var statuses []Status
+	err := r.locked(func(conn *sql.Conn) error {
+		done, err := r.applied(conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range r.migrations {
+			s := Status{Migration: m}
+			if at, ok := done[m.Version]; ok {
+				s.AppliedAt = &at
+			}
+			statuses = append(statuses, s)
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// Pending returns the migrations that have not been applied yet
+func (r *Runner) Pending() ([]Migration, error) {
+	statuses, err := r.Status()
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, s := range statuses {
+		if s.AppliedAt == nil {
+			pending = append(pending, s.Migration)
+		}
+	}
+	return pending, nil
+}
+
+// locked runs fn on a single connection while holding the advisory lock
+// Advisory locks belong to the connection that took them, which is why
+// everything has to happen on the same *sql.Conn
+func (r *Runner) locked(fn func(conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := r.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// SQLite has no advisory locks, but only lets one connection write at a time anyway
+	if r.dialect == "postgres" {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockKey); err != nil {
+			return err
+		}
+		defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, lockKey)
+	}
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version BIGINT PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	return fn(conn)
+}
+
+// applied returns the versions found in schema_migrations and when they were applied
+func (r *Runner) applied(conn *sql.Conn) (map[int64]time.Time, error) {
+	rows, err := conn.QueryContext(context.Background(), `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	done := make(map[int64]time.Time)
+	for rows.Next() {
+		var version int64
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		done[version] = at
+	}
+	return done, rows.Err()
+}
+
+// exec runs the migration's SQL and the bookkeeping statement in a single transaction
+// so that a failed migration leaves neither the schema nor schema_migrations changed
+func (r *Runner) exec(conn *sql.Conn, migration, bookkeeping string, args ...interface{}) error {
+	ctx := context.Background()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(migration) != "" {
+		if _, err := tx.ExecContext(ctx, migration); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, bookkeeping, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,335 @@
+package migrate
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// postgresTestEnv holds the connection string of a Postgres database for the tests, as for the models tests
+// The tests only touch their own schema, migrate_test, which is dropped first
+const postgresTestEnv = "TEST_POSTGRES_URL"
+
+// testSchema keeps the tables of these tests apart from the rest of the Postgres database
+const testSchema = "migrate_test"
+
+// testDB is an empty database the runner tests run against
+type testDB struct {
+	dialect string
+	db      *sql.DB
+}
+
+// forEachDialect runs fn on an empty SQLite database, and on Postgres when postgresTestEnv is set
+func forEachDialect(t *testing.T, fn func(t *testing.T, tdb testDB)) {
+	t.Run("sqlite3", func(t *testing.T) {
+		// a file rather than :memory:, which would be a new database for every connection
+		db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		fn(t, testDB{dialect: "sqlite3", db: db})
+	})
+
+	t.Run("postgres", func(t *testing.T) {
+		conn := os.Getenv(postgresTestEnv)
+		if conn == "" {
+			t.Skip(postgresTestEnv + " is not set")
+		}
+		fn(t, testDB{dialect: "postgres", db: openPostgres(t, conn)})
+	})
+}
+
+// openPostgres returns a connection to conn whose tables go to an empty testSchema
+func openPostgres(t *testing.T, conn string) *sql.DB {
+	t.Helper()
+	admin, err := sql.Open("postgres", conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	if _, err := admin.Exec(`DROP SCHEMA IF EXISTS ` + testSchema + ` CASCADE; CREATE SCHEMA ` + testSchema); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(conn, "://") {
+		sep := "?"
+		if strings.Contains(conn, "?") {
+			sep = "&"
+		}
+		conn += sep + "search_path=" + testSchema
+	} else {
+		conn += " search_path=" + testSchema
+	}
+	db, err := sql.Open("postgres", conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// testMigrations are three migrations that create a table each
+var testMigrations = fstest.MapFS{
+	"0001_create_a.up.sql":   {Data: []byte("CREATE TABLE a (id integer);")},
+	"0001_create_a.down.sql": {Data: []byte("DROP TABLE a;")},
+	"0002_create_b.up.sql":   {Data: []byte("CREATE TABLE b (id integer);\nINSERT INTO b (id) VALUES (1);")},
+	"0002_create_b.down.sql": {Data: []byte("DROP TABLE b;")},
+	"0003_create_c.up.sql":   {Data: []byte("CREATE TABLE c (id integer);")},
+	"0003_create_c.down.sql": {Data: []byte("DROP TABLE c;")},
+}
+
+func mustLoad(t *testing.T, fsys fstest.MapFS) []Migration {
+	t.Helper()
+	migrations, err := Load(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return migrations
+}
+
+// tableExists reports whether the table can be queried
+func tableExists(db *sql.DB, table string) bool {
+	_, err := db.Exec(`SELECT COUNT(*) FROM ` + table)
+	return err == nil
+}
+
+// tables returns the tables that testMigrations create, e.g. "a,b" for 0001_create_a and 0002_create_b
+func tables(migrations []Migration) string {
+	var names []string
+	for _, m := range migrations {
+		names = append(names, strings.TrimPrefix(m.Name, "create_"))
+	}
+	return strings.Join(names, ",")
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name  string
+		files fstest.MapFS
+		want  []int64
+		err   string
+	}{
+		{
+			name: "ordered by version, not by name",
+			files: fstest.MapFS{
+				"0010_ten.up.sql":   {Data: []byte("-- 10")},
+				"0010_ten.down.sql": {Data: []byte("-- 10")},
+				"0002_two.up.sql":   {Data: []byte("-- 2")},
+				"0002_two.down.sql": {Data: []byte("-- 2")},
+				"1_one.up.sql":      {Data: []byte("-- 1")},
+				"1_one.down.sql":    {Data: []byte("-- 1")},
+				"README.md":         {Data: []byte("not a migration")},
+			},
+			want: []int64{1, 2, 10},
+		},
+		{
+			name: "missing down file",
+			files: fstest.MapFS{
+				"0001_one.up.sql": {Data: []byte("CREATE TABLE a (id integer);")},
+			},
+			err: "needs both an up and a down file",
+		},
+		{
+			name: "version used twice",
+			files: fstest.MapFS{
+				"0001_one.up.sql":   {Data: []byte("-- 1")},
+				"0001_one.down.sql": {Data: []byte("-- 1")},
+				"0001_two.up.sql":   {Data: []byte("-- 1")},
+			},
+			err: "version 1 is used by both",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrations, err := Load(tt.files)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Load() err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []int64
+			for _, m := range migrations {
+				got = append(got, m.Version)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Load() versions = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("Load() versions = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRunnerUpDown(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, tdb testDB) {
+		r := NewRunner(tdb.db, tdb.dialect, mustLoad(t, testMigrations))
+
+		applied, err := r.Up()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tables(applied); got != "a,b,c" {
+			t.Errorf("Up() applied %s, want a,b,c", got)
+		}
+
+		// running it again changes nothing
+		applied, err = r.Up()
+		if err != nil || len(applied) != 0 {
+			t.Errorf("Up() again applied %s, err = %v; want nothing", tables(applied), err)
+		}
+
+		// a partial down rolls back the newest migrations only
+		for _, want := range []string{"c", "b"} {
+			m, err := r.Down()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m == nil || tables([]Migration{*m}) != want {
+				t.Fatalf("Down() rolled back %v, want %s", m, want)
+			}
+		}
+		if !tableExists(tdb.db, "a") || tableExists(tdb.db, "b") || tableExists(tdb.db, "c") {
+			t.Error("after two Down() only the table a should be left")
+		}
+
+		statuses, err := r.Status()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range statuses {
+			if applied := s.AppliedAt != nil; applied != (s.Version == 1) {
+				t.Errorf("%04d_%s applied = %t", s.Version, s.Name, applied)
+			}
+		}
+		pending, err := r.Pending()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tables(pending); got != "b,c" {
+			t.Errorf("Pending() = %s, want b,c", got)
+		}
+
+		applied, err = r.Up()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tables(applied); got != "b,c" {
+			t.Errorf("Up() after Down() applied %s, want b,c", got)
+		}
+
+		for i := 0; i < 3; i++ {
+			if _, err := r.Down(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if m, err := r.Down(); m != nil || err != nil {
+			t.Errorf("Down() with nothing applied = %v, %v; want nil, nil", m, err)
+		}
+	})
+}
+
+func TestRunnerFailingMigration(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, tdb testDB) {
+		files := fstest.MapFS{}
+		for name, f := range testMigrations {
+			files[name] = f
+		}
+		// the table is created before the statement that fails, and must be gone again
+		files["0002_create_b.up.sql"] = &fstest.MapFile{Data: []byte("CREATE TABLE b (id integer);\nINSERT INTO missing (id) VALUES (1);")}
+		r := NewRunner(tdb.db, tdb.dialect, mustLoad(t, files))
+
+		applied, err := r.Up()
+		if err == nil || !strings.Contains(err.Error(), "0002_create_b up") {
+			t.Fatalf("Up() err = %v, want the error of 0002_create_b", err)
+		}
+		if got := tables(applied); got != "a" {
+			t.Errorf("Up() applied %s, want a", got)
+		}
+		if tableExists(tdb.db, "b") {
+			t.Error("the table of the failed migration was not rolled back")
+		}
+		if tableExists(tdb.db, "c") {
+			t.Error("the migration after the failed one was applied")
+		}
+
+		pending, err := r.Pending()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tables(pending); got != "b,c" {
+			t.Errorf("Pending() = %s, want b,c", got)
+		}
+	})
+}
+
+func TestRunnerIrreversible(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, tdb testDB) {
+		files := fstest.MapFS{
+			"0001_create_a.up.sql":   {Data: []byte("CREATE TABLE a (id integer);")},
+			"0001_create_a.down.sql": {Data: []byte("-- the table is kept\n\n")},
+		}
+		r := NewRunner(tdb.db, tdb.dialect, mustLoad(t, files))
+		if _, err := r.Up(); err != nil {
+			t.Fatal(err)
+		}
+
+		m, err := r.Down()
+		if !errors.Is(err, ErrIrreversible) || m != nil {
+			t.Fatalf("Down() = %v, %v; want nil, ErrIrreversible", m, err)
+		}
+		if pending, err := r.Pending(); err != nil || len(pending) != 0 {
+			t.Errorf("Pending() = %s, %v; the migration should still be applied", tables(pending), err)
+		}
+	})
+}
+
+// TestRunnerConcurrentUp starts two instances at once, which only Postgres allows:
+// the advisory lock makes the second one wait and find nothing left to apply
+func TestRunnerConcurrentUp(t *testing.T) {
+	conn := os.Getenv(postgresTestEnv)
+	if conn == "" {
+		t.Skip(postgresTestEnv + " is not set")
+	}
+	db := openPostgres(t, conn)
+	migrations := mustLoad(t, testMigrations)
+
+	const runners = 4
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var total int
+	for i := 0; i < runners; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			applied, err := NewRunner(db, "postgres", migrations).Up()
+			if err != nil {
+				t.Error(err)
+			}
+			mu.Lock()
+			total += len(applied)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if total != len(migrations) {
+		t.Errorf("the runners applied %d migrations in total, want %d", total, len(migrations))
+	}
+}
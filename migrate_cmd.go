@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"lenslocked.com/migrate"
+	"lenslocked.com/models"
+)
+
+// migrationsDir holds the versioned SQL files applied by the migrate subcommands,
+// in a directory for each database dialect, e.g. migrations/postgres and migrations/sqlite3
+const migrationsDir = "migrations"
+
+// migrationDialects are the dialects that have their own migrations
+// The directories are kept in step: every migration exists for every dialect, with the same version
+var migrationDialects = []string{"postgres", "sqlite3"}
+
+const migrateUsage = `usage: lenslocked.com migrate <command>
+
+commands:
+  up            apply every pending migration
+  down          roll back the most recently applied migration (the postgres baseline, 0001, is kept)
+  status        list the migrations and whether they have been applied
+  new <name>    create empty up and down files for a new migration, for every dialect`
+
+// isMigrateNew reports whether the "migrate new" subcommand was given,
+// which is the only one that does not need a database connection
+func isMigrateNew(args []string) bool {
+	return len(args) >= 2 && args[0] == "migrate" && args[1] == "new"
+}
+
+// migrateNew creates the files for a new migration in the directory of every dialect
+func migrateNew(args []string) error {
+	if len(args) != 3 {
+		return errors.New(migrateUsage)
+	}
+	for _, dialect := range migrationDialects {
+		files, err := migrate.Create(filepath.Join(migrationsDir, dialect), args[2])
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			fmt.Println("Created", f)
+		}
+	}
+	return nil
+}
+
+// runMigrate handles the "migrate up|down|status" subcommands
+func runMigrate(services *models.Services, args []string) error {
+	if len(args) != 2 {
+		return errors.New(migrateUsage)
+	}
+
+	m := services.Migrator()
+
+	switch args[1] {
+	case "up":
+		applied, err := m.Up()
+		for _, a := range applied {
+			fmt.Printf("Applied %04d_%s\n", a.Version, a.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("No pending migrations.")
+		}
+	case "down":
+		rolledBack, err := m.Down()
+		if err != nil {
+			return err
+		}
+		if rolledBack == nil {
+			fmt.Println("No migrations to roll back.")
+			return nil
+		}
+		fmt.Printf("Rolled back %04d_%s\n", rolledBack.Version, rolledBack.Name)
+	case "status":
+		statuses, err := m.Status()
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%-40s %s\n", s.Version, s.Name, applied)
+		}
+	default:
+		return errors.New(migrateUsage)
+	}
+	return nil
+}
+
+// checkMigrations runs before the server starts
+// In development the pending migrations are applied, while in production
+// the server refuses to start until "migrate up" has been run
+func checkMigrations(services *models.Services, isProd bool) error {
+	m := services.Migrator()
+
+	if !isProd {
+		applied, err := m.Up()
+		for _, a := range applied {
+			fmt.Printf("Applied migration %04d_%s\n", a.Version, a.Name)
+		}
+		return err
+	}
+
+	pending, err := m.Pending()
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("there are %d pending migrations, run \"%s migrate up\" before starting the server", len(pending), os.Args[0])
+	}
+	return nil
+}
@@ -0,0 +1,4 @@
+-- 0001 cannot be rolled back: "migrate down" stops here with an error, since this file has no SQL.
+-- The users and galleries tables may well have been created by AutoMigrate and adopted by 0001,
+-- and rolling the migrations back must not lose them.
+-- DestructiveReset drops them itself.
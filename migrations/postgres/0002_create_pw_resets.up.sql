@@ -0,0 +1,14 @@
+-- The tables and columns of 0002 to 0006 were created by AutoMigrate before there were migrations,
+-- IF NOT EXISTS lets those databases adopt them.
+
+CREATE TABLE IF NOT EXISTS pw_resets (
+    id serial PRIMARY KEY,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    user_id integer NOT NULL,
+    token_hash text NOT NULL,
+    expires_at timestamp with time zone NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_pw_resets_token_hash ON pw_resets (token_hash);
+CREATE INDEX IF NOT EXISTS idx_pw_resets_deleted_at ON pw_resets (deleted_at);
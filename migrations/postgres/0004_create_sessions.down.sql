@@ -0,0 +1,5 @@
+-- remember_hash comes back empty (NULL), so every user has to log in again
+ALTER TABLE users ADD COLUMN IF NOT EXISTS remember_hash text;
+CREATE UNIQUE INDEX IF NOT EXISTS uix_users_remember_hash ON users (remember_hash);
+
+DROP TABLE IF EXISTS sessions;
@@ -0,0 +1,17 @@
+-- A user now has a session per device instead of a single remember_hash.
+-- Everyone is logged out once.
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL,
+    token_hash text NOT NULL,
+    user_agent text,
+    ip text,
+    created_at timestamp with time zone,
+    last_seen_at timestamp with time zone,
+    expires_at timestamp with time zone NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_sessions_token_hash ON sessions (token_hash);
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions (user_id);
+
+ALTER TABLE users DROP COLUMN IF EXISTS remember_hash;
@@ -0,0 +1,12 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret text;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled_at timestamp with time zone;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step bigint;
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL,
+    code_hash text NOT NULL,
+    created_at timestamp with time zone
+);
+CREATE UNIQUE INDEX IF NOT EXISTS uix_recovery_codes_code_hash ON recovery_codes (code_hash);
+CREATE INDEX IF NOT EXISTS idx_recovery_codes_user_id ON recovery_codes (user_id);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS login_attempts (
+    subject text PRIMARY KEY,
+    failures integer NOT NULL,
+    last_failed_at timestamp with time zone,
+    locked_until timestamp with time zone
+);
@@ -0,0 +1,18 @@
+-- Images used to be found by globbing images/galleries/<id>/.
+-- Run "lenslocked.com images backfill" once to import the existing files.
+
+CREATE TABLE images (
+    id serial PRIMARY KEY,
+    created_at timestamp with time zone,
+    updated_at timestamp with time zone,
+    deleted_at timestamp with time zone,
+    gallery_id integer NOT NULL,
+    user_id integer NOT NULL,
+    filename text NOT NULL,
+    caption text NOT NULL DEFAULT '',
+    position integer NOT NULL DEFAULT 0
+);
+CREATE INDEX idx_images_deleted_at ON images (deleted_at);
+CREATE INDEX idx_images_gallery_id ON images (gallery_id);
+CREATE INDEX idx_images_user_id ON images (user_id);
+CREATE UNIQUE INDEX uix_images_gallery_id_filename ON images (gallery_id, filename);
@@ -0,0 +1,3 @@
+ALTER TABLE images DROP COLUMN IF EXISTS sizes;
+ALTER TABLE images DROP COLUMN IF EXISTS height;
+ALTER TABLE images DROP COLUMN IF EXISTS width;
@@ -0,0 +1,3 @@
+ALTER TABLE images ADD COLUMN width integer NOT NULL DEFAULT 0;
+ALTER TABLE images ADD COLUMN height integer NOT NULL DEFAULT 0;
+ALTER TABLE images ADD COLUMN sizes text NOT NULL DEFAULT '';
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_galleries_visibility;
+DROP INDEX IF EXISTS uix_galleries_slug;
+ALTER TABLE galleries DROP COLUMN IF EXISTS slug;
+ALTER TABLE galleries DROP COLUMN IF EXISTS visibility;
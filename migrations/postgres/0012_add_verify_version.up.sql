@@ -0,0 +1,2 @@
+-- Verification links carry the version; sending a new link makes the older ones invalid.
+ALTER TABLE users ADD COLUMN verify_version integer NOT NULL DEFAULT 0;
@@ -0,0 +1,4 @@
+-- Unlike Postgres, a SQLite database never had tables from AutoMigrate,
+-- so these were created by 0001 and can be dropped.
+DROP TABLE IF EXISTS galleries;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,32 @@
+-- The SQLite version of the schema, for development without a Postgres server.
+-- Keep the versions in step with migrations/postgres.
+--
+-- ALTER TABLE ... DROP COLUMN needs SQLite 3.35 (github.com/mattn/go-sqlite3 v1.14.7),
+-- and gorm only requires an older driver. The migrations that remove a column rebuild the table instead:
+-- create the new table, copy the rows, drop the old table, rename the new one, and create its indexes again.
+
+CREATE TABLE users (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    name text,
+    age integer,
+    email text NOT NULL,
+    password_hash text NOT NULL,
+    remember_hash text NOT NULL
+);
+CREATE UNIQUE INDEX uix_users_email ON users (email);
+CREATE UNIQUE INDEX uix_users_remember_hash ON users (remember_hash);
+CREATE INDEX idx_users_deleted_at ON users (deleted_at);
+
+CREATE TABLE galleries (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    title text NOT NULL,
+    user_id integer NOT NULL
+);
+CREATE INDEX idx_galleries_deleted_at ON galleries (deleted_at);
+CREATE INDEX idx_galleries_user_id ON galleries (user_id);
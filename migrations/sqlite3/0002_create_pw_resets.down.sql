@@ -0,0 +1 @@
+DROP TABLE IF EXISTS pw_resets;
@@ -0,0 +1,11 @@
+CREATE TABLE pw_resets (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    user_id integer NOT NULL,
+    token_hash text NOT NULL,
+    expires_at datetime NOT NULL
+);
+CREATE UNIQUE INDEX uix_pw_resets_token_hash ON pw_resets (token_hash);
+CREATE INDEX idx_pw_resets_deleted_at ON pw_resets (deleted_at);
@@ -0,0 +1,21 @@
+-- users is rebuilt without email_verified_at (see 0001 on DROP COLUMN).
+-- 0004 has been rolled back, so remember_hash is there again.
+CREATE TABLE users_new (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    name text,
+    age integer,
+    email text NOT NULL,
+    password_hash text NOT NULL,
+    remember_hash text
+);
+INSERT INTO users_new (id, created_at, updated_at, deleted_at, name, age, email, password_hash, remember_hash)
+SELECT id, created_at, updated_at, deleted_at, name, age, email, password_hash, remember_hash FROM users;
+DROP TABLE users;
+ALTER TABLE users_new RENAME TO users;
+
+CREATE UNIQUE INDEX uix_users_email ON users (email);
+CREATE UNIQUE INDEX uix_users_remember_hash ON users (remember_hash);
+CREATE INDEX idx_users_deleted_at ON users (deleted_at);
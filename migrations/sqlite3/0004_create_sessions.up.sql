@@ -0,0 +1,36 @@
+-- A user now has a session per device instead of a single remember_hash.
+-- Everyone is logged out once.
+
+CREATE TABLE sessions (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    user_id integer NOT NULL,
+    token_hash text NOT NULL,
+    user_agent text,
+    ip text,
+    created_at datetime,
+    last_seen_at datetime,
+    expires_at datetime NOT NULL
+);
+CREATE UNIQUE INDEX uix_sessions_token_hash ON sessions (token_hash);
+CREATE INDEX idx_sessions_user_id ON sessions (user_id);
+
+-- users is rebuilt without remember_hash (see 0001 on DROP COLUMN).
+-- Dropping the old table drops uix_users_remember_hash along with it.
+CREATE TABLE users_new (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    name text,
+    age integer,
+    email text NOT NULL,
+    password_hash text NOT NULL,
+    email_verified_at datetime
+);
+INSERT INTO users_new (id, created_at, updated_at, deleted_at, name, age, email, password_hash, email_verified_at)
+SELECT id, created_at, updated_at, deleted_at, name, age, email, password_hash, email_verified_at FROM users;
+DROP TABLE users;
+ALTER TABLE users_new RENAME TO users;
+
+CREATE UNIQUE INDEX uix_users_email ON users (email);
+CREATE INDEX idx_users_deleted_at ON users (deleted_at);
@@ -0,0 +1,15 @@
+CREATE TABLE images (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    gallery_id integer NOT NULL,
+    user_id integer NOT NULL,
+    filename text NOT NULL,
+    caption text NOT NULL DEFAULT '',
+    position integer NOT NULL DEFAULT 0
+);
+CREATE INDEX idx_images_deleted_at ON images (deleted_at);
+CREATE INDEX idx_images_gallery_id ON images (gallery_id);
+CREATE INDEX idx_images_user_id ON images (user_id);
+CREATE UNIQUE INDEX uix_images_gallery_id_filename ON images (gallery_id, filename);
@@ -0,0 +1,21 @@
+-- images is rebuilt without width, height and sizes (see 0001 on DROP COLUMN).
+CREATE TABLE images_new (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    gallery_id integer NOT NULL,
+    user_id integer NOT NULL,
+    filename text NOT NULL,
+    caption text NOT NULL DEFAULT '',
+    position integer NOT NULL DEFAULT 0
+);
+INSERT INTO images_new (id, created_at, updated_at, deleted_at, gallery_id, user_id, filename, caption, position)
+SELECT id, created_at, updated_at, deleted_at, gallery_id, user_id, filename, caption, position FROM images;
+DROP TABLE images;
+ALTER TABLE images_new RENAME TO images;
+
+CREATE INDEX idx_images_deleted_at ON images (deleted_at);
+CREATE INDEX idx_images_gallery_id ON images (gallery_id);
+CREATE INDEX idx_images_user_id ON images (user_id);
+CREATE UNIQUE INDEX uix_images_gallery_id_filename ON images (gallery_id, filename);
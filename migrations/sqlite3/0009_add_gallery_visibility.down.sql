@@ -0,0 +1,17 @@
+-- galleries is rebuilt without visibility and slug (see 0001 on DROP COLUMN).
+-- Dropping the old table drops uix_galleries_slug and idx_galleries_visibility along with it.
+CREATE TABLE galleries_new (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    title text NOT NULL,
+    user_id integer NOT NULL
+);
+INSERT INTO galleries_new (id, created_at, updated_at, deleted_at, title, user_id)
+SELECT id, created_at, updated_at, deleted_at, title, user_id FROM galleries;
+DROP TABLE galleries;
+ALTER TABLE galleries_new RENAME TO galleries;
+
+CREATE INDEX idx_galleries_deleted_at ON galleries (deleted_at);
+CREATE INDEX idx_galleries_user_id ON galleries (user_id);
@@ -0,0 +1,5 @@
+-- Existing galleries become private; their slugs are generated the next time they are saved.
+ALTER TABLE galleries ADD COLUMN visibility text NOT NULL DEFAULT 'private';
+ALTER TABLE galleries ADD COLUMN slug text NOT NULL DEFAULT '';
+CREATE UNIQUE INDEX uix_galleries_slug ON galleries (slug) WHERE slug <> '';
+CREATE INDEX idx_galleries_visibility ON galleries (visibility);
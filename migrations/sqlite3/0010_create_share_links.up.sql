@@ -0,0 +1,13 @@
+CREATE TABLE share_links (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    gallery_id integer NOT NULL,
+    label text NOT NULL DEFAULT '',
+    token_hash text NOT NULL,
+    expires_at datetime,
+    max_views integer NOT NULL DEFAULT 0,
+    views integer NOT NULL DEFAULT 0,
+    password_hash text NOT NULL DEFAULT '',
+    created_at datetime
+);
+CREATE UNIQUE INDEX uix_share_links_token_hash ON share_links (token_hash);
+CREATE INDEX idx_share_links_gallery_id ON share_links (gallery_id);
@@ -0,0 +1,22 @@
+-- users is rebuilt without verify_version (see 0001 on DROP COLUMN).
+CREATE TABLE users_new (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    created_at datetime,
+    updated_at datetime,
+    deleted_at datetime,
+    name text,
+    age integer,
+    email text NOT NULL,
+    password_hash text NOT NULL,
+    email_verified_at datetime,
+    totp_secret text,
+    totp_enabled_at datetime,
+    totp_last_step bigint
+);
+INSERT INTO users_new (id, created_at, updated_at, deleted_at, name, age, email, password_hash, email_verified_at, totp_secret, totp_enabled_at, totp_last_step)
+SELECT id, created_at, updated_at, deleted_at, name, age, email, password_hash, email_verified_at, totp_secret, totp_enabled_at, totp_last_step FROM users;
+DROP TABLE users;
+ALTER TABLE users_new RENAME TO users;
+
+CREATE UNIQUE INDEX uix_users_email ON users (email);
+CREATE INDEX idx_users_deleted_at ON users (deleted_at);
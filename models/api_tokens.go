@@ -0,0 +1,290 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/hash"
+	"lenslocked.com/rand"
+)
+
+// The scopes an API token can be given
+// A token can only be used for the API routes that need one of its scopes
+const (
+	ScopeGalleriesRead  = "galleries:read"
+	ScopeGalleriesWrite = "galleries:write"
+	ScopeImagesUpload   = "images:upload"
+)
+
+// APIScopes lists every scope, in the order they are shown on the tokens page
+var APIScopes = []string{ScopeGalleriesRead, ScopeGalleriesWrite, ScopeImagesUpload}
+
+// apiTokenPrefix starts every API token, so that a leaked token is easy to recognise
+const apiTokenPrefix = "llk_"
+
+// apiTokenBytes is the number of random bytes in an API token
+const apiTokenBytes = 32
+
+// APIToken is a personal access token that scripts send in the Authorization header
+// (Authorization: Bearer <token>) instead of logging in
+// Like sessions, only the HMAC of the token is stored, so the token is shown to the user once when it is created
+type APIToken struct {
+	ID        uint   `gorm:"primary_key"`
+	UserID    uint   `gorm:"not null;index"`
+	Name      string `gorm:"not null"`
+	Token     string `gorm:"-" json:",omitempty"`
+	TokenHash string `gorm:"not null;unique_index" json:"-"`
+
+	// Scopes are separated by spaces, e.g. "galleries:read images:upload"
+	Scopes string `gorm:"not null"`
+
+	// LastUsedAt is nil until the token is used, ExpiresAt is nil for tokens that do not expire
+	LastUsedAt *time.Time
+	ExpiresAt  *time.Time
+
+	CreatedAt time.Time
+}
+
+func (t *APIToken) ScopeList() []string {
+	return strings.Fields(t.Scopes)
+}
+
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.ScopeList() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *APIToken) Expired() bool {
+	return t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt)
+}
+
+// APITokenDB interface exposes the methods that engages the api_tokens table
+type APITokenDB interface {
+	ByToken(token string) (*APIToken, error)
+	ByUserID(userID uint) ([]APIToken, error)
+	Create(token *APIToken) error
+	Update(token *APIToken) error
+	Delete(id uint) error
+}
+
+// APITokenService interface implements APITokenDB
+type APITokenService interface {
+	APITokenDB
+}
+
+type apiTokenService struct {
+	APITokenDB
+}
+
+// apiTokenValidator generates and hashes the tokens and enforces the expiry
+type apiTokenValidator struct {
+	APITokenDB
+	hmac hash.HMAC
+}
+
+// apiTokenGorm implement methods found in APITokenDB
+type apiTokenGorm struct {
+	db *gorm.DB
+}
+
+var _ APITokenDB = &apiTokenGorm{}
+var _ APITokenDB = &apiTokenValidator{}
+var _ APITokenService = &apiTokenService{}
+
+func NewAPITokenService(db *gorm.DB, hmacKey string) APITokenService {
+	return &apiTokenService{
+		&apiTokenValidator{
+			APITokenDB: &apiTokenGorm{db},
+			hmac:       hash.NewHMAC(hmacKey),
+		},
+	}
+}
+
+// ************** THIS SECTION CONTAINS THE APITOKENGORM METHODS **************
+
+// ByToken looks up a token with the given token hash
+// This method expects the token to already be hashed
+func (tg *apiTokenGorm) ByToken(tokenHash string) (*APIToken, error) {
+	var token APIToken
+	err := first(tg.db.Where("token_hash=?", tokenHash), &token)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// ByUserID returns the tokens of a user, newest first
+func (tg *apiTokenGorm) ByUserID(userID uint) ([]APIToken, error) {
+	var tokens []APIToken
+	err := tg.db.Where("user_id=?", userID).Order("created_at desc").Find(&tokens).Error
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (tg *apiTokenGorm) Create(token *APIToken) error {
+	return tg.db.Create(token).Error
+}
+
+func (tg *apiTokenGorm) Update(token *APIToken) error {
+	return tg.db.Save(token).Error
+}
+
+func (tg *apiTokenGorm) Delete(id uint) error {
+	return tg.db.Where("id=?", id).Delete(&APIToken{}).Error
+}
+
+// ************** THIS SECTION CONTAINS THE VALIDATION CHAINING METHODS FOR API TOKENS **************
+
+type apiTokenValidateFunc func(*APIToken) error
+
+func runAPITokenValFuncs(token *APIToken, fns ...apiTokenValidateFunc) error {
+	for _, fn := range fns {
+		if err := fn(token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ByToken hashes the raw token before the lookup
+// Tokens that have expired are reported as ErrNotFound
+func (tv *apiTokenValidator) ByToken(raw string) (*APIToken, error) {
+	token := APIToken{Token: raw}
+	if err := runAPITokenValFuncs(&token, tv.hmacToken); err != nil {
+		return nil, err
+	}
+
+	found, err := tv.APITokenDB.ByToken(token.TokenHash)
+	if err != nil {
+		return nil, err
+	}
+	if found.Expired() {
+		return nil, ErrNotFound
+	}
+	return found, nil
+}
+
+// Create generates the token, hashes it, and returns the token with its raw Token set
+func (tv *apiTokenValidator) Create(token *APIToken) error {
+	if err := runAPITokenValFuncs(token,
+		tv.userIDRequired,
+		tv.nameRequired,
+		tv.normalizeScopes,
+		tv.scopeRequired,
+		tv.expiresInFuture,
+		tv.setToken,
+		tv.hmacToken,
+	); err != nil {
+		return err
+	}
+	return tv.APITokenDB.Create(token)
+}
+
+func (tv *apiTokenValidator) Update(token *APIToken) error {
+	if err := runAPITokenValFuncs(token,
+		tv.idBeGreaterThan(0),
+		tv.userIDRequired,
+		tv.nameRequired,
+	); err != nil {
+		return err
+	}
+	return tv.APITokenDB.Update(token)
+}
+
+// Delete will remove a single token
+// IMPORTANT: Please make sure a value of > 0 is supplied, otherwise the entire table will be wiped out
+func (tv *apiTokenValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrInvalidID
+	}
+	return tv.APITokenDB.Delete(id)
+}
+
+func (tv *apiTokenValidator) userIDRequired(token *APIToken) error {
+	if token.UserID <= 0 {
+		return ErruserIDRequired
+	}
+	return nil
+}
+
+func (tv *apiTokenValidator) nameRequired(token *APIToken) error {
+	token.Name = strings.TrimSpace(token.Name)
+	if token.Name == "" {
+		return ErrTokenNameRequired
+	}
+	return nil
+}
+
+// normalizeScopes rejects unknown scopes, and removes the duplicates
+// and puts the scopes in the order of APIScopes
+func (tv *apiTokenValidator) normalizeScopes(token *APIToken) error {
+	for _, given := range token.ScopeList() {
+		if !isAPIScope(given) {
+			return ErrScopeInvalid
+		}
+	}
+	var scopes []string
+	for _, scope := range APIScopes {
+		if token.HasScope(scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	token.Scopes = strings.Join(scopes, " ")
+	return nil
+}
+
+func (tv *apiTokenValidator) scopeRequired(token *APIToken) error {
+	if token.Scopes == "" {
+		return ErrScopeRequired
+	}
+	return nil
+}
+
+func (tv *apiTokenValidator) expiresInFuture(token *APIToken) error {
+	if token.ExpiresAt != nil && !token.ExpiresAt.After(time.Now()) {
+		return ErrExpiryInPast
+	}
+	return nil
+}
+
+func (tv *apiTokenValidator) setToken(token *APIToken) error {
+	raw, err := rand.String(apiTokenBytes)
+	if err != nil {
+		return err
+	}
+	token.Token = apiTokenPrefix + raw
+	return nil
+}
+
+func (tv *apiTokenValidator) hmacToken(token *APIToken) error {
+	if token.Token == "" {
+		return nil
+	}
+	token.TokenHash = tv.hmac.Hash(token.Token)
+	return nil
+}
+
+func (tv *apiTokenValidator) idBeGreaterThan(n uint) apiTokenValidateFunc {
+	return apiTokenValidateFunc(func(token *APIToken) error {
+		if token.ID <= n {
+			return ErrInvalidID
+		}
+		return nil
+	})
+}
+
+func isAPIScope(scope string) bool {
+	for _, s := range APIScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPITokenCreate(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name   string
+		token  APIToken
+		scopes string // as stored
+		err    error
+	}{
+		{"valid", APIToken{UserID: 1, Name: "backup", Scopes: ScopeGalleriesRead}, ScopeGalleriesRead, nil},
+		{
+			"scopes normalized",
+			APIToken{UserID: 1, Name: "upload", Scopes: ScopeImagesUpload + "  " + ScopeGalleriesRead + " " + ScopeImagesUpload},
+			ScopeGalleriesRead + " " + ScopeImagesUpload,
+			nil,
+		},
+		{"user required", APIToken{Name: "backup", Scopes: ScopeGalleriesRead}, "", ErruserIDRequired},
+		{"name required", APIToken{UserID: 1, Name: "  ", Scopes: ScopeGalleriesRead}, "", ErrTokenNameRequired},
+		{"scope required", APIToken{UserID: 1, Name: "backup"}, "", ErrScopeRequired},
+		{"scope invalid", APIToken{UserID: 1, Name: "backup", Scopes: "users:delete"}, "", ErrScopeInvalid},
+		{"expiry in the past", APIToken{UserID: 1, Name: "backup", Scopes: ScopeGalleriesRead, ExpiresAt: &past}, "", ErrExpiryInPast},
+	}
+
+	forEachDialect(t, func(t *testing.T, s *Services) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				token := tt.token
+				if err := s.APIToken.Create(&token); err != tt.err {
+					t.Fatalf("Create() err = %v, want %v", err, tt.err)
+				}
+				if tt.err != nil {
+					return
+				}
+				if !strings.HasPrefix(token.Token, apiTokenPrefix) {
+					t.Errorf("the token %q does not start with %s", token.Token, apiTokenPrefix)
+				}
+				found, err := s.APIToken.ByToken(token.Token)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if found.ID != token.ID || found.Scopes != tt.scopes {
+					t.Errorf("ByToken() = %d %q, want %d %q", found.ID, found.Scopes, token.ID, tt.scopes)
+				}
+			})
+		}
+	})
+}
+
+func TestAPITokenByTokenExpired(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, s *Services) {
+		expires := time.Now().Add(time.Hour)
+		token := APIToken{UserID: 1, Name: "backup", Scopes: ScopeGalleriesRead, ExpiresAt: &expires}
+		if err := s.APIToken.Create(&token); err != nil {
+			t.Fatal(err)
+		}
+
+		expired := time.Now().Add(-time.Minute)
+		token.ExpiresAt = &expired
+		if err := s.APIToken.Update(&token); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.APIToken.ByToken(token.Token); err != ErrNotFound {
+			t.Errorf("ByToken() of an expired token err = %v, want ErrNotFound", err)
+		}
+	})
+}
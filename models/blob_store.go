@@ -0,0 +1,219 @@
+package models
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"lenslocked.com/s3"
+)
+
+// BlobInfo describes a file kept in a BlobStore
+type BlobInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// BlobStore is where the uploaded files are kept
+// Keys are slash separated paths, e.g. "galleries/20/beach.jpg"
+// Use the local store for a single instance, and the S3 store
+// when more than one instance of the app needs to see the same files
+type BlobStore interface {
+	// Put writes the file, replacing any existing file with the same key
+	Put(key string, r io.Reader) error
+
+	// Delete removes the file
+	// Deleting a file that does not exist is not an error
+	Delete(key string) error
+
+	// List returns every file whose key starts with prefix
+	List(prefix string) ([]BlobInfo, error)
+
+	// Open returns the content of the file so that the app can serve it
+	// ErrNotFound is returned when there is no such file
+	Open(key string) (io.ReadSeekCloser, *BlobInfo, error)
+
+	// URL returns a short-lived url that browsers can fetch the file from directly,
+	// or "" when the store can only be read through the app (see Open)
+	URL(key string) (string, error)
+}
+
+// ************** THIS SECTION CONTAINS THE LOCAL DISK BLOBSTORE **************
+
+type localBlobStore struct {
+	dir string
+}
+
+var _ BlobStore = &localBlobStore{}
+
+// NewLocalBlobStore keeps the files in dir
+// Browsers cannot fetch the files directly, the app serves them through Open
+func NewLocalBlobStore(dir string) BlobStore {
+	return &localBlobStore{
+		dir: dir,
+	}
+}
+
+func (ls *localBlobStore) Put(key string, r io.Reader) error {
+	p := ls.path(key)
+
+	// Create the directories for the file (e.g. images/galleries/20)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	dst, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, r)
+	return err
+}
+
+func (ls *localBlobStore) Delete(key string) error {
+	err := os.Remove(ls.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (ls *localBlobStore) List(prefix string) ([]BlobInfo, error) {
+	var blobs []BlobInfo
+	err := filepath.Walk(ls.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(ls.dir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			blobs = append(blobs, BlobInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return blobs, err
+}
+
+func (ls *localBlobStore) Open(key string) (io.ReadSeekCloser, *BlobInfo, error) {
+	f, err := os.Open(ls.path(key))
+	if os.IsNotExist(err) {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, nil, ErrNotFound
+	}
+
+	return f, &BlobInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (ls *localBlobStore) URL(key string) (string, error) {
+	return "", nil
+}
+
+// path turns the key into a file path inside dir
+// Cleaning the key as an absolute path first makes sure ".." cannot escape dir
+func (ls *localBlobStore) path(key string) string {
+	return filepath.Join(ls.dir, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+// ************** THIS SECTION CONTAINS THE S3 BLOBSTORE **************
+
+type s3BlobStore struct {
+	client     *s3.Client
+	presignTTL time.Duration
+}
+
+var _ BlobStore = &s3BlobStore{}
+
+// NewS3BlobStore keeps the files in an S3 bucket (or any S3-compatible server, e.g. MinIO)
+// The bucket stays private; once the app has checked that a browser may see a file,
+// it redirects the browser to a presigned url that expires after presignTTL
+func NewS3BlobStore(cfg s3.Config, presignTTL time.Duration) (BlobStore, error) {
+	client, err := s3.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &s3BlobStore{
+		client:     client,
+		presignTTL: presignTTL,
+	}, nil
+}
+
+func (ss *s3BlobStore) Put(key string, r io.Reader) error {
+	return ss.client.Put(key, r, mime.TypeByExtension(path.Ext(key)))
+}
+
+func (ss *s3BlobStore) Delete(key string) error {
+	return ss.client.Delete(key)
+}
+
+func (ss *s3BlobStore) List(prefix string) ([]BlobInfo, error) {
+	objects, err := ss.client.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	blobs := make([]BlobInfo, len(objects))
+	for i, o := range objects {
+		blobs[i] = BlobInfo{Key: o.Key, Size: o.Size, ModTime: o.LastModified}
+	}
+	return blobs, nil
+}
+
+// Open downloads the whole file, since S3 responses cannot be seeked
+// The app normally redirects browsers to URL instead
+func (ss *s3BlobStore) Open(key string) (io.ReadSeekCloser, *BlobInfo, error) {
+	body, err := ss.client.Get(key)
+	if err == s3.ErrNotFound {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer body.Close()
+
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nopSeekCloser{bytes.NewReader(b)}, &BlobInfo{Key: key, Size: int64(len(b))}, nil
+}
+
+func (ss *s3BlobStore) URL(key string) (string, error) {
+	return ss.client.PresignGet(key, ss.presignTTL)
+}
+
+// nopSeekCloser adds a Close method that does nothing to a bytes.Reader
+type nopSeekCloser struct {
+	*bytes.Reader
+}
+
+func (nopSeekCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,55 @@
+package models
+
+import (
+	"strconv"
+	"time"
+)
+
+// emailVerifier creates and checks the tokens used in email verification links
+//
+// Because the email address and the user's VerifyVersion are part of the signed payload,
+// a link stops working as soon as the user's email address changes or a new link is sent
+type emailVerifier struct {
+	signer *tokenSigner
+	ttl    time.Duration
+}
+
+const verifyPurpose = "verify"
+
+func newEmailVerifier(signer *tokenSigner, ttl time.Duration) *emailVerifier {
+	return &emailVerifier{
+		signer: signer,
+		ttl:    ttl,
+	}
+}
+
+// Token returns a signed token for the user that expires after the verifier's ttl
+// Email addresses cannot contain "|" as they have passed emailFormat
+func (ev *emailVerifier) Token(user *User) string {
+	return ev.signer.Sign(verifyPurpose, ev.ttl,
+		strconv.FormatUint(uint64(user.ID), 10), user.Email, strconv.Itoa(user.VerifyVersion))
+}
+
+// Parse checks the token and returns the user ID, email and VerifyVersion it was issued for
+func (ev *emailVerifier) Parse(token string) (uint, string, int, error) {
+	fields, err := ev.signer.Parse(verifyPurpose, token)
+	if err != nil {
+		return 0, "", 0, err
+	}
+
+	if len(fields) != 3 {
+		return 0, "", 0, ErrTokenInvalid
+	}
+
+	id, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return 0, "", 0, ErrTokenInvalid
+	}
+
+	version, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return 0, "", 0, ErrTokenInvalid
+	}
+
+	return uint(id), fields[1], version, nil
+}
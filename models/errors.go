@@ -1,6 +1,10 @@
 package models
 
-import "strings"
+import (
+	"fmt"
+	"strings"
+	"time"
+)
 
 type modelError string   // by making modelErrors's underlying type as string, you can make it as constants
 type privateError string // errors set to privateErrors are those that will not be revealed to users
@@ -24,6 +28,87 @@ func (e modelError) Public() string {
 	return strings.Join(split, " ")
 }
 
+// LockoutError is returned when too many failed attempts have been made
+// Unlike the modelErrors below, it carries how long the user has to wait
+// before trying again so that it can be shown to them
+type LockoutError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockoutError) Error() string {
+	return fmt.Sprintf("models: Too many failed attempts, locked for %s", e.RetryAfter)
+}
+
+func (e *LockoutError) Public() string {
+	return fmt.Sprintf("Too many failed attempts. Please try again in %s.", e.wait())
+}
+
+// wait rounds the lockout up to whole seconds or minutes to display to the user
+func (e *LockoutError) wait() string {
+	if e.RetryAfter <= time.Minute {
+		secs := int((e.RetryAfter + time.Second - 1) / time.Second)
+		if secs == 1 {
+			return "1 second"
+		}
+		return fmt.Sprintf("%d seconds", secs)
+	}
+	return fmt.Sprintf("%d minutes", int((e.RetryAfter+time.Minute-1)/time.Minute))
+}
+
+// ImagePixelsError is returned when an uploaded image has more pixels than the configured maximum
+// It carries the dimensions so that the user knows by how much to scale the image down
+type ImagePixelsError struct {
+	Width, Height int
+	MaxPixels     int
+}
+
+func (e *ImagePixelsError) Error() string {
+	return fmt.Sprintf("models: A %dx%d image has more than %d pixels", e.Width, e.Height, e.MaxPixels)
+}
+
+func (e *ImagePixelsError) Public() string {
+	return fmt.Sprintf("Images must not be larger than %g megapixels, this one is %dx%d.",
+		float64(e.MaxPixels)/1e6, e.Width, e.Height)
+}
+
+// ImageError is returned for a single file of an upload that was rejected
+// It names the file so that the user knows which one to fix
+type ImageError struct {
+	Filename string
+	Err      error
+}
+
+func (e *ImageError) Error() string {
+	return fmt.Sprintf("models: %s: %v", e.Filename, e.Err)
+}
+
+func (e *ImageError) Public() string {
+	if pErr, ok := e.Err.(interface{ Public() string }); ok {
+		return fmt.Sprintf("%s: %s", e.Filename, pErr.Public())
+	}
+	return fmt.Sprintf("%s could not be uploaded.", e.Filename)
+}
+
+// ImageErrors collects the rejected files of an upload,
+// so that the rest of the files can still be uploaded
+type ImageErrors []*ImageError
+
+func (e ImageErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e ImageErrors) Public() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Public()
+	}
+	return strings.Join(msgs, " ")
+}
+
 const (
 
 	// ************** THIS SECTION CONTAINS ALL ERRORS THAT USERS CAN SEE **************
@@ -53,16 +138,49 @@ const (
 	// returned when a password is not supplied when creating a user
 	ErrPasswordRequired modelError = "models: Password is required"
 
-	// returned when create or update is attempted without a user remember token hash
-	ErrRememberRequired modelError = "models: Remember token is required"
-
 	// returns when gallery title is not provided
 	ErrTitleRequired modelError = "models: Title is required"
 
+	// returned when a gallery's visibility is not private, unlisted or public
+	ErrVisibilityInvalid modelError = "models: Visibility must be private, unlisted or public"
+
+	// returned when a share link has expired or has no views left
+	ErrShareLinkExpired modelError = "models: This link has expired"
+
+	// returned when a share link is given a negative view limit
+	ErrMaxViewsInvalid modelError = "models: View limit must not be negative"
+
+	// returned when a share link is given an expiry that has already passed
+	ErrExpiryInPast modelError = "models: Expiry must be in the future"
+
+	// returned when a reset or verification token is not found or has expired
+	ErrTokenInvalid modelError = "models: Token provided is not valid"
+
+	// returned when a two-factor code or recovery code does not match
+	ErrTOTPInvalid modelError = "models: Authentication code is not valid"
+
+	// returned when enrolling a user that already has two-factor authentication enabled
+	ErrTOTPEnabled modelError = "models: Two-factor authentication is already enabled"
+
+	// returned when an image is uploaded without a filename
+	ErrFilenameRequired modelError = "models: Filename is required"
+
+	// returned when an uploaded file is not a JPEG or PNG image, judging by its content
+	ErrImageType modelError = "models: Only jpg, jpeg and png images can be uploaded"
+
+	// returned when an API token is created without a name
+	ErrTokenNameRequired modelError = "models: Name is required"
+
+	// returned when an API token is created without any scope
+	ErrScopeRequired modelError = "models: At least one scope is required"
+
+	// returned when an API token is given a scope that does not exist
+	ErrScopeInvalid modelError = "models: Scope is not valid"
+
 	// ************** THIS SECTION CONTAINS ALL PRIVATE ERRORS **************
 
-	// returned when the remember token is not at least 32 bytes
-	ErrBytesTooShort privateError = "models: Number of bytes for remember token must be at least 32 bytes."
+	// returned when the session token is not at least 32 bytes
+	ErrBytesTooShort privateError = "models: Number of bytes for session token must be at least 32 bytes."
 
 	// returns when user id is not provided
 	ErruserIDRequired privateError = "models: User ID is required"
@@ -70,6 +188,13 @@ const (
 	// returned when an invalid id is provided to a method such as ByID
 	ErrInvalidID privateError = "models: ID received is less than 0"
 
+	// returned when an image filename could be used to leave the gallery's directory
+	ErrFilenameInvalid privateError = "models: Filename must not contain a path"
+
 	// the variable is used to match email addresses; it's basic but good enough for now
 	// emailRegex = regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`)
 )
+
+// ErrImageTooLarge is returned when an uploaded file is larger than MaxImageBytes
+// Unlike the errors above it is a var, so that the message follows MaxImageBytes
+var ErrImageTooLarge = modelError(fmt.Sprintf("models: Images must not be larger than %d megabytes", MaxImageBytes>>20))
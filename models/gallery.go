@@ -1,15 +1,53 @@
 package models
 
 import (
+	"strings"
+
 	"github.com/jinzhu/gorm"
+	"lenslocked.com/rand"
+)
+
+// The visibility levels of a gallery
+//   - private galleries can only be seen by their owner
+//   - unlisted galleries can be seen by anyone who has their /g/<slug> link
+//   - public galleries can be seen by anyone and appear in the public listing
+const (
+	VisibilityPrivate  = "private"
+	VisibilityUnlisted = "unlisted"
+	VisibilityPublic   = "public"
 )
 
+// slugBytes is the number of random bytes in a gallery slug
+// The slug is what keeps an unlisted gallery from being found, so it must not be guessable
+const slugBytes = 12
+
 // Gallery is our images container resource that visitors view
 type Gallery struct {
 	gorm.Model
-	Title  string  `gorm:"not null"`
-	UserID uint    `gorm:"not null;index"`
-	Images []Image `gorm:"-"`
+	Title      string  `gorm:"not null"`
+	UserID     uint    `gorm:"not null;index"`
+	Visibility string  `gorm:"not null"`
+	Slug       string  `gorm:"not null"`
+	Images     []Image `gorm:"-"`
+
+	// ShareLinks are only loaded for the owner, on the edit page
+	ShareLinks []ShareLink `gorm:"-"`
+}
+
+// CanView reports whether the user (nil for visitors that are not logged in)
+// may see the gallery when it is looked up by its ID
+// Unlisted galleries are only shown through their slug, see CanViewBySlug
+func (g *Gallery) CanView(user *User) bool {
+	return g.IsOwner(user) || g.Visibility == VisibilityPublic
+}
+
+// CanViewBySlug reports whether the user may see the gallery when it is looked up by its slug
+func (g *Gallery) CanViewBySlug(user *User) bool {
+	return g.CanView(user) || g.Visibility == VisibilityUnlisted
+}
+
+func (g *Gallery) IsOwner(user *User) bool {
+	return user != nil && g.UserID == user.ID
 }
 
 // GalleryDB interface exposes the methods that engages the database
@@ -17,6 +55,11 @@ type Gallery struct {
 type GalleryDB interface {
 	ByUserID(userID uint) ([]Gallery, error)
 	ByID(id uint) (*Gallery, error)
+	BySlug(slug string) (*Gallery, error)
+
+	// Public returns the most recent public galleries, at most limit of them
+	Public(limit int) ([]Gallery, error)
+
 	Create(gallery *Gallery) error
 	Update(gallery *Gallery) error
 	Delete(gallery *Gallery) error
@@ -76,6 +119,14 @@ func (g *Gallery) ImageSplitN(n int) [][]Image {
 	return ret
 }
 
+// Cover returns the first image of the gallery, or nil when it has none
+func (g *Gallery) Cover() *Image {
+	if len(g.Images) == 0 {
+		return nil
+	}
+	return &g.Images[0]
+}
+
 // ************** THIS SECTION CONTAINS THE GALLERYGORM METHODS FOR GALLERY **************
 
 // NewGalleryService takes in a gorm.DB and return a pointer to the galleryService
@@ -117,6 +168,22 @@ func (gg *galleryGorm) ByID(id uint) (*Gallery, error) {
 	return &gallery, err
 }
 
+// BySlug returns the gallery with the slug passed in
+func (gg *galleryGorm) BySlug(slug string) (*Gallery, error) {
+	var gallery Gallery
+	err := first(gg.db.Where("slug=?", slug), &gallery)
+	return &gallery, err
+}
+
+func (gg *galleryGorm) Public(limit int) ([]Gallery, error) {
+	var galleries []Gallery
+	err := gg.db.Where("visibility=?", VisibilityPublic).Order("created_at desc").Limit(limit).Find(&galleries).Error
+	if err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
 // ByUserID returns all the galleries that belongs to the parameter ID passed in
 func (gg *galleryGorm) ByUserID(userId uint) ([]Gallery, error) {
 	var galleries []Gallery
@@ -149,6 +216,9 @@ func (gv *galleryValidator) Create(gallery *Gallery) error {
 	if err := runGalleryValFuncs(gallery,
 		gv.userIDRequired,
 		gv.titleRequired,
+		gv.defaultVisibility,
+		gv.visibilityValid,
+		gv.slugRequired,
 	); err != nil {
 		return err
 	}
@@ -156,11 +226,23 @@ func (gv *galleryValidator) Create(gallery *Gallery) error {
 	return gv.GalleryDB.Create(gallery)
 }
 
+// BySlug does not look up an empty slug,
+// which is what galleries created before slugs existed still have
+func (gv *galleryValidator) BySlug(slug string) (*Gallery, error) {
+	if slug == "" {
+		return nil, ErrNotFound
+	}
+	return gv.GalleryDB.BySlug(slug)
+}
+
 // This Update validator runs before the passing to the galleryService method that updates the gallery
 func (gv *galleryValidator) Update(gallery *Gallery) error {
 	if err := runGalleryValFuncs(gallery,
 		gv.userIDRequired,
 		gv.titleRequired,
+		gv.defaultVisibility,
+		gv.visibilityValid,
+		gv.slugRequired,
 	); err != nil {
 		return err
 	}
@@ -193,6 +275,37 @@ func (gv *galleryValidator) titleRequired(g *Gallery) error {
 	return nil
 }
 
+// defaultVisibility makes new galleries private unless asked otherwise
+func (gv *galleryValidator) defaultVisibility(g *Gallery) error {
+	g.Visibility = strings.ToLower(strings.TrimSpace(g.Visibility))
+	if g.Visibility == "" {
+		g.Visibility = VisibilityPrivate
+	}
+	return nil
+}
+
+func (gv *galleryValidator) visibilityValid(g *Gallery) error {
+	switch g.Visibility {
+	case VisibilityPrivate, VisibilityUnlisted, VisibilityPublic:
+		return nil
+	}
+	return ErrVisibilityInvalid
+}
+
+// slugRequired generates the slug of galleries that don't have one yet,
+// i.e. new galleries and galleries created before slugs existed
+func (gv *galleryValidator) slugRequired(g *Gallery) error {
+	if g.Slug != "" {
+		return nil
+	}
+	slug, err := rand.String(slugBytes)
+	if err != nil {
+		return err
+	}
+	g.Slug = slug
+	return nil
+}
+
 func (gv *galleryValidator) idBeGreaterThan(n uint) galleryValidateFunc {
 	return galleryValidateFunc(func(gallery *Gallery) error {
 		if gallery.ID <= n {
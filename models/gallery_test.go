@@ -0,0 +1,101 @@
+package models
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+func TestGalleryCreate(t *testing.T) {
+	tests := []struct {
+		name       string
+		gallery    Gallery
+		visibility string // as stored
+		err        error
+	}{
+		{"private by default", Gallery{UserID: 1, Title: "Holiday"}, VisibilityPrivate, nil},
+		{"visibility normalized", Gallery{UserID: 1, Title: "Beach", Visibility: " Public "}, VisibilityPublic, nil},
+		{"unlisted", Gallery{UserID: 1, Title: "Family", Visibility: VisibilityUnlisted}, VisibilityUnlisted, nil},
+		{"user required", Gallery{Title: "Holiday"}, "", ErruserIDRequired},
+		{"title required", Gallery{UserID: 1}, "", ErrTitleRequired},
+		{"visibility invalid", Gallery{UserID: 1, Title: "Holiday", Visibility: "friends"}, "", ErrVisibilityInvalid},
+	}
+
+	forEachDialect(t, func(t *testing.T, s *Services) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				gallery := tt.gallery
+				if err := s.Gallery.Create(&gallery); err != tt.err {
+					t.Fatalf("Create() err = %v, want %v", err, tt.err)
+				}
+				if tt.err != nil {
+					return
+				}
+				found, err := s.Gallery.BySlug(gallery.Slug)
+				if err != nil {
+					t.Fatalf("BySlug(%q): %v", gallery.Slug, err)
+				}
+				if found.ID != gallery.ID || found.Visibility != tt.visibility {
+					t.Errorf("BySlug() = %d %q, want %d %q", found.ID, found.Visibility, gallery.ID, tt.visibility)
+				}
+			})
+		}
+	})
+}
+
+func TestGalleryQueries(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, s *Services) {
+		// from the oldest to the newest, since Public lists the newest first
+		galleries := []Gallery{
+			{UserID: 1, Title: "Holiday", Visibility: VisibilityPublic},
+			{UserID: 1, Title: "Family", Visibility: VisibilityPrivate},
+			{UserID: 2, Title: "Beach", Visibility: VisibilityPublic},
+			{UserID: 2, Title: "Party", Visibility: VisibilityUnlisted},
+		}
+		created := time.Now().Add(-time.Hour).Truncate(time.Second)
+		for i := range galleries {
+			galleries[i].Model = gorm.Model{CreatedAt: created.Add(time.Duration(i) * time.Minute)}
+			if err := s.Gallery.Create(&galleries[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tests := []struct {
+			name    string
+			query   func() ([]Gallery, error)
+			want    []string
+			ordered bool
+		}{
+			{"ByUserID", func() ([]Gallery, error) { return s.Gallery.ByUserID(2) }, []string{"Beach", "Party"}, false},
+			{"ByUserID without galleries", func() ([]Gallery, error) { return s.Gallery.ByUserID(3) }, nil, false},
+			{"Public", func() ([]Gallery, error) { return s.Gallery.Public(10) }, []string{"Beach", "Holiday"}, true},
+			{"Public with a limit", func() ([]Gallery, error) { return s.Gallery.Public(1) }, []string{"Beach"}, true},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				got, err := tt.query()
+				if err != nil {
+					t.Fatal(err)
+				}
+				var titles []string
+				for _, g := range got {
+					titles = append(titles, g.Title)
+				}
+				if !tt.ordered {
+					sort.Strings(titles)
+				}
+				if len(titles) != len(tt.want) {
+					t.Fatalf("got %v, want %v", titles, tt.want)
+				}
+				for i := range titles {
+					if titles[i] != tt.want[i] {
+						t.Errorf("got %v, want %v", titles, tt.want)
+						break
+					}
+				}
+			})
+		}
+	})
+}
@@ -0,0 +1,189 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// ImageSize is a derived size generated for every uploaded image
+// Width is the maximum width in pixels; the height keeps the aspect ratio
+type ImageSize struct {
+	Name  string
+	Width int
+}
+
+// DefaultImageSizes are used when no sizes are configured
+var DefaultImageSizes = []ImageSize{
+	{Name: "thumb", Width: 320},
+	{Name: "medium", Width: 800},
+	{Name: "large", Width: 1600},
+}
+
+// ImageVariant is a derived size of an image along with the url browsers fetch it from
+type ImageVariant struct {
+	Name  string
+	Width int
+	URL   string
+}
+
+// DefaultMaxImagePixels is used when no maximum is configured
+// A decoded image takes 4 bytes per pixel, so 40 megapixels take 160 megabytes of memory
+const DefaultMaxImagePixels = 40 * 1000 * 1000
+
+// jpegQuality is used when encoding the derived sizes of JPEG images
+const jpegQuality = 85
+
+// sortImageSizes orders the sizes from the smallest to the largest
+func sortImageSizes(sizes []ImageSize) []ImageSize {
+	sorted := append([]ImageSize(nil), sizes...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Width < sorted[j].Width
+	})
+	return sorted
+}
+
+// ************** THIS SECTION CONTAINS THE TEMPLATE HELPERS **************
+
+// Src returns the url of the named size, e.g. {{.Src "thumb"}}
+// The original is used when the size was not generated,
+// which is the case for images smaller than that size
+func (i *Image) Src(name string) string {
+	for _, v := range i.Variants {
+		if v.Name == name {
+			return v.URL
+		}
+	}
+	return i.URL
+}
+
+// Srcset lists the derived sizes and the original for the srcset attribute of an img tag,
+// e.g. <img src="{{.Src "medium"}}" srcset="{{.Srcset}}" sizes="33vw">
+// It is empty when there are no derived sizes
+func (i *Image) Srcset() string {
+	if len(i.Variants) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(i.Variants)+1)
+	for _, v := range i.Variants {
+		parts = append(parts, fmt.Sprintf("%s %dw", v.URL, v.Width))
+	}
+	if i.Width > 0 {
+		parts = append(parts, fmt.Sprintf("%s %dw", i.URL, i.Width))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// ************** THIS SECTION CONTAINS THE RESIZING **************
+
+// variantKey is where a derived size is kept in the BlobStore,
+// e.g. galleries/20/thumb/beach.jpg
+func (i *Image) variantKey(name string) string {
+	return imagePrefix(i.GalleryID) + name + "/" + i.Filename
+}
+
+// sizeKey returns the key of the named derived size, or of the original when name is ""
+// ErrNotFound is returned when the size was not generated for this image
+func (i *Image) sizeKey(name string) (string, error) {
+	if name == "" {
+		return i.Key(), nil
+	}
+	for _, size := range i.generatedSizes() {
+		if size.Name == name {
+			return i.variantKey(name), nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+// generatedSizes returns the sizes recorded in the Sizes column ("thumb:320,medium:800")
+func (i *Image) generatedSizes() []ImageSize {
+	var sizes []ImageSize
+	for _, s := range strings.Split(i.Sizes, ",") {
+		parts := strings.SplitN(s, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		width, err := strconv.Atoi(parts[1])
+		if err != nil {
+			continue
+		}
+		sizes = append(sizes, ImageSize{Name: parts[0], Width: width})
+	}
+	return sizes
+}
+
+func (i *Image) setGeneratedSizes(sizes []ImageSize) {
+	parts := make([]string, len(sizes))
+	for n, s := range sizes {
+		parts[n] = fmt.Sprintf("%s:%d", s.Name, s.Width)
+	}
+	i.Sizes = strings.Join(parts, ",")
+}
+
+// resizedImage is a derived size that is ready to be stored
+type resizedImage struct {
+	size ImageSize
+	data []byte
+}
+
+// resize decodes the original and scales it down to each of the sizes
+// Sizes that are not smaller than the original are skipped so that images are never upscaled
+// Only JPEG and PNG images are resized; for any other format
+// the original's dimensions are returned along with no derived sizes
+//
+// The dimensions are read from the header before anything is decoded: a small file can claim
+// to be huge (a "decompression bomb"), and an *ImagePixelsError is returned when it has more than maxPixels
+func resize(original []byte, sizes []ImageSize, maxPixels int) (width, height int, resized []resizedImage, err error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(original))
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > int64(maxPixels) {
+		return 0, 0, nil, &ImagePixelsError{Width: cfg.Width, Height: cfg.Height, MaxPixels: maxPixels}
+	}
+
+	src, format, err := image.Decode(bytes.NewReader(original))
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	bounds := src.Bounds()
+	width, height = bounds.Dx(), bounds.Dy()
+
+	if format != "jpeg" && format != "png" {
+		return width, height, nil, nil
+	}
+
+	for _, size := range sizes {
+		if size.Width <= 0 || size.Width >= width {
+			continue
+		}
+
+		h := height * size.Width / width
+		if h < 1 {
+			h = 1
+		}
+		dst := image.NewRGBA(image.Rect(0, 0, size.Width, h))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+
+		var buf bytes.Buffer
+		if format == "jpeg" {
+			err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: jpegQuality})
+		} else {
+			err = png.Encode(&buf, dst)
+		}
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		resized = append(resized, resizedImage{size: size, data: buf.Bytes()})
+	}
+
+	return width, height, resized, nil
+}
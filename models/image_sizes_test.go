@@ -0,0 +1,77 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func encodePNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// bombPNG is a PNG header claiming to be width×height, without any pixels
+// Decoding it for real would allocate width×height×4 bytes
+func bombPNG(width, height uint32) []byte {
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], width)
+	binary.BigEndian.PutUint32(ihdr[4:], height)
+	ihdr[8] = 8 // bit depth
+	ihdr[9] = 6 // RGBA
+
+	var buf bytes.Buffer
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+	binary.Write(&buf, binary.BigEndian, uint32(len(ihdr)))
+	chunk := append([]byte("IHDR"), ihdr...)
+	buf.Write(chunk)
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+	return buf.Bytes()
+}
+
+func TestResizeMaxPixels(t *testing.T) {
+	sizes := []ImageSize{{Name: "thumb", Width: 20}}
+	tests := []struct {
+		name      string
+		original  []byte
+		maxPixels int
+		rejected  bool
+		resized   int
+	}{
+		{"under the limit", encodePNG(t, 40, 30), 40 * 30, false, 1},
+		{"over the limit", encodePNG(t, 40, 31), 40 * 30, true, 0},
+		{"decompression bomb", bombPNG(100000, 100000), DefaultMaxImagePixels, true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, resized, err := resize(tt.original, sizes, tt.maxPixels)
+
+			var pixelsErr *ImagePixelsError
+			if rejected := errors.As(err, &pixelsErr); rejected != tt.rejected {
+				t.Fatalf("resize() err = %v, rejected = %v, want %v", err, rejected, tt.rejected)
+			}
+			if !tt.rejected && err != nil {
+				t.Fatal(err)
+			}
+			if len(resized) != tt.resized {
+				t.Errorf("resize() made %d sizes, want %d", len(resized), tt.resized)
+			}
+		})
+	}
+}
+
+func TestImagePixelsErrorPublic(t *testing.T) {
+	err := &ImagePixelsError{Width: 9000, Height: 6000, MaxPixels: DefaultMaxImagePixels}
+	if got, want := err.Public(), "Images must not be larger than 40 megapixels, this one is 9000x6000."; got != want {
+		t.Errorf("Public() = %q, want %q", got, want)
+	}
+}
@@ -1,18 +1,54 @@
 package models
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"net/http"
 	"net/url"
-	"os"
-	"path/filepath"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/hash"
+	"lenslocked.com/rand"
 )
 
-// Image is not stored in the database
+// Image is an uploaded file that belongs to a gallery
+// The file itself is kept in the BlobStore under galleries/<gallery id>/<filename>
+// while the record keeps its owner, order, caption and upload time (CreatedAt)
 type Image struct {
-	GalleryID uint
-	Filename  string
+	gorm.Model
+	GalleryID uint   `gorm:"not null;index"`
+	UserID    uint   `gorm:"not null;index"`
+	Filename  string `gorm:"not null"`
+	Caption   string
+	Position  int `gorm:"not null"`
+
+	// Width and Height of the original in pixels, 0 when unknown (e.g. backfilled images)
+	Width  int `gorm:"not null"`
+	Height int `gorm:"not null"`
+
+	// Sizes lists the derived sizes that were generated on upload, e.g. "thumb:320,medium:800"
+	Sizes string `gorm:"not null"`
+
+	// URL is where browsers fetch the file from, e.g. /images/galleries/20/beach.jpg
+	// It is filled in by the ImageService; the app checks that the gallery may be seen
+	// before sending the file (or redirecting to a presigned S3 url)
+	URL string `gorm:"-"`
+
+	// EmbedURL is a signed url that works without a login until it expires (see ImageService.SignedURL)
+	// It is only filled in for the owner of the gallery
+	EmbedURL string `gorm:"-"`
+
+	// Variants are the derived sizes, from the smallest to the largest,
+	// filled in by the ImageService as well
+	Variants []ImageVariant `gorm:"-"`
 }
 
 // func (i *Image) String() string {
@@ -20,98 +56,548 @@ type Image struct {
 // }
 
 func (i *Image) Path() string {
-	temp := url.URL{
-		Path: "/" + i.RelativePath(),
-	}
+	return i.URL
+}
 
-	return temp.String()
+// Key is where the file is kept in the BlobStore
+func (i *Image) Key() string {
+	return imagePrefix(i.GalleryID) + i.Filename
 }
 
-func (i *Image) RelativePath() string {
-	return fmt.Sprintf("images/galleries/%v/%v", i.GalleryID, i.Filename)
+// ImageDB interface exposes the methods that engages the images table
+type ImageDB interface {
+	ByID(id uint) (*Image, error)
+	ByGalleryID(galleryID uint) ([]Image, error)
+	ByFilename(galleryID uint, filename string) (*Image, error)
+	Create(image *Image) error
+	Update(image *Image) error
+	Delete(image *Image) error
 }
 
+// ImageService interface implements ImageDB
+// Upload and Delete also take care of the image file
 type ImageService interface {
-	Create(galleryID uint, r io.ReadCloser, filename string) error
-	Delete(i *Image) error
-	makeImagePath(galleryID uint) (string, error)
-	ByGalleryID(galleryID uint) ([]Image, error)
+	ImageDB
+
+	// Upload checks that r is a JPEG or PNG image of at most MaxImageBytes,
+	// writes it along with its derived sizes and creates the image record
+	// image must have its GalleryID and UserID set; its Filename is generated
+	Upload(image *Image, r io.Reader) error
+
+	// Open returns the file of the image, or of one of its derived sizes when size is not ""
+	// ErrNotFound is returned for sizes that were not generated
+	Open(image *Image, size string) (*ImageFile, error)
+
+	// SignedURL returns the url of the image (or of a derived size) with a signature
+	// that lets anyone fetch the file until ttl has passed, e.g. to embed it in another site
+	// ValidSignature checks the signature that came with a request
+	SignedURL(image *Image, size string, ttl time.Duration) string
+	ValidSignature(image *Image, size, sig string) bool
+}
+
+// ImageFile is what the app needs to send an image to a browser
+// Stores that browsers can fetch from directly (S3) only set RedirectURL
+type ImageFile struct {
+	Content     io.ReadSeekCloser
+	Size        int64
+	ModTime     time.Time
+	RedirectURL string
 }
 
 type imageService struct {
+	ImageDB
+	store  BlobStore
+	sizes  []ImageSize
+	signer *tokenSigner
+
+	// maxPixels is the largest width×height accepted on upload
+	maxPixels int
 }
 
-func NewImageService() ImageService {
-	return &imageService{}
+// imageValidator struct is a wrapper service around imageGorm to perform validations
+type imageValidator struct {
+	ImageDB
+}
+
+// imageGorm implement methods found in ImageDB
+type imageGorm struct {
+	db *gorm.DB
+}
+
+var _ ImageDB = &imageGorm{}
+var _ ImageDB = &imageValidator{}
+var _ ImageService = &imageService{}
+
+// sizes are the derived sizes generated on upload
+// hmacKey signs the urls given out by SignedURL
+func NewImageService(db *gorm.DB, store BlobStore, sizes []ImageSize, maxPixels int, hmacKey string) ImageService {
+	return &imageService{
+		ImageDB: &imageValidator{
+			ImageDB: &imageGorm{db},
+		},
+		store:  store,
+		sizes:  sortImageSizes(sizes),
+		signer: newTokenSigner(hash.NewHMAC(hmacKey)),
+
+		maxPixels: maxPixels,
+	}
 }
 
-// io.ReadCloser accepts anything ranging a mulitipart file to the string with a reader
-// wrapped around it
-func (is *imageService) Create(galleryID uint, r io.ReadCloser, filename string) error {
+// ************** THIS SECTION CONTAINS THE IMAGESERVICE METHODS **************
+
+// MaxImageBytes is the largest file that can be uploaded (see ErrImageTooLarge)
+const MaxImageBytes = 10 << 20
+
+// imageTypes maps the content types that can be uploaded to the extension they are stored with
+var imageTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+}
 
-	defer r.Close()
+// Upload writes the files before creating the record
+// New images are placed after the existing images of the gallery
+func (is *imageService) Upload(image *Image, r io.Reader) error {
 
-	// 1. Create a path for the image (e.g. images/galleries/20) via makeImagePath
-	path, err := is.makeImagePath(galleryID)
+	// Read one byte more than allowed to find out whether the file is too large
+	original, err := io.ReadAll(io.LimitReader(r, MaxImageBytes+1))
 	if err != nil {
 		return err
 	}
+	if len(original) > MaxImageBytes {
+		return ErrImageTooLarge
+	}
 
-	// 2. Create a destination file according based on the filename passed in
-	dst, err := os.Create(path + filename)
+	// The content type is sniffed from the first bytes of the file,
+	// so that neither the filename nor the type sent by the browser can be trusted
+	ext, ok := imageTypes[http.DetectContentType(original)]
+	if !ok {
+		return ErrImageType
+	}
+
+	// The filename sent by the browser is never used to store the file
+	name, err := rand.String(12)
 	if err != nil {
 		return err
 	}
+	image.Filename = name + ext
 
-	defer dst.Close()
+	existing, err := is.ImageDB.ByGalleryID(image.GalleryID)
+	if err != nil {
+		return err
+	}
+	image.Position = nextPosition(existing)
 
-	// 3. Copy the uploaded file data from the reader to the destination
-	_, err = io.Copy(dst, r)
+	// Files that cannot be decoded are kept as they are, without derived sizes,
+	// but images with too many pixels are rejected
+	width, height, resized, err := resize(original, is.sizes, is.maxPixels)
+	var pixelsErr *ImagePixelsError
+	if errors.As(err, &pixelsErr) {
+		return err
+	}
 	if err != nil {
+		slog.Warn("not resizing the image", "gallery_id", image.GalleryID, "filename", image.Filename, "err", err)
+	}
+	image.Width = width
+	image.Height = height
+
+	// Keep track of what has been written so that it can be removed if anything fails
+	written := []string{}
+	cleanup := func() {
+		for _, key := range written {
+			is.store.Delete(key)
+		}
+	}
+
+	if err := is.store.Put(image.Key(), bytes.NewReader(original)); err != nil {
 		return err
 	}
+	written = append(written, image.Key())
 
+	var generated []ImageSize
+	for _, ri := range resized {
+		key := image.variantKey(ri.size.Name)
+		if err := is.store.Put(key, bytes.NewReader(ri.data)); err != nil {
+			cleanup()
+			return err
+		}
+		written = append(written, key)
+		generated = append(generated, ri.size)
+	}
+	image.setGeneratedSizes(generated)
+
+	if err := is.ImageDB.Create(image); err != nil {
+		cleanup()
+		return err
+	}
+	is.setURL(image)
 	return nil
+}
 
+// Delete removes the record and then the files, derived sizes included
+func (is *imageService) Delete(image *Image) error {
+	if err := is.ImageDB.Delete(image); err != nil {
+		return err
+	}
+	for _, size := range image.generatedSizes() {
+		if err := is.store.Delete(image.variantKey(size.Name)); err != nil {
+			return err
+		}
+	}
+	return is.store.Delete(image.Key())
 }
 
-func (is *imageService) makeImagePath(galleryID uint) (string, error) {
-	galleryPath := is.imagePath(galleryID)
-	err := os.MkdirAll(galleryPath, 0755)
+func (is *imageService) ByID(id uint) (*Image, error) {
+	image, err := is.ImageDB.ByID(id)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	is.setURL(image)
+	return image, nil
+}
+
+func (is *imageService) ByFilename(galleryID uint, filename string) (*Image, error) {
+	image, err := is.ImageDB.ByFilename(galleryID, filename)
+	if err != nil {
+		return nil, err
 	}
-	return galleryPath, err
+	is.setURL(image)
+	return image, nil
 }
 
 func (is *imageService) ByGalleryID(galleryID uint) ([]Image, error) {
+	images, err := is.ImageDB.ByGalleryID(galleryID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range images {
+		is.setURL(&images[i])
+	}
+	return images, nil
+}
 
-	path := is.imagePath(galleryID)
+// Open asks the store for a url first, so that S3 files are not downloaded by the app
+func (is *imageService) Open(image *Image, size string) (*ImageFile, error) {
+	key, err := image.sizeKey(size)
+	if err != nil {
+		return nil, err
+	}
 
-	imgStrings, err := filepath.Glob(path + "*")
+	u, err := is.store.URL(key)
+	if err != nil {
+		return nil, err
+	}
+	if u != "" {
+		return &ImageFile{RedirectURL: u}, nil
+	}
 
+	content, info, err := is.store.Open(key)
 	if err != nil {
 		return nil, err
 	}
 
-	ret := make([]Image, len(imgStrings))
-	for i := range imgStrings {
-		imgStrings[i] = strings.Replace(imgStrings[i], path, "", 1)
-		// strings[i] = "/" + strings[i]
-		ret[i] = Image{
-			Filename:  imgStrings[i],
-			GalleryID: galleryID,
+	// Files are never changed once uploaded, so the upload time will do
+	// when the store does not know when the file was written
+	modTime := info.ModTime
+	if modTime.IsZero() {
+		modTime = image.CreatedAt
+	}
+	return &ImageFile{Content: content, Size: info.Size, ModTime: modTime}, nil
+}
+
+// The signature covers the image and the size, so it cannot be reused for another file
+func (is *imageService) SignedURL(image *Image, size string, ttl time.Duration) string {
+	key, err := image.sizeKey(size)
+	if err != nil {
+		// fall back to the original, like Src does
+		key, size = image.Key(), ""
+	}
+	sig := is.signer.Sign("image", ttl, strconv.FormatUint(uint64(image.ID), 10), size)
+	return imageURL(key) + "?" + url.Values{"sig": {sig}}.Encode()
+}
+
+func (is *imageService) ValidSignature(image *Image, size, sig string) bool {
+	fields, err := is.signer.Parse("image", sig)
+	if err != nil || len(fields) != 2 {
+		return false
+	}
+	return fields[0] == strconv.FormatUint(uint64(image.ID), 10) && fields[1] == size
+}
+
+// setURL fills in the urls of the image and of its derived sizes
+func (is *imageService) setURL(image *Image) {
+	image.URL = imageURL(image.Key())
+
+	image.Variants = nil
+	for _, size := range sortImageSizes(image.generatedSizes()) {
+		image.Variants = append(image.Variants, ImageVariant{
+			Name:  size.Name,
+			Width: size.Width,
+			URL:   imageURL(image.variantKey(size.Name)),
+		})
+	}
+}
+
+// nextPosition returns the position after the last of the images
+// Their count is not enough, since deleting and reordering images leaves gaps in the positions
+func nextPosition(images []Image) int {
+	next := 0
+	for _, image := range images {
+		next = max(next, image.Position+1)
+	}
+	return next
+}
+
+// imageURL is the path the app serves the file with the given key under, see controllers.Images
+func imageURL(key string) string {
+	u := url.URL{Path: "/images/" + key}
+	return u.String()
+}
+
+// imagesPrefix is the part of the key shared by the images of every gallery
+const imagesPrefix = "galleries/"
+
+func imagePrefix(galleryID uint) string {
+	return fmt.Sprintf("%s%v/", imagesPrefix, galleryID)
+}
+
+// ************** THIS SECTION CONTAINS THE IMAGEGORM METHODS **************
+
+func (ig *imageGorm) ByID(id uint) (*Image, error) {
+	var image Image
+	err := first(ig.db.Where("id=?", id), &image)
+	return &image, err
+}
+
+func (ig *imageGorm) ByFilename(galleryID uint, filename string) (*Image, error) {
+	var image Image
+	err := first(ig.db.Where("gallery_id=? AND filename=?", galleryID, filename), &image)
+	if err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+// ByGalleryID returns the images of the gallery in the order they are displayed
+func (ig *imageGorm) ByGalleryID(galleryID uint) ([]Image, error) {
+	var images []Image
+	err := ig.db.Where("gallery_id=?", galleryID).Order("position asc, id asc").Find(&images).Error
+	if err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (ig *imageGorm) Create(image *Image) error {
+	return ig.db.Create(image).Error
+}
+
+func (ig *imageGorm) Update(image *Image) error {
+	return ig.db.Save(image).Error
+}
+
+// Delete will remove the image record
+// The record is removed for good (Unscoped) since the file is gone as well,
+// and so that the filename can be uploaded to the gallery again
+// IMPORTANT: Please make sure a value of > 0 is supplied, otherwise the entire table will be wiped out
+func (ig *imageGorm) Delete(image *Image) error {
+	return ig.db.Unscoped().Delete(&Image{Model: gorm.Model{ID: image.ID}}).Error
+}
+
+// ************** THIS SECTION CONTAINS THE VALIDATION CHAINING METHODS FOR IMAGES **************
+
+type imageValidateFunc func(*Image) error
+
+func runImageValFuncs(image *Image, fns ...imageValidateFunc) error {
+	for _, fn := range fns {
+		if err := fn(image); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+func (iv *imageValidator) Create(image *Image) error {
+	if err := runImageValFuncs(image,
+		iv.galleryIDRequired,
+		iv.userIDRequired,
+		iv.filenameRequired,
+		iv.filenameSafe,
+	); err != nil {
+		return err
+	}
+	return iv.ImageDB.Create(image)
+}
+
+func (iv *imageValidator) Update(image *Image) error {
+	if err := runImageValFuncs(image,
+		iv.idBeGreaterThan(0),
+		iv.galleryIDRequired,
+		iv.userIDRequired,
+		iv.filenameRequired,
+		iv.filenameSafe,
+	); err != nil {
+		return err
+	}
+	return iv.ImageDB.Update(image)
+}
+
+// Delete will remove an image from the table
+// IMPORTANT: Please make sure a value of > 0 is supplied, otherwise the entire table will be wiped out
+func (iv *imageValidator) Delete(image *Image) error {
+	if err := runImageValFuncs(image, iv.idBeGreaterThan(0)); err != nil {
+		return err
+	}
+	return iv.ImageDB.Delete(image)
+}
+
+func (iv *imageValidator) galleryIDRequired(i *Image) error {
+	if i.GalleryID <= 0 {
+		return ErrInvalidID
+	}
+	return nil
+}
+
+func (iv *imageValidator) userIDRequired(i *Image) error {
+	if i.UserID <= 0 {
+		return ErruserIDRequired
+	}
+	return nil
+}
 
-	return ret, nil
+func (iv *imageValidator) filenameRequired(i *Image) error {
+	if i.Filename == "" {
+		return ErrFilenameRequired
+	}
+	return nil
 }
 
-func (is *imageService) imagePath(galleryID uint) string {
-	// Make a directory for the gallery image(s)
-	return fmt.Sprintf("images/galleries/%v/", galleryID)
+// filenameSafe makes sure the filename stays inside the gallery's directory
+// Generated filenames always pass, uploads and backfilled images both get one
+func (iv *imageValidator) filenameSafe(i *Image) error {
+	if strings.ContainsAny(i.Filename, "/\\\x00") || strings.HasPrefix(i.Filename, ".") {
+		return ErrFilenameInvalid
+	}
+	return nil
 }
 
-func (is *imageService) Delete(i *Image) error {
-	return os.Remove(i.RelativePath())
+func (iv *imageValidator) idBeGreaterThan(n uint) imageValidateFunc {
+	return imageValidateFunc(func(image *Image) error {
+		if image.ID <= n {
+			return ErrInvalidID
+		}
+		return nil
+	})
+}
+
+// ************** THIS SECTION CONTAINS THE IMAGE BACKFILL **************
+
+// BackfillImages creates image records for the files in the BlobStore (galleries/<id>/<filename>)
+// that were uploaded before images were stored in the database
+// Files that already have a record, or whose gallery no longer exists, are skipped
+// It returns the number of records created
+//
+// Every file is moved to a random filename, like the ones given to uploads,
+// since the original names (IMG_0001.jpg, ...) could be guessed from an unlisted gallery's ID
+func (s *Services) BackfillImages() (int, error) {
+
+	blobs, err := s.blobs.List(imagesPrefix)
+	if err != nil {
+		return 0, err
+	}
+
+	// keep the order the files were uploaded in
+	sort.SliceStable(blobs, func(i, j int) bool {
+		return blobs[i].ModTime.Before(blobs[j].ModTime)
+	})
+
+	byGallery := make(map[uint][]BlobInfo)
+	var galleryIDs []uint
+	for _, blob := range blobs {
+		parts := strings.Split(strings.TrimPrefix(blob.Key, imagesPrefix), "/")
+		if len(parts) != 2 {
+			continue
+		}
+		id, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		if _, ok := byGallery[uint(id)]; !ok {
+			galleryIDs = append(galleryIDs, uint(id))
+		}
+		byGallery[uint(id)] = append(byGallery[uint(id)], blob)
+	}
+
+	created := 0
+	for _, id := range galleryIDs {
+		gallery, err := s.Gallery.ByID(id)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return created, err
+		}
+
+		existing, err := s.Image.ByGalleryID(gallery.ID)
+		if err != nil {
+			return created, err
+		}
+		known := make(map[string]bool)
+		for _, e := range existing {
+			known[e.Filename] = true
+		}
+
+		position := nextPosition(existing)
+		for _, blob := range byGallery[id] {
+			filename := path.Base(blob.Key)
+			if known[filename] {
+				continue
+			}
+
+			ext := strings.ToLower(path.Ext(filename))
+			if ext != ".jpg" && ext != ".jpeg" && ext != ".png" {
+				slog.Warn("not importing the file, it is not an image", "key", blob.Key)
+				continue
+			}
+			name, err := rand.String(12)
+			if err != nil {
+				return created, err
+			}
+
+			image := Image{
+				GalleryID: gallery.ID,
+				UserID:    gallery.UserID,
+				Filename:  name + ext,
+				Position:  position,
+			}
+			image.CreatedAt = blob.ModTime
+
+			if err := s.moveImage(blob.Key, &image); err != nil {
+				return created, err
+			}
+			position++
+			created++
+		}
+	}
+
+	return created, nil
+}
+
+// moveImage copies the file at key to the image's key and creates the record,
+// and only then removes the file at key, so that a failure never loses the file
+func (s *Services) moveImage(key string, image *Image) error {
+	rc, _, err := s.blobs.Open(key)
+	if err != nil {
+		return err
+	}
+	err = s.blobs.Put(image.Key(), rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+
+	if err := s.Image.Create(image); err != nil {
+		s.blobs.Delete(image.Key())
+		return err
+	}
+	return s.blobs.Delete(key)
 }
@@ -0,0 +1,107 @@
+package models
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestNextPosition(t *testing.T) {
+	tests := []struct {
+		name      string
+		positions []int
+		want      int
+	}{
+		{"no images", nil, 0},
+		{"in order", []int{0, 1, 2}, 3},
+		{"gap after a delete", []int{0, 2}, 3},
+		{"moved to the end", []int{1, 2, 5}, 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var images []Image
+			for _, p := range tt.positions {
+				images = append(images, Image{Position: p})
+			}
+			if got := nextPosition(images); got != tt.want {
+				t.Errorf("nextPosition() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUploadTooLarge(t *testing.T) {
+	is := &imageService{}
+	err := is.Upload(&Image{GalleryID: 1}, bytes.NewReader(make([]byte, MaxImageBytes+1)))
+	if err != ErrImageTooLarge {
+		t.Fatalf("Upload() err = %v, want ErrImageTooLarge", err)
+	}
+	if !strings.Contains(ErrImageTooLarge.Error(), "10 megabytes") {
+		t.Errorf("the message %q does not give the limit", ErrImageTooLarge.Error())
+	}
+}
+
+func TestBackfillImagesRenamesFiles(t *testing.T) {
+	forEachDialect(t, testBackfillImagesRenamesFiles)
+}
+
+func testBackfillImagesRenamesFiles(t *testing.T, s *Services) {
+	gallery := Gallery{UserID: 1, Title: "Holiday", Visibility: VisibilityUnlisted}
+	if err := s.Gallery.Create(&gallery); err != nil {
+		t.Fatal(err)
+	}
+
+	prefix := imagePrefix(gallery.ID)
+	files := map[string]string{
+		prefix + "IMG_0001.JPG": "first",
+		prefix + "IMG_0002.png": "second",
+		prefix + "notes.txt":    "not an image",
+	}
+	for key, content := range files {
+		if err := s.blobs.Put(key, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := s.BackfillImages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("BackfillImages() imported %d images, want 2", n)
+	}
+
+	images, err := s.Image.ByGalleryID(gallery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := map[string]bool{}
+	for _, image := range images {
+		if strings.HasPrefix(image.Filename, "IMG_") {
+			t.Errorf("the image kept its original filename %s", image.Filename)
+		}
+		rc, _, err := s.blobs.Open(image.Key())
+		if err != nil {
+			t.Fatalf("opening %s: %v", image.Key(), err)
+		}
+		b, _ := io.ReadAll(rc)
+		rc.Close()
+		contents[string(b)] = true
+	}
+	if !contents["first"] || !contents["second"] {
+		t.Errorf("the imported files hold %v, want first and second", contents)
+	}
+
+	for _, key := range []string{prefix + "IMG_0001.JPG", prefix + "IMG_0002.png"} {
+		if _, _, err := s.blobs.Open(key); err != ErrNotFound {
+			t.Errorf("%s is still there after the backfill (err = %v)", key, err)
+		}
+	}
+
+	// running it again imports nothing
+	if n, err := s.BackfillImages(); err != nil || n != 0 {
+		t.Errorf("BackfillImages() again = %d, %v; want 0, nil", n, err)
+	}
+}
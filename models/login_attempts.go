@@ -0,0 +1,248 @@
+package models
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// LoginAttempt counts the recent failed attempts for a subject,
+// e.g. "login:ip:127.0.0.1" or "login:email:jon@example.com"
+type LoginAttempt struct {
+	Subject      string `gorm:"primary_key"`
+	Failures     int    `gorm:"not null"`
+	LastFailedAt time.Time
+	LockedUntil  time.Time
+}
+
+// AttemptStore is where the failed attempt counters are kept
+// Use the in-memory store for a single instance, and the database store
+// when more than one instance of the app needs to share the counters
+type AttemptStore interface {
+	// BySubject returns the counter of the subject,
+	// or a zero LoginAttempt if there have been no failures
+	BySubject(subject string) (*LoginAttempt, error)
+
+	// Increment counts a failure at now in one step, starting the counter over
+	// when the last failure is older than attemptWindow, and returns the new counter
+	// Concurrent failures are all counted, unlike a read followed by a save
+	Increment(subject string, now time.Time) (*LoginAttempt, error)
+
+	// Lock locks the subject until the given time, unless it is already locked for longer
+	Lock(subject string, until time.Time) error
+
+	Delete(subject string) error
+}
+
+// AttemptService decides when a subject is locked out
+type AttemptService interface {
+	// Check returns a *LockoutError if any of the subjects is locked
+	Check(subjects ...string) error
+
+	// Fail records a failed attempt for each subject
+	Fail(subjects ...string) error
+
+	// Reset clears the counters, e.g. after a successful login
+	Reset(subjects ...string) error
+}
+
+const (
+	// freeAttempts is the number of failures allowed before any lockout
+	freeAttempts = 5
+
+	// baseLockout doubles with every failure after the free attempts, up to maxLockout
+	baseLockout = time.Second
+	maxLockout  = 15 * time.Minute
+
+	// attemptWindow is how long a counter is kept after the last failure
+	attemptWindow = time.Hour
+)
+
+type attemptService struct {
+	store AttemptStore
+}
+
+var _ AttemptService = &attemptService{}
+
+func NewAttemptService(store AttemptStore) AttemptService {
+	return &attemptService{store}
+}
+
+func (as *attemptService) Check(subjects ...string) error {
+	now := time.Now()
+	for _, subject := range subjects {
+		attempt, err := as.store.BySubject(subject)
+		if err != nil {
+			return err
+		}
+		if now.Before(attempt.LockedUntil) {
+			return &LockoutError{RetryAfter: attempt.LockedUntil.Sub(now)}
+		}
+	}
+	return nil
+}
+
+// Fail increments the counters and locks the subject with exponential backoff
+// once the free attempts have been used up
+func (as *attemptService) Fail(subjects ...string) error {
+	now := time.Now()
+	for _, subject := range subjects {
+		attempt, err := as.store.Increment(subject, now)
+		if err != nil {
+			return err
+		}
+		if attempt.Failures <= freeAttempts {
+			continue
+		}
+		if err := as.store.Lock(subject, now.Add(lockoutFor(attempt.Failures-freeAttempts))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (as *attemptService) Reset(subjects ...string) error {
+	for _, subject := range subjects {
+		if err := as.store.Delete(subject); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockoutFor returns baseLockout * 2^(n-1), capped at maxLockout
+func lockoutFor(n int) time.Duration {
+	d := float64(baseLockout) * math.Pow(2, float64(n-1))
+	if d > float64(maxLockout) {
+		return maxLockout
+	}
+	return time.Duration(d)
+}
+
+// ************** THIS SECTION CONTAINS THE IN-MEMORY ATTEMPTSTORE **************
+
+type memoryAttempts struct {
+	mu       sync.Mutex
+	attempts map[string]LoginAttempt
+}
+
+var _ AttemptStore = &memoryAttempts{}
+
+// NewMemoryAttemptStore keeps the counters in memory
+// The counters are lost on restart and are not shared between instances
+func NewMemoryAttemptStore() AttemptStore {
+	return &memoryAttempts{
+		attempts: make(map[string]LoginAttempt),
+	}
+}
+
+func (ma *memoryAttempts) BySubject(subject string) (*LoginAttempt, error) {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	attempt := ma.attempts[subject]
+	return &attempt, nil
+}
+
+// Increment reads and writes the counter under the lock, so that no failure is lost
+func (ma *memoryAttempts) Increment(subject string, now time.Time) (*LoginAttempt, error) {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+
+	attempt := ma.attempts[subject]
+	// counters start over once the subject has been quiet for a while
+	if now.Sub(attempt.LastFailedAt) > attemptWindow {
+		attempt.Failures = 0
+	}
+	attempt.Subject = subject
+	attempt.Failures++
+	attempt.LastFailedAt = now
+	ma.attempts[subject] = attempt
+
+	// drop stale counters so that the map cannot grow forever
+	if len(ma.attempts) > 10000 {
+		for subject, a := range ma.attempts {
+			if now.Sub(a.LastFailedAt) > attemptWindow && now.After(a.LockedUntil) {
+				delete(ma.attempts, subject)
+			}
+		}
+	}
+	return &attempt, nil
+}
+
+func (ma *memoryAttempts) Lock(subject string, until time.Time) error {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	attempt, ok := ma.attempts[subject]
+	if ok && until.After(attempt.LockedUntil) {
+		attempt.LockedUntil = until
+		ma.attempts[subject] = attempt
+	}
+	return nil
+}
+
+func (ma *memoryAttempts) Delete(subject string) error {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	delete(ma.attempts, subject)
+	return nil
+}
+
+// ************** THIS SECTION CONTAINS THE DATABASE ATTEMPTSTORE **************
+
+type attemptGorm struct {
+	db *gorm.DB
+}
+
+var _ AttemptStore = &attemptGorm{}
+
+// NewGormAttemptStore keeps the counters in the login_attempts table
+// of the database so that every instance sees the same counters
+func NewGormAttemptStore(db *gorm.DB) AttemptStore {
+	return &attemptGorm{db}
+}
+
+func (ag *attemptGorm) BySubject(subject string) (*LoginAttempt, error) {
+	var attempt LoginAttempt
+	err := first(ag.db.Where("subject=?", subject), &attempt)
+	if err == ErrNotFound {
+		return &LoginAttempt{Subject: subject}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &attempt, nil
+}
+
+// Increment creates the counter when it does not exist yet, and then increments it
+// in a single UPDATE, like shareLinkGorm.AddView, so that concurrent failures are all counted
+func (ag *attemptGorm) Increment(subject string, now time.Time) (*LoginAttempt, error) {
+	err := ag.db.Exec(`INSERT INTO login_attempts (subject, failures, last_failed_at, locked_until)
+		VALUES (?, 0, ?, ?) ON CONFLICT (subject) DO NOTHING`, subject, time.Time{}, time.Time{}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	// counters start over once the subject has been quiet for a while
+	err = ag.db.Model(&LoginAttempt{}).Where("subject=?", subject).UpdateColumns(map[string]interface{}{
+		"failures":       gorm.Expr("CASE WHEN last_failed_at < ? THEN 1 ELSE failures + 1 END", now.Add(-attemptWindow)),
+		"last_failed_at": now,
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+	return ag.BySubject(subject)
+}
+
+// Lock only ever moves locked_until forward, so that a shorter lockout
+// from a concurrent failure cannot replace a longer one
+func (ag *attemptGorm) Lock(subject string, until time.Time) error {
+	return ag.db.Model(&LoginAttempt{}).
+		Where("subject=? AND (locked_until IS NULL OR locked_until<?)", subject, until).
+		UpdateColumn("locked_until", until).Error
+}
+
+func (ag *attemptGorm) Delete(subject string) error {
+	return ag.db.Where("subject=?", subject).Delete(&LoginAttempt{}).Error
+}
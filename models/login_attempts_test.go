@@ -0,0 +1,80 @@
+package models
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAttemptServiceConcurrentFailures(t *testing.T) {
+	stores := map[string]func(t *testing.T) AttemptStore{
+		"memory": func(t *testing.T) AttemptStore { return NewMemoryAttemptStore() },
+	}
+	for _, db := range testDatabases() {
+		stores[db.dialect] = func(t *testing.T) AttemptStore { return NewGormAttemptStore(newDialectServices(t, db).db) }
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			as := NewAttemptService(store)
+
+			const failures = 20
+			var wg sync.WaitGroup
+			for i := 0; i < failures; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := as.Fail("login:ip:127.0.0.1"); err != nil {
+						t.Error(err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			attempt, err := store.BySubject("login:ip:127.0.0.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if attempt.Failures != failures {
+				t.Errorf("Failures = %d, want %d", attempt.Failures, failures)
+			}
+
+			var lockout *LockoutError
+			if err := as.Check("login:ip:127.0.0.1"); !errors.As(err, &lockout) {
+				t.Fatalf("Check() = %v, want a *LockoutError", err)
+			}
+			if want := lockoutFor(failures - freeAttempts); lockout.RetryAfter > want || lockout.RetryAfter < want/2 {
+				t.Errorf("RetryAfter = %v, want about %v", lockout.RetryAfter, want)
+			}
+
+			if err := as.Reset("login:ip:127.0.0.1"); err != nil {
+				t.Fatal(err)
+			}
+			if err := as.Check("login:ip:127.0.0.1"); err != nil {
+				t.Errorf("Check() after Reset = %v", err)
+			}
+		})
+	}
+}
+
+func TestAttemptStoreStartsOverAfterWindow(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, s *Services) {
+		store := NewGormAttemptStore(s.db)
+		now := time.Now()
+
+		for i := 0; i < 3; i++ {
+			if _, err := store.Increment("login:email:jon@example.com", now.Add(-2*attemptWindow)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		attempt, err := store.Increment("login:email:jon@example.com", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attempt.Failures != 1 {
+			t.Errorf("Failures = %d, want 1", attempt.Failures)
+		}
+	})
+}
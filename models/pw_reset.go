@@ -0,0 +1,169 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/hash"
+	"lenslocked.com/rand"
+)
+
+// PwReset is a single-use token that allows a user to set a new password
+// Only the HMAC of the token is stored, the raw token is sent to the user by email
+type PwReset struct {
+	gorm.Model
+	UserID    uint      `gorm:"not null"`
+	Token     string    `gorm:"-" json:"-"`
+	TokenHash string    `gorm:"not null;unique_index" json:"-"`
+	ExpiresAt time.Time `gorm:"not null"`
+}
+
+// PwResetDB interface exposes the methods that engages the pw_resets table
+type PwResetDB interface {
+	ByToken(token string) (*PwReset, error)
+	Create(pwr *PwReset) error
+
+	// Claim hard deletes the reset with pwr's ID and token hash, so that the token can never be used again
+	// ErrTokenInvalid is returned when it is already gone, i.e. another request used the token first
+	Claim(pwr *PwReset) error
+}
+
+// pwResetValidator is a wrapper around pwResetGorm to hash
+// the token and set the expiry before it reaches the database
+type pwResetValidator struct {
+	PwResetDB
+	hmac hash.HMAC
+	ttl  time.Duration
+}
+
+// pwResetGorm implement methods found in PwResetDB
+type pwResetGorm struct {
+	db *gorm.DB
+}
+
+var _ PwResetDB = &pwResetValidator{}
+var _ PwResetDB = &pwResetGorm{}
+
+func newPwResetValidator(db PwResetDB, hmac hash.HMAC, ttl time.Duration) *pwResetValidator {
+	return &pwResetValidator{
+		PwResetDB: db,
+		hmac:      hmac,
+		ttl:       ttl,
+	}
+}
+
+// ************** THIS SECTION CONTAINS THE PWRESETGORM METHODS **************
+
+// ByToken looks up a reset with the given token hash
+// This method expects the token to already be hashed
+func (pwrg *pwResetGorm) ByToken(tokenHash string) (*PwReset, error) {
+	var pwr PwReset
+	err := first(pwrg.db.Where("token_hash=?", tokenHash), &pwr)
+	if err != nil {
+		return nil, err
+	}
+	return &pwr, nil
+}
+
+func (pwrg *pwResetGorm) Create(pwr *PwReset) error {
+	return pwrg.db.Create(pwr).Error
+}
+
+// Claim deletes the reset in a single statement, so of two requests with the same token only one affects the row
+func (pwrg *pwResetGorm) Claim(pwr *PwReset) error {
+	db := pwrg.db.Unscoped().Where("id=? AND token_hash=?", pwr.ID, pwr.TokenHash).Delete(&PwReset{})
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected != 1 {
+		return ErrTokenInvalid
+	}
+	return nil
+}
+
+// ************** THIS SECTION CONTAINS THE VALIDATION CHAINING METHODS FOR PWRESET **************
+
+type pwResetValidateFunc func(*PwReset) error
+
+func runPwResetValFuncs(pwr *PwReset, fns ...pwResetValidateFunc) error {
+	for _, fn := range fns {
+		if err := fn(pwr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ByToken hashes the raw token and then checks that the reset has not expired
+func (pwrv *pwResetValidator) ByToken(token string) (*PwReset, error) {
+	pwr := PwReset{Token: token}
+	if err := runPwResetValFuncs(&pwr, pwrv.hmacToken); err != nil {
+		return nil, err
+	}
+
+	found, err := pwrv.PwResetDB.ByToken(pwr.TokenHash)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrTokenInvalid
+		}
+		return nil, err
+	}
+
+	if time.Now().After(found.ExpiresAt) {
+		return nil, ErrTokenInvalid
+	}
+
+	return found, nil
+}
+
+// Create generates the token, sets the expiry and hashes the token
+func (pwrv *pwResetValidator) Create(pwr *PwReset) error {
+	if err := runPwResetValFuncs(pwr,
+		pwrv.userIDRequired,
+		pwrv.setTokenIfUnset,
+		pwrv.setExpiry,
+		pwrv.hmacToken,
+	); err != nil {
+		return err
+	}
+	return pwrv.PwResetDB.Create(pwr)
+}
+
+func (pwrv *pwResetValidator) Claim(pwr *PwReset) error {
+	if pwr.ID <= 0 {
+		return ErrInvalidID
+	}
+	return pwrv.PwResetDB.Claim(pwr)
+}
+
+func (pwrv *pwResetValidator) userIDRequired(pwr *PwReset) error {
+	if pwr.UserID <= 0 {
+		return ErruserIDRequired
+	}
+	return nil
+}
+
+func (pwrv *pwResetValidator) setTokenIfUnset(pwr *PwReset) error {
+	if pwr.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	pwr.Token = token
+	return nil
+}
+
+func (pwrv *pwResetValidator) setExpiry(pwr *PwReset) error {
+	pwr.ExpiresAt = time.Now().Add(pwrv.ttl)
+	return nil
+}
+
+func (pwrv *pwResetValidator) hmacToken(pwr *PwReset) error {
+	if pwr.Token == "" {
+		return nil
+	}
+	pwr.TokenHash = pwrv.hmac.Hash(pwr.Token)
+	return nil
+}
@@ -0,0 +1,84 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/hash"
+	"lenslocked.com/rand"
+)
+
+// RecoveryCodeCount is the number of recovery codes given to a user
+// when they enable two-factor authentication
+const RecoveryCodeCount = 10
+
+// RecoveryCode lets a user log in once when they don't have their authenticator app
+// Only the HMAC of the code is stored; the raw codes are shown to the user a single time
+type RecoveryCode struct {
+	ID        uint   `gorm:"primary_key"`
+	UserID    uint   `gorm:"not null;index"`
+	CodeHash  string `gorm:"not null;unique_index" json:"-"`
+	CreatedAt time.Time
+}
+
+// recoveryCodeDB interface exposes the methods that engages the recovery_codes table
+type recoveryCodeDB interface {
+	// Replace removes any existing codes of the user and creates new ones
+	Replace(userID uint) ([]string, error)
+
+	// Use deletes the matching code so that it cannot be used again
+	// ErrNotFound is returned when the user has no such code
+	Use(userID uint, code string) error
+}
+
+type recoveryCodeGorm struct {
+	db   *gorm.DB
+	hmac hash.HMAC
+}
+
+var _ recoveryCodeDB = &recoveryCodeGorm{}
+
+func (rcg *recoveryCodeGorm) Replace(userID uint) ([]string, error) {
+	if userID <= 0 {
+		return nil, ErruserIDRequired
+	}
+
+	codes := make([]string, RecoveryCodeCount)
+	tx := rcg.db.Begin()
+
+	if err := tx.Where("user_id=?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	for i := range codes {
+		code, err := rand.String(9)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		codes[i] = code
+
+		rc := RecoveryCode{
+			UserID:   userID,
+			CodeHash: rcg.hmac.Hash(code),
+		}
+		if err := tx.Create(&rc).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	return codes, tx.Commit().Error
+}
+
+func (rcg *recoveryCodeGorm) Use(userID uint, code string) error {
+	db := rcg.db.Where("user_id=? AND code_hash=?", userID, rcg.hmac.Hash(code)).Delete(&RecoveryCode{})
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -1,16 +1,36 @@
 package models
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"sync/atomic"
+	"time"
+
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"lenslocked.com/migrate"
 )
 
 // DBConnectionServices unifies all the connections to the database
 type Services struct {
-	Gallery GalleryService
-	User    UserService
-	Image   ImageService
-	db      *gorm.DB //both NewUserService and the methods here are accessing the same reference of gorm.DB
+	Gallery  GalleryService
+	User     UserService
+	Session  SessionService
+	Image    ImageService
+	Attempts AttemptService
+	Share    ShareLinkService
+	APIToken APITokenService
+	db       *gorm.DB //both NewUserService and the methods here are accessing the same reference of gorm.DB
+	blobs    BlobStore
+
+	// blobsWritable is set once Ready has written to the image store, see checkBlobs
+	blobsWritable atomic.Bool
+
+	migrations []migrate.Migration
 }
 
 type ServicesConfig func(*Services) error
@@ -33,19 +53,77 @@ func (s *Services) Close() error {
 	return s.db.Close()
 }
 
-// Destructive Reset allows the requestor the drop the existing database tables and re-create them for testing
-// NOT for production use
-func (s *Services) DestructiveReset() error {
-	err := s.db.DropTableIfExists(&User{}, &Gallery{}).Error
+// readyKey is the file Ready writes to the image store, and removes again
+const readyKey = "readyz"
+
+// Ready reports whether the app can serve requests:
+// the database must answer and the image store must have accepted a new file (see checkBlobs)
+func (s *Services) Ready(ctx context.Context) error {
+	if err := s.db.DB().PingContext(ctx); err != nil {
+		return fmt.Errorf("database: %w", err)
+	}
+	if s.blobs != nil {
+		if err := s.checkBlobs(); err != nil {
+			return fmt.Errorf("image store: %w", err)
+		}
+	}
+	return nil
+}
+
+// checkBlobs writes readyKey to the image store until that has worked once,
+// and from then on only looks the file up, which is no longer there
+// Writing on every probe would be two signed writes to the bucket every few seconds, from every instance
+func (s *Services) checkBlobs() error {
+	if !s.blobsWritable.Load() {
+		if err := s.blobs.Put(readyKey, strings.NewReader("ok")); err != nil {
+			return err
+		}
+		if err := s.blobs.Delete(readyKey); err != nil {
+			return err
+		}
+		s.blobsWritable.Store(true)
+		return nil
+	}
+
+	f, _, err := s.blobs.Open(readyKey)
+	if err == ErrNotFound {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	return s.AutoMigrate()
+	return f.Close()
 }
 
-// Automigrate will attempt to automatically migrate the users table
-func (s *Services) AutoMigrate() error {
-	return s.db.AutoMigrate(&User{}, &Gallery{}).Error
+// Migrator returns the runner used to apply and roll back the schema migrations
+func (s *Services) Migrator() *migrate.Runner {
+	return migrate.NewRunner(s.db.DB(), s.db.Dialect().GetName(), s.migrations)
+}
+
+// Destructive Reset allows the requestor the drop the existing database tables and re-create them for testing
+// Every migration is rolled back and applied again. The Postgres baseline (0001) cannot be rolled back,
+// since its tables may have been created by AutoMigrate, so the users and galleries tables are dropped here instead,
+// along with schema_migrations, which still lists the baseline
+// NOT for production use
+func (s *Services) DestructiveReset() error {
+	m := s.Migrator()
+	for {
+		rolledBack, err := m.Down()
+		if errors.Is(err, migrate.ErrIrreversible) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if rolledBack == nil {
+			break
+		}
+	}
+	if err := s.db.DropTableIfExists("galleries", "users", "schema_migrations").Error; err != nil {
+		return err
+	}
+	_, err := m.Up()
+	return err
 }
 
 // func AddImageService(services *DBServices) error {
@@ -53,24 +131,86 @@ func (s *Services) AutoMigrate() error {
 // 	return nil
 // }
 
+// WithGorm connects to the database; dialect is "postgres" or "sqlite3"
 func WithGorm(dialect, connectionstring string) ServicesConfig {
 	return func(s *Services) error {
 		db, err := gorm.Open(dialect, connectionstring)
 		if err != nil {
 			return err
 		}
+		if dialect == "sqlite3" {
+			// SQLite only has one writer at a time anyway, and with a single connection
+			// an in-memory database (":memory:") is the same database for every query
+			db.DB().SetMaxOpenConns(1)
+		}
 		s.db = db
 		return nil
 	}
 }
 
+// WithMigrations loads the schema migrations of the database's dialect,
+// from the directory of fsys named after it, e.g. postgres/0001_initial_schema.up.sql
+// It must come after WithGorm
+func WithMigrations(fsys fs.FS) ServicesConfig {
+	return func(s *Services) error {
+		sub, err := fs.Sub(fsys, s.db.Dialect().GetName())
+		if err != nil {
+			return err
+		}
+		migrations, err := migrate.Load(sub)
+		if err != nil {
+			return err
+		}
+		s.migrations = migrations
+		return nil
+	}
+}
+
 // For the With...() functions below,
 // it is the closure here that matches ServicesConfig user-defined function
 // which NewDBServices accepts as its parameter(s)
 
-func WithUser(pepper, hmacKey string) ServicesConfig {
+// resetTTL is how long a password reset token stays valid after it is created
+// verifyTTL is how long an email verification link stays valid after it is sent
+func WithUser(pepper, hmacKey string, resetTTL, verifyTTL time.Duration) ServicesConfig {
+	return func(s *Services) error {
+		s.User = NewUserService(s.db, pepper, hmacKey, resetTTL, verifyTTL)
+		return nil
+	}
+}
+
+// sessionTTL is how long a user stays logged in on a device
+func WithSession(hmacKey string, sessionTTL time.Duration) ServicesConfig {
+	return func(s *Services) error {
+		s.Session = NewSessionService(s.db, hmacKey, sessionTTL)
+		return nil
+	}
+}
+
+// WithAttempts sets up the failed login counters
+// When inMemory is false, the counters are kept in the database
+// so that they are shared by every instance of the app
+func WithAttempts(inMemory bool) ServicesConfig {
+	return func(s *Services) error {
+		if inMemory {
+			s.Attempts = NewAttemptService(NewMemoryAttemptStore())
+		} else {
+			s.Attempts = NewAttemptService(NewGormAttemptStore(s.db))
+		}
+		return nil
+	}
+}
+
+func WithAPIToken(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.APIToken = NewAPITokenService(s.db, hmacKey)
+		return nil
+	}
+}
+
+func WithShareLink(pepper, hmacKey string) ServicesConfig {
 	return func(s *Services) error {
-		s.User = NewUserService(s.db, pepper, hmacKey)
+		s.Share = NewShareLinkService(s.db, pepper, hmacKey)
 		return nil
 	}
 }
@@ -82,9 +222,13 @@ func WithGallery() ServicesConfig {
 	}
 }
 
-func WithImage() ServicesConfig {
+// store is where the image files are kept
+// sizes are the derived sizes generated for every uploaded image
+// maxPixels is the largest width×height of an uploaded image, see DefaultMaxImagePixels
+func WithImage(store BlobStore, sizes []ImageSize, maxPixels int, hmacKey string) ServicesConfig {
 	return func(s *Services) error {
-		s.Image = NewImageService()
+		s.blobs = store
+		s.Image = NewImageService(s.db, store, sizes, maxPixels, hmacKey)
 		return nil
 	}
 }
@@ -0,0 +1,158 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// postgresTestEnv holds the connection string of a Postgres database for the tests, e.g.
+// TEST_POSTGRES_URL="host=localhost port=5432 user=postgres dbname=lenslocked_test sslmode=disable" go test ./models/
+// IMPORTANT: every table of that database is dropped, so never point it at a database you want to keep
+// The tests that take a dialect only run against SQLite without it
+const postgresTestEnv = "TEST_POSTGRES_URL"
+
+// testDatabase is a database the model tests run against
+type testDatabase struct {
+	dialect          string
+	connectionstring string
+}
+
+// testDatabases returns the databases the model tests run against:
+// an in-memory SQLite database, and Postgres when postgresTestEnv is set
+func testDatabases() []testDatabase {
+	dbs := []testDatabase{{dialect: "sqlite3", connectionstring: ":memory:"}}
+	if conn := os.Getenv(postgresTestEnv); conn != "" {
+		dbs = append(dbs, testDatabase{dialect: "postgres", connectionstring: conn})
+	}
+	return dbs
+}
+
+// forEachDialect runs fn in a subtest for every database of testDatabases, each time on empty services
+func forEachDialect(t *testing.T, fn func(t *testing.T, s *Services)) {
+	t.Helper()
+	for _, db := range testDatabases() {
+		t.Run(db.dialect, func(t *testing.T) {
+			fn(t, newDialectServices(t, db))
+		})
+	}
+}
+
+// newDialectServices returns the services on db with every migration applied, and the images in a temporary directory
+// Postgres is reset first, since the database is kept between runs
+func newDialectServices(t *testing.T, db testDatabase) *Services {
+	t.Helper()
+	s, err := NewServices(
+		WithGorm(db.dialect, db.connectionstring),
+		WithMigrations(os.DirFS("../migrations")),
+		WithUser("pepper", "hmac-secret-key", time.Hour, time.Hour),
+		WithSession("hmac-secret-key", time.Hour),
+		WithGallery(),
+		WithShareLink("pepper", "hmac-secret-key"),
+		WithAPIToken("hmac-secret-key"),
+		WithAttempts(false),
+		WithImage(NewLocalBlobStore(t.TempDir()), DefaultImageSizes, DefaultMaxImagePixels, "hmac-secret-key"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	if db.dialect == "postgres" {
+		err = s.DestructiveReset()
+	} else {
+		_, err = s.Migrator().Up()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// createTestUser saves a user with the email and a valid password, and fails the test otherwise
+func createTestUser(t *testing.T, s *Services, email string) *User {
+	t.Helper()
+	user := User{Name: "Jon", Email: email, Password: "correct horse battery staple"}
+	if err := s.User.Create(&user); err != nil {
+		t.Fatal(err)
+	}
+	return &user
+}
+
+func TestMigrationsRollBack(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, s *Services) {
+		if err := s.DestructiveReset(); err != nil {
+			t.Fatal(err)
+		}
+
+		pending, err := s.Migrator().Pending()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) != 0 {
+			t.Errorf("%d migrations are still pending after DestructiveReset", len(pending))
+		}
+	})
+}
+
+// countingBlobStore counts the calls that Ready makes to the store, and fails the writes while failPut is set
+type countingBlobStore struct {
+	BlobStore
+	puts, deletes, opens int
+	failPut              bool
+}
+
+func (cs *countingBlobStore) Put(key string, r io.Reader) error {
+	cs.puts++
+	if cs.failPut {
+		return errors.New("read-only file system")
+	}
+	return cs.BlobStore.Put(key, r)
+}
+
+func (cs *countingBlobStore) Delete(key string) error {
+	cs.deletes++
+	return cs.BlobStore.Delete(key)
+}
+
+func (cs *countingBlobStore) Open(key string) (io.ReadSeekCloser, *BlobInfo, error) {
+	cs.opens++
+	return cs.BlobStore.Open(key)
+}
+
+// TestReady checks that the image store is only written to until a write has worked,
+// and after that is only read, on every probe
+func TestReady(t *testing.T) {
+	store := &countingBlobStore{BlobStore: NewLocalBlobStore(t.TempDir()), failPut: true}
+	s, err := NewServices(
+		WithGorm("sqlite3", ":memory:"),
+		WithImage(store, DefaultImageSizes, DefaultMaxImagePixels, "hmac-secret-key"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if err := s.Ready(ctx); err == nil {
+			t.Fatal("Ready() = nil while the image store cannot be written to")
+		}
+	}
+	if store.puts != 2 {
+		t.Errorf("Ready() wrote %d times while the writes failed, want every probe to try again", store.puts)
+	}
+
+	store.failPut = false
+	for i := 0; i < 3; i++ {
+		if err := s.Ready(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if store.puts != 3 || store.deletes != 1 || store.opens != 2 {
+		t.Errorf("Ready() made %d puts, %d deletes and %d opens; want 3, 1 and 2", store.puts, store.deletes, store.opens)
+	}
+}
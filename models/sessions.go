@@ -0,0 +1,245 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/hash"
+	"lenslocked.com/rand"
+)
+
+// Session is a single logged in device of a user
+// Each login creates a new session, so logging in on a second device
+// no longer signs the first one out
+// Only the HMAC of the token is stored, the raw token lives in the user's cookie
+type Session struct {
+	ID         uint   `gorm:"primary_key"`
+	UserID     uint   `gorm:"not null;index"`
+	Token      string `gorm:"-" json:"-"`
+	TokenHash  string `gorm:"not null;unique_index" json:"-"`
+	UserAgent  string
+	IP         string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time `gorm:"not null"`
+}
+
+// SessionDB interface exposes the methods that engages the sessions table
+type SessionDB interface {
+	ByToken(token string) (*Session, error)
+	ByUserID(userID uint) ([]Session, error)
+	Create(session *Session) error
+	Update(session *Session) error
+	Delete(id uint) error
+	DeleteByUserID(userID uint) error
+}
+
+// SessionService interface implements SessionDB
+type SessionService interface {
+	SessionDB
+}
+
+type sessionService struct {
+	SessionDB
+}
+
+// sessionValidator hashes the session tokens and enforces the expiry
+type sessionValidator struct {
+	SessionDB
+	hmac hash.HMAC
+	ttl  time.Duration
+}
+
+// sessionGorm implement methods found in SessionDB
+type sessionGorm struct {
+	db *gorm.DB
+}
+
+var _ SessionDB = &sessionGorm{}
+var _ SessionDB = &sessionValidator{}
+var _ SessionService = &sessionService{}
+
+// NewSessionService returns the SessionService
+// ttl is how long a session stays valid after the user logs in
+func NewSessionService(db *gorm.DB, hmacKey string, ttl time.Duration) SessionService {
+	return &sessionService{
+		&sessionValidator{
+			SessionDB: &sessionGorm{db},
+			hmac:      hash.NewHMAC(hmacKey),
+			ttl:       ttl,
+		},
+	}
+}
+
+// ************** THIS SECTION CONTAINS THE SESSIONGORM METHODS **************
+
+// ByToken looks up a session with the given token hash
+// This method expects the token to already be hashed
+func (sg *sessionGorm) ByToken(tokenHash string) (*Session, error) {
+	var session Session
+	err := first(sg.db.Where("token_hash=?", tokenHash), &session)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// ByUserID returns the sessions of a user that have not expired, most recently used first
+// Expired sessions are only removed once their token is used, so they are skipped here
+func (sg *sessionGorm) ByUserID(userID uint) ([]Session, error) {
+	var sessions []Session
+	err := sg.db.Where("user_id=? AND expires_at > ?", userID, time.Now()).Order("last_seen_at desc").Find(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (sg *sessionGorm) Create(session *Session) error {
+	return sg.db.Create(session).Error
+}
+
+func (sg *sessionGorm) Update(session *Session) error {
+	return sg.db.Save(session).Error
+}
+
+func (sg *sessionGorm) Delete(id uint) error {
+	return sg.db.Where("id=?", id).Delete(&Session{}).Error
+}
+
+// DeleteByUserID signs the user out on every device
+func (sg *sessionGorm) DeleteByUserID(userID uint) error {
+	return sg.db.Where("user_id=?", userID).Delete(&Session{}).Error
+}
+
+// ************** THIS SECTION CONTAINS THE VALIDATION CHAINING METHODS FOR SESSIONS **************
+
+type sessionValidateFunc func(*Session) error
+
+func runSessionValFuncs(session *Session, fns ...sessionValidateFunc) error {
+	for _, fn := range fns {
+		if err := fn(session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ByToken hashes the raw token before the lookup
+// Expired sessions are removed and reported as ErrNotFound
+func (sv *sessionValidator) ByToken(token string) (*Session, error) {
+	session := Session{Token: token}
+	if err := runSessionValFuncs(&session, sv.hmacToken); err != nil {
+		return nil, err
+	}
+
+	found, err := sv.SessionDB.ByToken(session.TokenHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(found.ExpiresAt) {
+		if err := sv.SessionDB.Delete(found.ID); err != nil {
+			return nil, err
+		}
+		return nil, ErrNotFound
+	}
+
+	return found, nil
+}
+
+// Create generates the session token, sets the timestamps and hashes the token
+func (sv *sessionValidator) Create(session *Session) error {
+	if err := runSessionValFuncs(session,
+		sv.userIDRequired,
+		sv.setTokenIfUnset,
+		sv.tokenMinBytes,
+		sv.hmacToken,
+		sv.setTimestamps,
+	); err != nil {
+		return err
+	}
+	return sv.SessionDB.Create(session)
+}
+
+func (sv *sessionValidator) Update(session *Session) error {
+	if err := runSessionValFuncs(session,
+		sv.idBeGreaterThan(0),
+		sv.userIDRequired,
+	); err != nil {
+		return err
+	}
+	return sv.SessionDB.Update(session)
+}
+
+// Delete will remove a single session
+// IMPORTANT: Please make sure a value of > 0 is supplied, otherwise the entire table will be wiped out
+func (sv *sessionValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrInvalidID
+	}
+	return sv.SessionDB.Delete(id)
+}
+
+func (sv *sessionValidator) DeleteByUserID(userID uint) error {
+	if userID <= 0 {
+		return ErruserIDRequired
+	}
+	return sv.SessionDB.DeleteByUserID(userID)
+}
+
+func (sv *sessionValidator) userIDRequired(session *Session) error {
+	if session.UserID <= 0 {
+		return ErruserIDRequired
+	}
+	return nil
+}
+
+func (sv *sessionValidator) idBeGreaterThan(n uint) sessionValidateFunc {
+	return sessionValidateFunc(func(session *Session) error {
+		if session.ID <= n {
+			return ErrInvalidID
+		}
+		return nil
+	})
+}
+
+// setTokenIfUnset ensures that a session token is created
+func (sv *sessionValidator) setTokenIfUnset(session *Session) error {
+	if session.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	session.Token = token
+	return nil
+}
+
+// tokenMinBytes ensures that the session token is at least 32 bytes
+func (sv *sessionValidator) tokenMinBytes(session *Session) error {
+	n, err := rand.NBytes(session.Token)
+	if err != nil {
+		return err
+	}
+	if n < 32 {
+		return ErrBytesTooShort
+	}
+	return nil
+}
+
+func (sv *sessionValidator) hmacToken(session *Session) error {
+	if session.Token == "" {
+		return nil
+	}
+	session.TokenHash = sv.hmac.Hash(session.Token)
+	return nil
+}
+
+func (sv *sessionValidator) setTimestamps(session *Session) error {
+	now := time.Now()
+	session.LastSeenAt = now
+	session.ExpiresAt = now.Add(sv.ttl)
+	return nil
+}
@@ -0,0 +1,65 @@
+package models
+
+import "testing"
+
+func TestSessionByToken(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, s *Services) {
+		user := createTestUser(t, s, "jon@example.com")
+
+		session := Session{UserID: user.ID}
+		if err := s.Session.Create(&session); err != nil {
+			t.Fatal(err)
+		}
+		found, err := s.Session.ByToken(session.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found.ID != session.ID || found.UserID != user.ID {
+			t.Errorf("ByToken() = session %d of user %d, want %d of %d", found.ID, found.UserID, session.ID, user.ID)
+		}
+
+		if _, err := s.Session.ByToken("not-a-session-token"); err != ErrNotFound {
+			t.Errorf("ByToken() of an unknown token err = %v, want ErrNotFound", err)
+		}
+
+		found.ExpiresAt = found.LastSeenAt.Add(-1)
+		if err := s.Session.Update(found); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Session.ByToken(session.Token); err != ErrNotFound {
+			t.Errorf("ByToken() of an expired session err = %v, want ErrNotFound", err)
+		}
+		if sessions, err := s.Session.ByUserID(user.ID); err != nil || len(sessions) != 0 {
+			t.Errorf("the expired session was not removed: %d sessions, err = %v", len(sessions), err)
+		}
+	})
+}
+
+func TestSessionByUserID(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, s *Services) {
+		user := createTestUser(t, s, "jon@example.com")
+		other := createTestUser(t, s, "arya@example.com")
+
+		var sessions [3]Session
+		for i, userID := range []uint{user.ID, user.ID, other.ID} {
+			sessions[i] = Session{UserID: userID}
+			if err := s.Session.Create(&sessions[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// the second session expires without its token being used again
+		sessions[1].ExpiresAt = sessions[1].LastSeenAt.Add(-1)
+		if err := s.Session.Update(&sessions[1]); err != nil {
+			t.Fatal(err)
+		}
+
+		found, err := s.Session.ByUserID(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != 1 || found[0].ID != sessions[0].ID {
+			t.Errorf("ByUserID() = %d sessions, want only the session %d that has not expired", len(found), sessions[0].ID)
+		}
+	})
+}
@@ -0,0 +1,356 @@
+package models
+
+import (
+	"crypto/subtle"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/bcrypt"
+	"lenslocked.com/hash"
+	"lenslocked.com/rand"
+)
+
+// shareLinkTokenBytes is the number of random bytes in a share link token
+const shareLinkTokenBytes = 24
+
+// shareUnlockTTL is how long a visitor stays unlocked after entering a link's password
+const shareUnlockTTL = 24 * time.Hour
+
+// shareImagesTTL is how long a visitor of a share link may fetch the gallery's images
+// after loading the gallery page
+const shareImagesTTL = time.Hour
+
+// ShareLink lets anyone who has the link see a gallery without an account,
+// whatever the gallery's visibility is
+// Only the HMAC of the token is stored, so the link is shown to the owner once when it is created
+type ShareLink struct {
+	ID        uint   `gorm:"primary_key"`
+	GalleryID uint   `gorm:"not null;index"`
+	Label     string `gorm:"not null"`
+	Token     string `gorm:"-" json:",omitempty"`
+	TokenHash string `gorm:"not null;unique_index" json:"-"`
+
+	// ExpiresAt is nil for links that do not expire
+	ExpiresAt *time.Time
+
+	// MaxViews is the number of times the gallery may be viewed, 0 for no limit
+	MaxViews int `gorm:"not null"`
+	Views    int `gorm:"not null"`
+
+	// Password is only set when the link is created; PasswordHash is empty for links without a password
+	Password     string `gorm:"-" json:"-"`
+	PasswordHash string `gorm:"not null" json:"-"`
+
+	CreatedAt time.Time
+}
+
+// Expired reports whether the link can no longer be used, either because it is
+// past its expiry or because the gallery has been viewed MaxViews times
+func (sl *ShareLink) Expired() bool {
+	if sl.ExpiresAt != nil && time.Now().After(*sl.ExpiresAt) {
+		return true
+	}
+	return sl.MaxViews > 0 && sl.Views >= sl.MaxViews
+}
+
+func (sl *ShareLink) HasPassword() bool {
+	return sl.PasswordHash != ""
+}
+
+// ShareLinkDB interface exposes the methods that engages the share_links table
+type ShareLinkDB interface {
+	ByID(id uint) (*ShareLink, error)
+	ByToken(token string) (*ShareLink, error)
+	ByGalleryID(galleryID uint) ([]ShareLink, error)
+	Create(link *ShareLink) error
+	Delete(id uint) error
+	DeleteByGalleryID(galleryID uint) error
+
+	// AddView counts a view of the link, unless that would go over MaxViews
+	// ErrShareLinkExpired is returned when there are no views left
+	AddView(link *ShareLink) error
+}
+
+// ShareLinkService interface implements ShareLinkDB
+type ShareLinkService interface {
+	ShareLinkDB
+
+	// CheckPassword returns ErrInvalidPassword when the password does not match the link's
+	CheckPassword(link *ShareLink, password string) error
+
+	// UnlockToken is kept by the visitor (in a cookie) once they have entered the link's password
+	UnlockToken(link *ShareLink) string
+	Unlocked(link *ShareLink, token string) bool
+
+	// ImagesToken is given to the visitor of a share link so that they can fetch the gallery's images,
+	// and ImagesAllowed checks it; it stops working as soon as the link is revoked or expires
+	ImagesToken(link *ShareLink) string
+	ImagesAllowed(galleryID uint, token string) bool
+}
+
+type shareLinkService struct {
+	ShareLinkDB
+	signer *tokenSigner
+	pepper string
+}
+
+// shareLinkValidator generates and hashes the tokens and hashes the passwords
+type shareLinkValidator struct {
+	ShareLinkDB
+	hmac   hash.HMAC
+	pepper string
+}
+
+// shareLinkGorm implement methods found in ShareLinkDB
+type shareLinkGorm struct {
+	db *gorm.DB
+}
+
+var _ ShareLinkDB = &shareLinkGorm{}
+var _ ShareLinkDB = &shareLinkValidator{}
+var _ ShareLinkService = &shareLinkService{}
+
+func NewShareLinkService(db *gorm.DB, pepper, hmacKey string) ShareLinkService {
+	hmac := hash.NewHMAC(hmacKey)
+	return &shareLinkService{
+		ShareLinkDB: &shareLinkValidator{
+			ShareLinkDB: &shareLinkGorm{db},
+			hmac:        hmac,
+			pepper:      pepper,
+		},
+		signer: newTokenSigner(hmac),
+		pepper: pepper,
+	}
+}
+
+// ************** THIS SECTION CONTAINS THE SHARELINKSERVICE METHODS **************
+
+func (ss *shareLinkService) CheckPassword(link *ShareLink, password string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(link.PasswordHash), []byte(password+ss.pepper))
+	if err != nil {
+		return ErrInvalidPassword
+	}
+	return nil
+}
+
+// The unlock token is tied to the link and to its password, through the HMAC of the password hash
+func (ss *shareLinkService) UnlockToken(link *ShareLink) string {
+	return ss.signer.Sign("share_unlock", shareUnlockTTL,
+		strconv.FormatUint(uint64(link.ID), 10),
+		ss.signer.hmac.Hash(link.PasswordHash),
+	)
+}
+
+func (ss *shareLinkService) Unlocked(link *ShareLink, token string) bool {
+	fields, err := ss.signer.Parse("share_unlock", token)
+	if err != nil || len(fields) != 2 {
+		return false
+	}
+	return fields[0] == strconv.FormatUint(uint64(link.ID), 10) &&
+		subtle.ConstantTimeCompare([]byte(fields[1]), []byte(ss.signer.hmac.Hash(link.PasswordHash))) == 1
+}
+
+func (ss *shareLinkService) ImagesToken(link *ShareLink) string {
+	return ss.signer.Sign("share_images", shareImagesTTL,
+		strconv.FormatUint(uint64(link.ID), 10),
+		strconv.FormatUint(uint64(link.GalleryID), 10),
+	)
+}
+
+// ImagesAllowed does not look at the views left, since the images of the last allowed view
+// are fetched after that view has been counted
+func (ss *shareLinkService) ImagesAllowed(galleryID uint, token string) bool {
+	fields, err := ss.signer.Parse("share_images", token)
+	if err != nil || len(fields) != 2 {
+		return false
+	}
+	if fields[1] != strconv.FormatUint(uint64(galleryID), 10) {
+		return false
+	}
+
+	id, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return false
+	}
+	link, err := ss.ByID(uint(id))
+	if err != nil {
+		return false
+	}
+	return link.GalleryID == galleryID && (link.ExpiresAt == nil || time.Now().Before(*link.ExpiresAt))
+}
+
+// ************** THIS SECTION CONTAINS THE SHARELINKGORM METHODS **************
+
+func (sg *shareLinkGorm) ByID(id uint) (*ShareLink, error) {
+	var link ShareLink
+	err := first(sg.db.Where("id=?", id), &link)
+	if err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+// ByToken looks up a link with the given token hash
+// This method expects the token to already be hashed
+func (sg *shareLinkGorm) ByToken(tokenHash string) (*ShareLink, error) {
+	var link ShareLink
+	err := first(sg.db.Where("token_hash=?", tokenHash), &link)
+	if err != nil {
+		return nil, err
+	}
+	return &link, nil
+}
+
+// ByGalleryID returns the links of a gallery, newest first
+func (sg *shareLinkGorm) ByGalleryID(galleryID uint) ([]ShareLink, error) {
+	var links []ShareLink
+	err := sg.db.Where("gallery_id=?", galleryID).Order("created_at desc").Find(&links).Error
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func (sg *shareLinkGorm) Create(link *ShareLink) error {
+	return sg.db.Create(link).Error
+}
+
+func (sg *shareLinkGorm) Delete(id uint) error {
+	return sg.db.Where("id=?", id).Delete(&ShareLink{}).Error
+}
+
+func (sg *shareLinkGorm) DeleteByGalleryID(galleryID uint) error {
+	return sg.db.Where("gallery_id=?", galleryID).Delete(&ShareLink{}).Error
+}
+
+// AddView increments the counter in a single statement,
+// so that two visitors cannot both use the last view
+func (sg *shareLinkGorm) AddView(link *ShareLink) error {
+	db := sg.db.Model(&ShareLink{}).
+		Where("id=? AND (max_views=0 OR views<max_views)", link.ID).
+		UpdateColumn("views", gorm.Expr("views + 1"))
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrShareLinkExpired
+	}
+	link.Views++
+	return nil
+}
+
+// ************** THIS SECTION CONTAINS THE VALIDATION CHAINING METHODS FOR SHARE LINKS **************
+
+type shareLinkValidateFunc func(*ShareLink) error
+
+func runShareLinkValFuncs(link *ShareLink, fns ...shareLinkValidateFunc) error {
+	for _, fn := range fns {
+		if err := fn(link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ByToken hashes the raw token before the lookup
+// Links that have expired are reported as ErrShareLinkExpired
+func (sv *shareLinkValidator) ByToken(token string) (*ShareLink, error) {
+	link := ShareLink{Token: token}
+	if err := runShareLinkValFuncs(&link, sv.hmacToken); err != nil {
+		return nil, err
+	}
+
+	found, err := sv.ShareLinkDB.ByToken(link.TokenHash)
+	if err != nil {
+		return nil, err
+	}
+	if found.Expired() {
+		return nil, ErrShareLinkExpired
+	}
+	return found, nil
+}
+
+// Create generates the token, hashes it along with the password,
+// and returns the link with its raw Token set
+func (sv *shareLinkValidator) Create(link *ShareLink) error {
+	if err := runShareLinkValFuncs(link,
+		sv.galleryIDRequired,
+		sv.maxViewsNotNegative,
+		sv.expiresInFuture,
+		sv.setToken,
+		sv.hmacToken,
+		sv.bcryptPassword,
+	); err != nil {
+		return err
+	}
+	return sv.ShareLinkDB.Create(link)
+}
+
+// Delete will remove a single link
+// IMPORTANT: Please make sure a value of > 0 is supplied, otherwise the entire table will be wiped out
+func (sv *shareLinkValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrInvalidID
+	}
+	return sv.ShareLinkDB.Delete(id)
+}
+
+func (sv *shareLinkValidator) DeleteByGalleryID(galleryID uint) error {
+	if galleryID <= 0 {
+		return ErrInvalidID
+	}
+	return sv.ShareLinkDB.DeleteByGalleryID(galleryID)
+}
+
+func (sv *shareLinkValidator) galleryIDRequired(link *ShareLink) error {
+	if link.GalleryID <= 0 {
+		return ErrInvalidID
+	}
+	return nil
+}
+
+func (sv *shareLinkValidator) maxViewsNotNegative(link *ShareLink) error {
+	if link.MaxViews < 0 {
+		return ErrMaxViewsInvalid
+	}
+	return nil
+}
+
+func (sv *shareLinkValidator) expiresInFuture(link *ShareLink) error {
+	if link.ExpiresAt != nil && !link.ExpiresAt.After(time.Now()) {
+		return ErrExpiryInPast
+	}
+	return nil
+}
+
+func (sv *shareLinkValidator) setToken(link *ShareLink) error {
+	token, err := rand.String(shareLinkTokenBytes)
+	if err != nil {
+		return err
+	}
+	link.Token = token
+	return nil
+}
+
+func (sv *shareLinkValidator) hmacToken(link *ShareLink) error {
+	if link.Token == "" {
+		return nil
+	}
+	link.TokenHash = sv.hmac.Hash(link.Token)
+	return nil
+}
+
+// bcryptPassword only hashes the password IF one was given, since passwords are optional
+func (sv *shareLinkValidator) bcryptPassword(link *ShareLink) error {
+	if link.Password == "" {
+		return nil
+	}
+	hashBytes, err := bcrypt.GenerateFromPassword([]byte(link.Password+sv.pepper), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	link.PasswordHash = string(hashBytes)
+	link.Password = ""
+	return nil
+}
@@ -0,0 +1,66 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShareLinkCreate(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	tests := []struct {
+		name string
+		link ShareLink
+		err  error
+	}{
+		{"valid", ShareLink{GalleryID: 1, Label: "Family"}, nil},
+		{"with a password and an expiry", ShareLink{GalleryID: 1, Password: "secret", ExpiresAt: &future}, nil},
+		{"gallery required", ShareLink{Label: "Family"}, ErrInvalidID},
+		{"max views negative", ShareLink{GalleryID: 1, MaxViews: -1}, ErrMaxViewsInvalid},
+		{"expiry in the past", ShareLink{GalleryID: 1, ExpiresAt: &past}, ErrExpiryInPast},
+	}
+
+	forEachDialect(t, func(t *testing.T, s *Services) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				link := tt.link
+				if err := s.Share.Create(&link); err != tt.err {
+					t.Fatalf("Create() err = %v, want %v", err, tt.err)
+				}
+				if tt.err != nil {
+					return
+				}
+				found, err := s.Share.ByToken(link.Token)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if found.ID != link.ID || found.HasPassword() != (tt.link.Password != "") {
+					t.Errorf("ByToken() = link %d with a password %t, want %d", found.ID, found.HasPassword(), link.ID)
+				}
+				if tt.link.Password != "" {
+					if err := s.Share.CheckPassword(found, tt.link.Password); err != nil {
+						t.Errorf("CheckPassword() = %v", err)
+					}
+				}
+			})
+		}
+	})
+}
+
+func TestShareLinkAddView(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, s *Services) {
+		link := ShareLink{GalleryID: 1, MaxViews: 2}
+		if err := s.Share.Create(&link); err != nil {
+			t.Fatal(err)
+		}
+
+		for view, want := range []error{nil, nil, ErrShareLinkExpired} {
+			if err := s.Share.AddView(&link); err != want {
+				t.Fatalf("AddView() number %d err = %v, want %v", view+1, err, want)
+			}
+		}
+		if _, err := s.Share.ByToken(link.Token); err != ErrShareLinkExpired {
+			t.Errorf("ByToken() of a link without views left err = %v, want ErrShareLinkExpired", err)
+		}
+	})
+}
@@ -0,0 +1,67 @@
+package models
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+
+	"lenslocked.com/hash"
+)
+
+// tokenSigner creates and checks signed tokens that are not stored anywhere
+// Instead, the token carries its own fields and an expiry time, and is signed
+// with HMAC so that it cannot be tampered with
+//
+// The purpose is part of the signed payload, so a token issued for one purpose
+// (e.g. email verification) cannot be used for another (e.g. a pending 2FA login)
+type tokenSigner struct {
+	hmac hash.HMAC
+}
+
+func newTokenSigner(hmac hash.HMAC) *tokenSigner {
+	return &tokenSigner{
+		hmac: hmac,
+	}
+}
+
+// Sign returns a token for the fields that expires after ttl
+// The fields must not contain "|"
+func (ts *tokenSigner) Sign(purpose string, ttl time.Duration, fields ...string) string {
+	expires := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	payload := strings.Join(append([]string{purpose, expires}, fields...), "|")
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	return encoded + "." + ts.hmac.Hash(payload)
+}
+
+// Parse checks the token's signature, purpose and expiry and returns the signed fields
+// Any problem with the token returns ErrTokenInvalid
+func (ts *tokenSigner) Parse(purpose, token string) ([]string, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return nil, ErrTokenInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+
+	sig := ts.hmac.Hash(string(payload))
+	if subtle.ConstantTimeCompare([]byte(sig), []byte(parts[1])) != 1 {
+		return nil, ErrTokenInvalid
+	}
+
+	fields := strings.Split(string(payload), "|")
+	if len(fields) < 2 || fields[0] != purpose {
+		return nil, ErrTokenInvalid
+	}
+
+	expires, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return nil, ErrTokenInvalid
+	}
+
+	return fields[2:], nil
+}
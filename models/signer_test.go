@@ -0,0 +1,58 @@
+package models
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"lenslocked.com/hash"
+)
+
+// Run with -race: the signer is shared by every request
+func TestTokenSignerConcurrent(t *testing.T) {
+	ts := newTokenSigner(hash.NewHMAC("hmac-secret-key"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := strconv.Itoa(i)
+			token := ts.Sign("verify", time.Hour, id)
+			fields, err := ts.Parse("verify", token)
+			if err != nil {
+				t.Errorf("Parse(%s): %v", token, err)
+				return
+			}
+			if len(fields) != 1 || fields[0] != id {
+				t.Errorf("Parse() = %q, want [%s]", fields, id)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestTokenSignerParse(t *testing.T) {
+	ts := newTokenSigner(hash.NewHMAC("hmac-secret-key"))
+	other := newTokenSigner(hash.NewHMAC("another-secret-key"))
+
+	tests := []struct {
+		name    string
+		purpose string
+		token   string
+	}{
+		{"wrong purpose", "reset", ts.Sign("verify", time.Hour, "1")},
+		{"expired", "verify", ts.Sign("verify", -time.Minute, "1")},
+		{"other key", "verify", other.Sign("verify", time.Hour, "1")},
+		{"tampered", "verify", ts.Sign("verify", time.Hour, "1") + "x"},
+		{"garbage", "verify", "not-a-token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ts.Parse(tt.purpose, tt.token); err != ErrTokenInvalid {
+				t.Errorf("Parse() err = %v, want ErrTokenInvalid", err)
+			}
+		})
+	}
+}
@@ -2,12 +2,14 @@ package models
 
 import (
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 	"golang.org/x/crypto/bcrypt"
 	"lenslocked.com/hash"
-	"lenslocked.com/rand"
+	"lenslocked.com/totp"
 
 	"github.com/jinzhu/gorm"
 )
@@ -29,7 +31,6 @@ type UserDB interface {
 	// Methods for querying single user
 	ByID(id uint) (*User, error)
 	ByEmail(email string) (*User, error)
-	ByRemember(token string) (*User, error)
 
 	// Methods for altering data
 	Create(user *User) error
@@ -41,6 +42,44 @@ type UserDB interface {
 
 type UserService interface {
 	Authenticate(email, password string) (*User, error)
+
+	// InitiateReset will start the forgot password process by creating a
+	// reset token for the user found with the provided email address
+	// The raw token is returned so that it can be emailed to the user
+	InitiateReset(email string) (string, error)
+
+	// CompleteReset will look up the reset with the provided token and
+	// update the user's password if the token is valid and has not expired
+	CompleteReset(token, newPw string) (*User, error)
+
+	// VerificationToken returns a signed, expiring token that
+	// confirms the user's email address when passed to Verify
+	// Every new token makes the ones issued before it invalid
+	VerificationToken(user *User) (string, error)
+
+	// Verify checks the token and marks the user's email address as verified
+	Verify(token string) (*User, error)
+
+	// EnrollTOTP creates a new TOTP secret for the user and returns the
+	// provisioning URI; two-factor authentication is not enabled until EnableTOTP
+	EnrollTOTP(user *User) (string, error)
+
+	// EnableTOTP confirms the enrollment with a code from the authenticator app
+	// and returns the recovery codes, which are only ever available here
+	EnableTOTP(user *User, code string) ([]string, error)
+
+	// DisableTOTP turns two-factor authentication off after checking a code
+	DisableTOTP(user *User, code string) error
+
+	// ValidateTOTP checks a code from the authenticator app, or a recovery code
+	ValidateTOTP(user *User, code string) error
+
+	// PendingTOTPToken is given to a user that has entered their password
+	// but still has to provide their second factor
+	PendingTOTPToken(user *User) string
+
+	// ByPendingTOTPToken returns the user that the pending token was issued for
+	ByPendingTOTPToken(token string) (*User, error)
 	UserDB
 }
 
@@ -48,16 +87,20 @@ type UserService interface {
 
 type userService struct {
 	UserDB
-	pepper string
+	db             *gorm.DB // for CompleteReset's transaction
+	pwResetDB      PwResetDB
+	recoveryCodeDB recoveryCodeDB
+	verifier       *emailVerifier
+	signer         *tokenSigner
+	pepper         string
 }
 
 var _ UserService = &userService{} // this check ensures that userService implements UserServce interface successfully
 
-// UserValidator now has the hmac property to create the remember token
+// userValidator normalizes and validates a user before it reaches the database
 
 type userValidator struct {
 	UserDB
-	hmac       hash.HMAC
 	emailRegex *regexp.Regexp
 	pepper     string
 }
@@ -66,31 +109,14 @@ var _ UserDB = &userValidator{} // this check ensures that userValidator impleme
 
 // Create a newUserValidator that wraps the userValidator
 
-func newUserValidator(udb UserDB, hmac hash.HMAC, pepper string) *userValidator {
+func newUserValidator(udb UserDB, pepper string) *userValidator {
 	return &userValidator{
-		hmac:       hmac,
 		UserDB:     udb,
 		emailRegex: regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`), // the variable is used to match email addresses; it's basic but good enough for now
 		pepper:     pepper,
 	}
 }
 
-// ByRemember will have the remember token and then call
-// ByRemember on the subsequent UserDB layer.
-
-func (uv *userValidator) ByRemember(token string) (*User, error) {
-
-	user := User{
-		Remember: token,
-	}
-
-	if err := runUserValFuncs(&user, uv.hmacRemember); err != nil {
-		return nil, err
-	}
-
-	return uv.UserDB.ByRemember(user.RememberHash)
-}
-
 // Byemail will normailize the email address before calling ByEmail on the UserDB field
 func (uv *userValidator) ByEmail(email string) (*User, error) {
 	user := User{
@@ -103,7 +129,6 @@ func (uv *userValidator) ByEmail(email string) (*User, error) {
 }
 
 // Create will hash the password
-// Create will also generate a remember token if one isn't available
 
 func (uv *userValidator) Create(user *User) error {
 
@@ -112,10 +137,6 @@ func (uv *userValidator) Create(user *User) error {
 		uv.passwordMinLength,
 		uv.bcryptPassword,
 		uv.passwordHashRequired,
-		uv.setRememberIfUnset,
-		uv.rememberMinBytes,
-		uv.hmacRemember,
-		uv.rememberHashRequired,
 		uv.normalizeEmail,
 		uv.requireEmail,
 		uv.emailFormat,
@@ -126,56 +147,6 @@ func (uv *userValidator) Create(user *User) error {
 	return uv.UserDB.Create(user)
 }
 
-// rememberHashRequired ensures that that the remember token that is hash is stored in the user's RememberHash
-
-func (uv *userValidator) rememberHashRequired(user *User) error {
-	if user.RememberHash == "" {
-		return ErrRememberRequired
-	}
-	return nil
-}
-
-// rememberMinBytes ensures that the remembertokens is 32 bytes
-func (uv *userValidator) rememberMinBytes(user *User) error {
-	if user.Remember == "" {
-		return nil
-	}
-	n, err := rand.NBytes(user.Remember)
-
-	if err != nil {
-		return err
-	}
-
-	if n < 32 {
-		return ErrBytesTooShort
-	}
-
-	return nil
-}
-
-// hmacRemember hashes the remember token
-func (uv *userValidator) hmacRemember(user *User) error {
-	if user.Remember == "" {
-		return nil
-	}
-
-	user.RememberHash = uv.hmac.Hash(user.Remember)
-	return nil
-}
-
-// setRememberIfUnset ensures that a remember token is created
-func (uv *userValidator) setRememberIfUnset(user *User) error {
-	if user.Remember != "" {
-		return nil
-	}
-	rememberToken, err := rand.RememberToken()
-	if err != nil {
-		return err
-	}
-	user.Remember = rememberToken
-	return nil
-}
-
 // idBeGreaterThan ensures that the id to be deleted is greater than zero
 // To make the function dynamic, return the user-defined function userValidateFunc to process the value
 
@@ -304,7 +275,7 @@ func (uv *userValidator) passwordHashRequired(user *User) error {
 	return nil
 }
 
-// Update will check if the user.Remember is provided and hash its value
+// Update will hash the password if a new one is provided
 
 func (uv *userValidator) Update(user *User) error {
 	if err := runUserValFuncs(user,
@@ -312,9 +283,6 @@ func (uv *userValidator) Update(user *User) error {
 		uv.passwordMinLength,
 		uv.bcryptPassword,
 		uv.passwordHashRequired,
-		uv.rememberMinBytes,
-		uv.hmacRemember,
-		uv.rememberHashRequired,
 		uv.normalizeEmail,
 		uv.requireEmail,
 		uv.emailFormat,
@@ -344,7 +312,7 @@ type userGorm struct {
 var _ UserDB = &userGorm{} // this check ensures that userGorm does implement userDB interface successfully
 
 // User is a struct used to model after the User table in lenslocked_dev database
-// This shall be done via db.AutoMigrate (&User{}) to be created in DestructiveReset()
+// The table is created by the schema migrations in the migrations directory
 // with backfils created: id, created_at, updated_at, deleted_at
 
 // The gorm.Model object will need to be added so that the backfills are created
@@ -353,10 +321,34 @@ type User struct {
 	Name         string
 	Age          uint
 	Email        string `gorm:"not null;unique_index"`
-	Password     string `gorm:"-"` //the hypen means that the password will not be stored in the DB
-	PasswordHash string `gorm:"not null"`
-	Remember     string `gorm:"-"`
-	RememberHash string `gorm:"not null;unique_index"`
+	Password     string `gorm:"-" json:"-"` //the hypen means that the password will not be stored in the DB
+	PasswordHash string `gorm:"not null" json:"-"`
+
+	// EmailVerifiedAt is nil until the user follows the link in the verification email
+	EmailVerifiedAt *time.Time
+
+	// VerifyVersion is signed into the verification links and goes up with every link sent,
+	// so that only the most recent link works
+	VerifyVersion int `gorm:"not null" json:"-"`
+
+	// TOTPSecret is set when the user starts enrolling in two-factor authentication
+	// but it is only used to log in once TOTPEnabledAt is set
+	TOTPSecret    string `json:"-"`
+	TOTPEnabledAt *time.Time
+
+	// TOTPLastStep is the time step of the last accepted code
+	// so that the same code cannot be used twice
+	TOTPLastStep int64 `json:"-"`
+}
+
+// TwoFactorEnabled reports whether the user has to provide a code when logging in
+func (u *User) TwoFactorEnabled() bool {
+	return u.TOTPEnabledAt != nil
+}
+
+// Verified reports whether the user has confirmed their email address
+func (u *User) Verified() bool {
+	return u.EmailVerifiedAt != nil
 }
 
 // Create the variables that represents the error values returned from the database
@@ -366,16 +358,24 @@ type User struct {
 // NOTE: Now, NewuserService returns the UserService interface instead
 // In doing so, only the methods such as Authenticate and those from UserDB are avialable
 
-func NewUserService(db *gorm.DB, pepper, hmacKey string) UserService {
+func NewUserService(db *gorm.DB, pepper, hmacKey string, resetTTL, verifyTTL time.Duration) UserService {
 
 	ug := &userGorm{db}
 
+	uv := newUserValidator(ug, pepper)
+
 	hmac := hash.NewHMAC(hmacKey)
-	uv := newUserValidator(ug, hmac, pepper)
+	signer := newTokenSigner(hmac)
+	pwrv := newPwResetValidator(&pwResetGorm{db}, hmac, resetTTL)
 
 	return &userService{
-		UserDB: uv,
-		pepper: pepper,
+		UserDB:         uv,
+		db:             db,
+		pwResetDB:      pwrv,
+		recoveryCodeDB: &recoveryCodeGorm{db, hmac},
+		verifier:       newEmailVerifier(signer, verifyTTL),
+		signer:         signer,
+		pepper:         pepper,
 	}
 }
 
@@ -440,21 +440,6 @@ func (ug *userGorm) ByEmail(email string) (*User, error) {
 	return &user, err
 }
 
-// ByRemember looks up a user with the given remember token
-// and returns to the user. This method expects the token tp already be hashed
-
-func (ug *userGorm) ByRemember(rememberHash string) (*User, error) {
-	var user User
-	db := ug.db.Where("remember_hash=?", rememberHash)
-	err := first(db, &user)
-
-	if err != nil {
-		return nil, err
-	}
-
-	return &user, nil
-}
-
 // first will query the provided gorm.DB and it will get the
 // the first item returned and place it into dst, if nothing
 // found in teh query, it will return ErrNotFound
@@ -497,3 +482,230 @@ func (us *userService) Authenticate(email, password string) (*User, error) {
 
 	return foundUser, nil
 }
+
+// InitiateReset looks up the user by email and creates a reset token for them
+// If no user is found, ErrNotFound is returned
+func (us *userService) InitiateReset(email string) (string, error) {
+	user, err := us.ByEmail(email)
+	if err != nil {
+		return "", err
+	}
+
+	pwr := PwReset{
+		UserID: user.ID,
+	}
+
+	if err := us.pwResetDB.Create(&pwr); err != nil {
+		return "", err
+	}
+
+	return pwr.Token, nil
+}
+
+// CompleteReset sets the user's new password and deletes the reset in one transaction
+// The reset is claimed first, so that of two requests with the same token only one sets a password:
+// the other gets ErrTokenInvalid, and nothing is changed if the new password is rejected
+// The new password goes through the userValidator's Update so that
+// the password length check and bcrypt hashing are still applied
+func (us *userService) CompleteReset(token, newPw string) (*User, error) {
+	pwr, err := us.pwResetDB.ByToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := us.ByID(pwr.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	// an empty password would leave the old password in place
+	// and still use up the token, so reject it here
+	if newPw == "" {
+		return nil, ErrPasswordRequired
+	}
+
+	tx := us.db.Begin()
+	if err := (&pwResetGorm{tx}).Claim(pwr); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	user.Password = newPw
+	if err := newUserValidator(&userGorm{tx}, us.pepper).Update(user); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// VerificationToken creates the token used in the verification email link
+// The user's VerifyVersion goes up first, which makes the links sent before invalid
+func (us *userService) VerificationToken(user *User) (string, error) {
+	user.VerifyVersion++
+	if err := us.Update(user); err != nil {
+		return "", err
+	}
+	return us.verifier.Token(user), nil
+}
+
+// Verify looks up the user the token was issued for and sets EmailVerifiedAt
+// If the user has changed their email address since the token was issued,
+// ErrTokenInvalid is returned
+func (us *userService) Verify(token string) (*User, error) {
+	id, email, version, err := us.verifier.Parse(token)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := us.ByID(id)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrTokenInvalid
+		}
+		return nil, err
+	}
+
+	if user.Email != email || user.VerifyVersion != version {
+		return nil, ErrTokenInvalid
+	}
+
+	// following the link a second time is not an error
+	if user.Verified() {
+		return user, nil
+	}
+
+	now := time.Now()
+	user.EmailVerifiedAt = &now
+	if err := us.Update(user); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// ************** THIS SECTION CONTAINS THE TWO-FACTOR AUTHENTICATION METHODS **************
+
+const (
+	totpIssuer = "LensLocked"
+
+	pendingTOTPPurpose = "pending_2fa"
+	pendingTOTPTTL     = 5 * time.Minute
+)
+
+// EnrollTOTP stores a new secret on the user, replacing any unconfirmed one
+func (us *userService) EnrollTOTP(user *User) (string, error) {
+	if user.TwoFactorEnabled() {
+		return "", ErrTOTPEnabled
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return "", err
+	}
+
+	user.TOTPSecret = secret
+	if err := us.Update(user); err != nil {
+		return "", err
+	}
+
+	return totp.ProvisioningURI(totpIssuer, user.Email, secret), nil
+}
+
+// EnableTOTP checks the code against the enrolled secret before enabling it,
+// which proves that the authenticator app was set up correctly
+func (us *userService) EnableTOTP(user *User, code string) ([]string, error) {
+	if user.TwoFactorEnabled() {
+		return nil, ErrTOTPEnabled
+	}
+	if user.TOTPSecret == "" {
+		return nil, ErrTOTPInvalid
+	}
+
+	step, ok := totp.Validate(user.TOTPSecret, code, time.Now())
+	if !ok {
+		return nil, ErrTOTPInvalid
+	}
+
+	codes, err := us.recoveryCodeDB.Replace(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	user.TOTPEnabledAt = &now
+	user.TOTPLastStep = step
+	if err := us.Update(user); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+func (us *userService) DisableTOTP(user *User, code string) error {
+	if err := us.ValidateTOTP(user, code); err != nil {
+		return err
+	}
+
+	user.TOTPSecret = ""
+	user.TOTPEnabledAt = nil
+	user.TOTPLastStep = 0
+	if err := us.Update(user); err != nil {
+		return err
+	}
+
+	// the remaining recovery codes are replaced when 2FA is enabled again,
+	// but they should not be usable in the meantime
+	_, err := us.recoveryCodeDB.Replace(user.ID)
+	return err
+}
+
+// ValidateTOTP accepts a code from the authenticator app that has not been used before,
+// and otherwise tries the code as one of the user's recovery codes
+func (us *userService) ValidateTOTP(user *User, code string) error {
+	if !user.TwoFactorEnabled() {
+		return ErrTOTPInvalid
+	}
+
+	if step, ok := totp.Validate(user.TOTPSecret, code, time.Now()); ok {
+		if step <= user.TOTPLastStep {
+			return ErrTOTPInvalid
+		}
+		user.TOTPLastStep = step
+		return us.Update(user)
+	}
+
+	err := us.recoveryCodeDB.Use(user.ID, strings.TrimSpace(code))
+	switch err {
+	case nil:
+		return nil
+	case ErrNotFound:
+		return ErrTOTPInvalid
+	default:
+		return err
+	}
+}
+
+func (us *userService) PendingTOTPToken(user *User) string {
+	return us.signer.Sign(pendingTOTPPurpose, pendingTOTPTTL, strconv.FormatUint(uint64(user.ID), 10))
+}
+
+func (us *userService) ByPendingTOTPToken(token string) (*User, error) {
+	fields, err := us.signer.Parse(pendingTOTPPurpose, token)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) != 1 {
+		return nil, ErrTokenInvalid
+	}
+
+	id, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+
+	return us.ByID(uint(id))
+}
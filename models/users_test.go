@@ -0,0 +1,205 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"lenslocked.com/totp"
+)
+
+func TestUserCreate(t *testing.T) {
+	tests := []struct {
+		name  string
+		user  User
+		email string // as stored
+		err   error
+	}{
+		{"valid", User{Email: "ann@example.com", Password: "password123"}, "ann@example.com", nil},
+		{"email normalized", User{Email: "  Bob@Example.COM ", Password: "password123"}, "bob@example.com", nil},
+		{"email required", User{Email: " ", Password: "password123"}, "", ErrEmailRequired},
+		{"email invalid", User{Email: "not-an-email", Password: "password123"}, "", ErrEmailInvalid},
+		{"email taken", User{Email: "JON@example.com", Password: "password123"}, "", ErrEmailTaken},
+		{"password required", User{Email: "cat@example.com"}, "", ErrPasswordRequired},
+		{"password too short", User{Email: "cat@example.com", Password: "short"}, "", ErrPasswordTooShort},
+	}
+
+	forEachDialect(t, func(t *testing.T, s *Services) {
+		createTestUser(t, s, "jon@example.com")
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				user := tt.user
+				if err := s.User.Create(&user); err != tt.err {
+					t.Fatalf("Create() err = %v, want %v", err, tt.err)
+				}
+				if tt.err != nil {
+					return
+				}
+				if user.Password != "" || user.PasswordHash == "" {
+					t.Error("the password was not replaced by its hash")
+				}
+				found, err := s.User.ByEmail(tt.user.Email)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if found.ID != user.ID || found.Email != tt.email {
+					t.Errorf("ByEmail() = %d %q, want %d %q", found.ID, found.Email, user.ID, tt.email)
+				}
+			})
+		}
+	})
+}
+
+func TestUserAuthenticate(t *testing.T) {
+	tests := []struct {
+		name     string
+		email    string
+		password string
+		err      error
+	}{
+		{"right password", "jon@example.com", "correct horse battery staple", nil},
+		{"email in another case", "Jon@Example.com", "correct horse battery staple", nil},
+		{"wrong password", "jon@example.com", "incorrect horse battery staple", ErrInvalidPassword},
+		{"unknown email", "ann@example.com", "correct horse battery staple", ErrNotFound},
+	}
+
+	forEachDialect(t, func(t *testing.T, s *Services) {
+		jon := createTestUser(t, s, "jon@example.com")
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				user, err := s.User.Authenticate(tt.email, tt.password)
+				if err != tt.err {
+					t.Fatalf("Authenticate() err = %v, want %v", err, tt.err)
+				}
+				if err == nil && user.ID != jon.ID {
+					t.Errorf("Authenticate() returned user %d, want %d", user.ID, jon.ID)
+				}
+			})
+		}
+	})
+}
+
+func TestUserCompleteResetSingleUse(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, s *Services) {
+		user := createTestUser(t, s, "jon@example.com")
+
+		token, err := s.User.InitiateReset(user.Email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.User.CompleteReset(token, "short"); err != ErrPasswordTooShort {
+			t.Fatalf("CompleteReset() with a short password err = %v, want ErrPasswordTooShort", err)
+		}
+		// a rejected password does not use up the token
+		if _, err := s.User.CompleteReset(token, "new password 1"); err != nil {
+			t.Fatalf("CompleteReset() err = %v", err)
+		}
+		if _, err := s.User.CompleteReset(token, "new password 2"); err != ErrTokenInvalid {
+			t.Errorf("CompleteReset() a second time err = %v, want ErrTokenInvalid", err)
+		}
+		if _, err := s.User.Authenticate(user.Email, "new password 1"); err != nil {
+			t.Errorf("Authenticate() with the first new password err = %v", err)
+		}
+	})
+}
+
+func TestUserCompleteResetConcurrent(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, s *Services) {
+		user := createTestUser(t, s, "jon@example.com")
+		token, err := s.User.InitiateReset(user.Email)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		const requests = 5
+		errs := make(chan error, requests)
+		for i := 0; i < requests; i++ {
+			go func(password string) {
+				_, err := s.User.CompleteReset(token, password)
+				errs <- err
+			}(fmt.Sprintf("new password %d", i))
+		}
+
+		var succeeded int
+		for i := 0; i < requests; i++ {
+			switch err := <-errs; err {
+			case nil:
+				succeeded++
+			case ErrTokenInvalid:
+			default:
+				t.Errorf("CompleteReset() err = %v", err)
+			}
+		}
+		if succeeded != 1 {
+			t.Errorf("%d requests set a password with the same token, want 1", succeeded)
+		}
+	})
+}
+
+// TestPwResetClaim is what two requests that both found the reset with ByToken do next
+func TestPwResetClaim(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, s *Services) {
+		user := createTestUser(t, s, "jon@example.com")
+		resets := &pwResetGorm{s.db}
+		pwr := PwReset{UserID: user.ID, TokenHash: "token-hash", ExpiresAt: time.Now().Add(time.Hour)}
+		if err := resets.Create(&pwr); err != nil {
+			t.Fatal(err)
+		}
+
+		first, second := pwr, pwr
+		if err := resets.Claim(&first); err != nil {
+			t.Fatalf("the first Claim() err = %v", err)
+		}
+		if err := resets.Claim(&second); err != ErrTokenInvalid {
+			t.Errorf("the second Claim() err = %v, want ErrTokenInvalid", err)
+		}
+	})
+}
+
+func TestUserValidateTOTPReplay(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, s *Services) {
+		user := createTestUser(t, s, "jon@example.com")
+		if _, err := s.User.EnrollTOTP(user); err != nil {
+			t.Fatal(err)
+		}
+		codeAt := func(step int64) string {
+			t.Helper()
+			code, err := totp.Code(user.TOTPSecret, step)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return code
+		}
+
+		current := totp.Step(time.Now())
+		if _, err := s.User.EnableTOTP(user, codeAt(current)); err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			name string
+			code string
+			err  error
+		}{
+			{"the code that enabled 2FA", codeAt(current), ErrTOTPInvalid},
+			{"the code of the next step", codeAt(current + 1), nil},
+			{"the same code again", codeAt(current + 1), ErrTOTPInvalid},
+			{"an older code", codeAt(current - 1), ErrTOTPInvalid},
+			{"a code too far ahead", codeAt(current + 3), ErrTOTPInvalid},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				// the user is loaded again, as every login does
+				found, err := s.User.ByID(user.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := s.User.ValidateTOTP(found, tt.code); err != tt.err {
+					t.Errorf("ValidateTOTP() err = %v, want %v", err, tt.err)
+				}
+			})
+		}
+	})
+}
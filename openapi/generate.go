@@ -0,0 +1,316 @@
+package openapi
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+)
+
+// Endpoint documents a route of the API
+// The method and the path are not part of it, they come from the route registrations (see Generate)
+type Endpoint struct {
+	ID          string
+	Summary     string
+	Description string
+	Tag         string
+
+	// Scope is the API token scope the route needs, "" when any logged in user may use it
+	Scope string
+
+	// Request is a value of the type the handler decodes the JSON body into, nil when there is no JSON body
+	// Upload is the name of the file field when the body is multipart/form-data instead
+	Request interface{}
+	Upload  string
+
+	// Status is the status code of a successful response and Response a value of the type
+	// found under "data" in its envelope; Response is nil for responses without a body (204)
+	Status   int
+	Response interface{}
+}
+
+// The API accepts either an API token or the session cookie
+const (
+	bearerAuth = "bearerAuth"
+	cookieAuth = "cookieAuth"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// routeParam matches the variables of a mux path template, e.g. {id:[0-9]+}
+var routeParam = regexp.MustCompile(`\{([^}:]+)(?::([^}]*))?\}`)
+
+// Generate documents every route registered on the router with the endpoint found under
+// "<METHOD> <path template>", e.g. "GET /api/v1/galleries/{id:[0-9]+}"
+// A route without an endpoint, or an endpoint without a route, is an error,
+// so the document cannot drift from the routes
+//
+// Every response is wrapped in an envelope: {"data": <Response>} on success,
+// and {"error": <apiError>} otherwise, where apiError is a value of the error type
+func Generate(info Info, router *mux.Router, endpoints map[string]Endpoint, apiError interface{}) (*Document, error) {
+	g := &generator{
+		doc: &Document{
+			OpenAPI: Version,
+			Info:    info,
+			Paths:   map[string]*PathItem{},
+			Components: Components{
+				Schemas: map[string]*Schema{},
+				SecuritySchemes: map[string]*SecurityScheme{
+					bearerAuth: {
+						Type:        "http",
+						Scheme:      "bearer",
+						Description: "An API token, created on the /tokens page. Operations need the scope in x-scope.",
+					},
+					cookieAuth: {
+						Type:        "apiKey",
+						In:          "cookie",
+						Name:        "remember_token",
+						Description: "The session cookie. POST, PATCH and DELETE requests also need the X-CSRF-Token header sent with every response.",
+					},
+				},
+			},
+		},
+		types: map[string]reflect.Type{},
+	}
+	errorSchema := g.envelope("error", apiError)
+
+	used := map[string]bool{}
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			// subrouters and catch-all routes have no methods
+			return nil
+		}
+		for _, method := range methods {
+			key := method + " " + tpl
+			endpoint, ok := endpoints[key]
+			if !ok {
+				return fmt.Errorf("openapi: route %s is not documented", key)
+			}
+			used[key] = true
+			g.add(method, tpl, endpoint, errorSchema)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for key := range endpoints {
+		if !used[key] {
+			return nil, fmt.Errorf("openapi: %s is documented but no such route is registered", key)
+		}
+	}
+	if g.err != nil {
+		return nil, g.err
+	}
+	return g.doc, nil
+}
+
+type generator struct {
+	doc *Document
+
+	// types remembers which Go type each component schema was made from
+	types map[string]reflect.Type
+	err   error
+}
+
+// add documents a single operation
+func (g *generator) add(method, tpl string, endpoint Endpoint, errorSchema *Schema) {
+	path := routeParam.ReplaceAllString(tpl, "{$1}")
+
+	op := &Operation{
+		OperationID: endpoint.ID,
+		Summary:     endpoint.Summary,
+		Description: endpoint.Description,
+		Responses:   map[string]*Response{},
+		Scope:       endpoint.Scope,
+		Security: []map[string][]string{
+			{bearerAuth: {}},
+			{cookieAuth: {}},
+		},
+	}
+	if endpoint.Tag != "" {
+		op.Tags = []string{endpoint.Tag}
+	}
+
+	for _, m := range routeParam.FindAllStringSubmatch(tpl, -1) {
+		schema := &Schema{Type: "string"}
+		if m[2] == "[0-9]+" {
+			schema = &Schema{Type: "integer"}
+		}
+		op.Parameters = append(op.Parameters, &Parameter{Name: m[1], In: "path", Required: true, Schema: schema})
+	}
+
+	switch {
+	case endpoint.Upload != "":
+		op.RequestBody = &RequestBody{
+			Required: true,
+			Content: map[string]*MediaType{
+				"multipart/form-data": {Schema: &Schema{
+					Type: "object",
+					Properties: map[string]*Schema{
+						endpoint.Upload: {Type: "array", Items: &Schema{Type: "string", Format: "binary"}},
+					},
+					Required: []string{endpoint.Upload},
+				}},
+			},
+		}
+	case endpoint.Request != nil:
+		op.RequestBody = &RequestBody{
+			Required: true,
+			Content: map[string]*MediaType{
+				"application/json": {Schema: g.schema(reflect.TypeOf(endpoint.Request))},
+			},
+		}
+	}
+
+	success := &Response{Description: http.StatusText(endpoint.Status)}
+	if endpoint.Response != nil {
+		success.Content = map[string]*MediaType{
+			"application/json": {Schema: g.envelope("data", endpoint.Response)},
+		}
+	}
+	op.Responses[strconv.Itoa(endpoint.Status)] = success
+	op.Responses["default"] = &Response{
+		Description: "Error",
+		Content:     map[string]*MediaType{"application/json": {Schema: errorSchema}},
+	}
+
+	item, ok := g.doc.Paths[path]
+	if !ok {
+		item = &PathItem{}
+		g.doc.Paths[path] = item
+	}
+	(*item)[strings.ToLower(method)] = op
+}
+
+// envelope is the schema of {"<key>": <v>}
+func (g *generator) envelope(key string, v interface{}) *Schema {
+	return &Schema{
+		Type:       "object",
+		Properties: map[string]*Schema{key: g.schema(reflect.TypeOf(v))},
+		Required:   []string{key},
+	}
+}
+
+// schema describes the JSON encoding of the type, the way encoding/json encodes it
+// Named structs become component schemas and are referenced
+func (g *generator) schema(t reflect.Type) *Schema {
+	if t == timeType {
+		return &Schema{Type: "string", Format: "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := *g.schema(t.Elem())
+		// siblings of a $ref are ignored, so a reference cannot be made nullable
+		if s.Ref == "" {
+			s.Nullable = true
+		}
+		return &s
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: g.schema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		return g.ref(t)
+	case reflect.Interface:
+		return &Schema{}
+	}
+
+	g.fail(fmt.Errorf("openapi: cannot describe %s", t))
+	return &Schema{}
+}
+
+// ref adds the struct to the component schemas and returns a reference to it
+func (g *generator) ref(t reflect.Type) *Schema {
+	name := schemaName(t)
+	ref := &Schema{Ref: "#/components/schemas/" + name}
+
+	if existing, ok := g.types[name]; ok {
+		if existing != t {
+			g.fail(fmt.Errorf("openapi: %s and %s would both be named %s", existing, t, name))
+		}
+		return ref
+	}
+
+	// remember the type before describing it, for structs that refer to themselves
+	g.types[name] = t
+	g.doc.Components.Schemas[name] = g.object(t)
+	return ref
+}
+
+// object describes the exported fields of the struct, using their json tags
+// Fields are required unless they are pointers or have the omitempty option
+func (g *generator) object(t reflect.Type) *Schema {
+	s := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	g.fields(s, t)
+	return s
+}
+
+func (g *generator) fields(s *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+
+		// the fields of embedded structs are encoded as if they were fields of t
+		if f.Anonymous && tag == "" && f.Type.Kind() == reflect.Struct {
+			g.fields(s, f.Type)
+			continue
+		}
+		if f.PkgPath != "" || tag == "-" {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+		s.Properties[name] = g.schema(f.Type)
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Ptr {
+			s.Required = append(s.Required, name)
+		}
+	}
+}
+
+func (g *generator) fail(err error) {
+	if g.err == nil {
+		g.err = err
+	}
+}
+
+// schemaName is the Go type name starting with an upper case letter
+// The "api" prefix of the resource types of the controllers is dropped, e.g. apiGallery is "Gallery"
+func schemaName(t reflect.Type) string {
+	name := t.Name()
+	if rest := strings.TrimPrefix(name, "api"); rest != name && rest != "" && unicode.IsUpper(rune(rest[0])) {
+		name = rest
+	}
+	return strings.ToUpper(name[:1]) + name[1:]
+}
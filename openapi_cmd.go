@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/gorilla/mux"
+	"lenslocked.com/controllers"
+	"lenslocked.com/middleware"
+	"lenslocked.com/openapi"
+	"lenslocked.com/views"
+)
+
+// openAPIFile is the committed copy of the OpenAPI document, for the client teams
+// "openapi check" fails when it no longer matches the API, e.g. after a request
+// or response type of controllers/api.go was changed without running "openapi write"
+const openAPIFile = "docs/openapi.json"
+
+const openAPIUsage = `usage: lenslocked.com openapi <command>
+
+commands:
+  check    fail when ` + openAPIFile + ` differs from the document generated from the API
+  write    write the generated document to ` + openAPIFile
+
+const apiPrefix = "/api/v1"
+
+var apiInfo = openapi.Info{
+	Title:   "LensLocked API",
+	Version: "1",
+	Description: "The galleries and images of the current user. " +
+		"Every response is a JSON envelope with either a data or an error property.",
+}
+
+// registerAPIRoutes adds the routes of the JSON API to the router
+// Each route is protected with the scope documented in controllers.APIEndpoints
+func registerAPIRoutes(r *mux.Router, apiC *controllers.API, requireAPIUserMW middleware.RequireAPIUser) *mux.Router {
+	api := r.PathPrefix(apiPrefix).Subrouter()
+
+	handle := func(method, path string, handler http.HandlerFunc) {
+		endpoint, ok := controllers.APIEndpoints[method+" "+apiPrefix+path]
+		if !ok {
+			must(fmt.Errorf("the API route %s %s is not documented in controllers.APIEndpoints", method, apiPrefix+path))
+		}
+		if endpoint.Scope != "" {
+			handler = requireAPIUserMW.ApplyScope(endpoint.Scope, handler)
+		} else {
+			handler = requireAPIUserMW.ApplyFn(handler)
+		}
+		api.HandleFunc(path, handler).Methods(method)
+	}
+
+	handle("GET", "/me", apiC.Me)
+	handle("PATCH", "/me", apiC.UpdateMe)
+	handle("GET", "/galleries", apiC.Galleries)
+	handle("POST", "/galleries", apiC.CreateGallery)
+	handle("GET", "/galleries/{id:[0-9]+}", apiC.Gallery)
+	handle("PATCH", "/galleries/{id:[0-9]+}", apiC.UpdateGallery)
+	handle("DELETE", "/galleries/{id:[0-9]+}", apiC.DeleteGallery)
+	handle("GET", "/galleries/{id:[0-9]+}/images", apiC.Images)
+	handle("POST", "/galleries/{id:[0-9]+}/images", apiC.UploadImages)
+	handle("GET", "/galleries/{id:[0-9]+}/images/{image_id:[0-9]+}", apiC.Image)
+	handle("PATCH", "/galleries/{id:[0-9]+}/images/{image_id:[0-9]+}", apiC.UpdateImage)
+	handle("DELETE", "/galleries/{id:[0-9]+}/images/{image_id:[0-9]+}", apiC.DeleteImage)
+	api.NotFoundHandler = http.HandlerFunc(apiC.NotFound)
+
+	return api
+}
+
+// apiDocument generates the OpenAPI document of the routes registered by registerAPIRoutes
+func apiDocument(api *mux.Router) (*openapi.Document, error) {
+	return openapi.Generate(apiInfo, api, controllers.APIEndpoints, views.JSONError{})
+}
+
+// isOpenAPI reports whether the "openapi" subcommand was given
+// It only looks at the routes and types, so it does not need a database connection
+func isOpenAPI(args []string) bool {
+	return len(args) >= 1 && args[0] == "openapi"
+}
+
+// runOpenAPI handles the "openapi check|write" subcommands
+func runOpenAPI(args []string) error {
+	if len(args) != 2 {
+		return errors.New(openAPIUsage)
+	}
+
+	// The handlers are never called, so the API controller needs no services
+	api := registerAPIRoutes(mux.NewRouter(), controllers.NewAPI(nil, nil, nil, nil), middleware.RequireAPIUser{})
+	doc, err := apiDocument(api)
+	if err != nil {
+		return err
+	}
+	generated, err := doc.JSON()
+	if err != nil {
+		return err
+	}
+
+	switch args[1] {
+	case "write":
+		if err := os.MkdirAll(filepath.Dir(openAPIFile), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(openAPIFile, generated, 0644); err != nil {
+			return err
+		}
+		fmt.Println("Wrote", openAPIFile)
+	case "check":
+		committed, err := os.ReadFile(openAPIFile)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(committed, generated) {
+			return fmt.Errorf("%s is out of date with the API, run: lenslocked.com openapi write", openAPIFile)
+		}
+		fmt.Println(openAPIFile, "is up to date")
+	default:
+		return errors.New(openAPIUsage)
+	}
+	return nil
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"lenslocked.com/controllers"
+	"lenslocked.com/middleware"
+	"lenslocked.com/models"
+	"lenslocked.com/openapi"
+)
+
+// apiCall is a request to one operation of the API
+// The path is the one of the document, its {id} and {image_id} are filled in with the ids created so far
+type apiCall struct {
+	method string
+	path   string
+	body   interface{} // sent as JSON, unless it is an *upload
+	save   func(data interface{})
+}
+
+// upload is a multipart/form-data body with a PNG image in the named field
+type upload struct {
+	field string
+}
+
+// TestAPIMatchesOpenAPI calls every operation of the API through the router, the way a client would,
+// and checks the request and the response against the generated document
+// The request and response types of controllers.APIEndpoints are written by hand,
+// so this is what catches a handler that sends or expects something else
+func TestAPIMatchesOpenAPI(t *testing.T) {
+	handler, api, user := newAPITestServer(t)
+	doc, err := apiDocument(api)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := map[string]string{}
+	saveID := func(name string) func(interface{}) {
+		return func(data interface{}) {
+			if list, ok := data.([]interface{}); ok && len(list) > 0 {
+				data = list[0]
+			}
+			if obj, ok := data.(map[string]interface{}); ok {
+				ids[name] = fmt.Sprint(obj["id"])
+			}
+		}
+	}
+
+	// in an order that creates what the later calls need, and deletes it at the end
+	calls := []apiCall{
+		{method: "GET", path: "/api/v1/me"},
+		{method: "PATCH", path: "/api/v1/me", body: map[string]interface{}{"name": "Ann", "age": 30}},
+		{method: "POST", path: "/api/v1/galleries", body: map[string]interface{}{"title": "Beach", "visibility": "unlisted"}, save: saveID("id")},
+		{method: "GET", path: "/api/v1/galleries"},
+		{method: "GET", path: "/api/v1/galleries/{id}"},
+		{method: "PATCH", path: "/api/v1/galleries/{id}", body: map[string]interface{}{"title": "Beach 2024"}},
+		{method: "POST", path: "/api/v1/galleries/{id}/images", body: &upload{field: "images"}, save: saveID("image_id")},
+		{method: "GET", path: "/api/v1/galleries/{id}/images"},
+		{method: "GET", path: "/api/v1/galleries/{id}/images/{image_id}"},
+		{method: "PATCH", path: "/api/v1/galleries/{id}/images/{image_id}", body: map[string]interface{}{"caption": "Sunset", "position": 2}},
+		{method: "DELETE", path: "/api/v1/galleries/{id}/images/{image_id}"},
+		{method: "DELETE", path: "/api/v1/galleries/{id}"},
+	}
+
+	called := map[string]bool{}
+	for _, call := range calls {
+		name := call.method + " " + call.path
+		called[name] = true
+		t.Run(name, func(t *testing.T) {
+			item, ok := doc.Paths[call.path]
+			if !ok || (*item)[strings.ToLower(call.method)] == nil {
+				t.Fatalf("the document has no operation %s", name)
+			}
+			op := (*item)[strings.ToLower(call.method)]
+
+			req := newAPIRequest(t, doc, op, call, ids)
+			req.AddCookie(&http.Cookie{Name: "remember_token", Value: user})
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			data := checkAPIResponse(t, doc, op, w.Result())
+			if call.save != nil {
+				call.save(data)
+			}
+		})
+	}
+
+	for path, item := range doc.Paths {
+		for method := range *item {
+			if name := strings.ToUpper(method) + " " + path; !called[name] {
+				t.Errorf("%s is not called by the test, please add it to the calls", name)
+			}
+		}
+	}
+}
+
+// newAPITestServer returns the API routes behind the User middleware, on an in-memory SQLite database,
+// along with the session token of a verified user
+func newAPITestServer(t *testing.T) (http.Handler, *mux.Router, string) {
+	t.Helper()
+	services, err := models.NewServices(
+		models.WithGorm("sqlite3", ":memory:"),
+		models.WithMigrations(os.DirFS("migrations")),
+		models.WithUser("pepper", "hmac-secret-key", time.Hour, time.Hour),
+		models.WithSession("hmac-secret-key", time.Hour),
+		models.WithGallery(),
+		models.WithImage(models.NewLocalBlobStore(t.TempDir()), models.DefaultImageSizes, models.DefaultMaxImagePixels, "hmac-secret-key"),
+		models.WithShareLink("pepper", "hmac-secret-key"),
+		models.WithAPIToken("hmac-secret-key"),
+		models.WithAttempts(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { services.Close() })
+	if _, err := services.Migrator().Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	user := models.User{Name: "Jon", Email: "jon@example.com", Password: "correct horse battery staple"}
+	if err := services.User.Create(&user); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	user.EmailVerifiedAt = &now
+	if err := services.User.Update(&user); err != nil {
+		t.Fatal(err)
+	}
+	session := models.Session{UserID: user.ID}
+	if err := services.Session.Create(&session); err != nil {
+		t.Fatal(err)
+	}
+
+	userMW := middleware.User{
+		UserService:     services.User,
+		SessionService:  services.Session,
+		APITokenService: services.APIToken,
+	}
+	r := mux.NewRouter()
+	apiC := controllers.NewAPI(services.User, services.Gallery, services.Image, services.Share)
+	api := registerAPIRoutes(r, apiC, middleware.RequireAPIUser{User: userMW})
+	return userMW.Apply(r), api, session.Token
+}
+
+// newAPIRequest checks the body of the call against the request body of the operation and builds the request
+func newAPIRequest(t *testing.T, doc *openapi.Document, op *openapi.Operation, call apiCall, ids map[string]string) *http.Request {
+	t.Helper()
+	path := call.path
+	for name, id := range ids {
+		path = strings.ReplaceAll(path, "{"+name+"}", id)
+	}
+	if strings.Contains(path, "{") {
+		t.Fatalf("%s needs an id that was not created by an earlier call", call.path)
+	}
+
+	var body io.Reader
+	var contentType string
+	switch b := call.body.(type) {
+	case nil:
+		if op.RequestBody != nil && op.RequestBody.Required {
+			t.Fatal("the operation needs a request body")
+		}
+	case *upload:
+		media := requestMedia(t, op, "multipart/form-data")
+		if _, ok := media.Schema.Properties[b.field]; !ok {
+			t.Fatalf("the multipart body has no field %q", b.field)
+		}
+		body, contentType = multipartPNG(t, b.field)
+	default:
+		media := requestMedia(t, op, "application/json")
+		raw, err := json.Marshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded interface{}
+		json.Unmarshal(raw, &decoded)
+		if err := validateSchema(doc, media.Schema, decoded, "body"); err != nil {
+			t.Fatalf("the request does not match the document: %v", err)
+		}
+		body, contentType = bytes.NewReader(raw), "application/json"
+	}
+
+	req := httptest.NewRequest(call.method, path, body)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return req
+}
+
+func requestMedia(t *testing.T, op *openapi.Operation, contentType string) *openapi.MediaType {
+	t.Helper()
+	if op.RequestBody == nil || op.RequestBody.Content[contentType] == nil {
+		t.Fatalf("the operation takes no %s body", contentType)
+	}
+	return op.RequestBody.Content[contentType]
+}
+
+func multipartPNG(t *testing.T, field string) (io.Reader, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, err := mw.CreateFormFile(field, "beach.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(fw, image.NewGray(image.Rect(0, 0, 40, 30))); err != nil {
+		t.Fatal(err)
+	}
+	mw.Close()
+	return &buf, mw.FormDataContentType()
+}
+
+// checkAPIResponse checks that the status is the documented one and that the body matches its schema
+// It returns the data of the envelope
+func checkAPIResponse(t *testing.T, doc *openapi.Document, op *openapi.Operation, res *http.Response) interface{} {
+	t.Helper()
+	raw, _ := io.ReadAll(res.Body)
+
+	documented, ok := op.Responses[fmt.Sprint(res.StatusCode)]
+	if !ok {
+		t.Fatalf("the status %d is not documented: %s", res.StatusCode, raw)
+	}
+	media := documented.Content["application/json"]
+	if media == nil {
+		if len(raw) > 0 {
+			t.Errorf("the response has a body, the document says it has none: %s", raw)
+		}
+		return nil
+	}
+
+	var decoded interface{}
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		t.Fatalf("the response is not JSON: %v: %s", err, raw)
+	}
+	if err := validateSchema(doc, media.Schema, decoded, "response"); err != nil {
+		t.Fatalf("the response does not match the document: %v\n%s", err, raw)
+	}
+	return decoded.(map[string]interface{})["data"]
+}
+
+// validateSchema checks a decoded JSON value against the parts of JSON Schema that openapi.Generate uses
+// Properties that the schema does not list are errors too, so that a handler sending another type is caught
+func validateSchema(doc *openapi.Document, s *openapi.Schema, v interface{}, at string) error {
+	if name := s.RefName(); name != "" {
+		ref, ok := doc.Components.Schemas[name]
+		if !ok {
+			return fmt.Errorf("%s: the schema %s is not defined", at, name)
+		}
+		s = ref
+	}
+	if s.Type == "" {
+		return nil
+	}
+	if v == nil {
+		if s.Nullable {
+			return nil
+		}
+		return fmt.Errorf("%s: null is not a %s", at, s.Type)
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: %v is not an object", at, v)
+		}
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				return fmt.Errorf("%s: the required property %s is missing", at, name)
+			}
+		}
+		for name, value := range obj {
+			prop, ok := s.Properties[name]
+			if !ok {
+				prop = s.AdditionalProperties
+			}
+			if prop == nil {
+				return fmt.Errorf("%s: the property %s is not in the schema", at, name)
+			}
+			if err := validateSchema(doc, prop, value, at+"."+name); err != nil {
+				return err
+			}
+		}
+	case "array":
+		list, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: %v is not an array", at, v)
+		}
+		for i, item := range list {
+			if err := validateSchema(doc, s.Items, item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s: %v is not a string", at, v)
+		}
+		if s.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, str); err != nil {
+				return fmt.Errorf("%s: %q is not a date-time", at, str)
+			}
+		}
+	case "integer":
+		n, ok := v.(float64)
+		if !ok || n != float64(int64(n)) {
+			return fmt.Errorf("%s: %v is not an integer", at, v)
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			return fmt.Errorf("%s: %v is not a number", at, v)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s: %v is not a boolean", at, v)
+		}
+	default:
+		return fmt.Errorf("%s: unknown type %s", at, s.Type)
+	}
+	return nil
+}
@@ -1,7 +1,6 @@
 package views
 
 import (
-	"log"
 	"net/http"
 	"time"
 
@@ -20,15 +19,21 @@ const (
 
 // Alert is used to render alert bootstrap messages in the bootstrap.html
 type Alert struct {
-	Level   string
-	Message string
+	Level   string `json:"level"`
+	Message string `json:"message"`
 }
 
 // Data is the top level structure that views expect data to come in
+// Clients asking for JSON get the alert and the yield (see negotiate.go);
+// the user is left out, since they know who they are logged in as
 type Data struct {
-	Alert *Alert
-	Yield interface{}
-	User  *models.User
+	Alert *Alert       `json:"alert,omitempty"`
+	Yield interface{}  `json:"yield"`
+	User  *models.User `json:"-"`
+
+	// err is the private error behind an AlertMsgGeneric alert
+	// Render logs it, since only Render knows which request it belongs to
+	err error
 }
 
 func (d *Data) SetAlert(err error) {
@@ -46,7 +51,7 @@ func (d *Data) SetAlert(err error) {
 			Message: pErr.Public(),
 		}
 	} else {
-		log.Print(err) // if this is a private error, print it out to debug
+		d.err = err // if this is a private error, keep it so that it is logged to debug
 		d.Alert = &Alert{
 			Level:   AlertLvlError,
 			Message: AlertMsgGeneric,
@@ -72,6 +77,7 @@ func persistAlert(w http.ResponseWriter, alert Alert) {
 
 	level := http.Cookie{
 		Name:     "alert_level",
+		Path:     "/",
 		Value:    alert.Level,
 		Expires:  expiresAt,
 		HttpOnly: true,
@@ -79,6 +85,7 @@ func persistAlert(w http.ResponseWriter, alert Alert) {
 
 	message := http.Cookie{
 		Name:     "alert_message",
+		Path:     "/",
 		Value:    alert.Message,
 		Expires:  expiresAt,
 		HttpOnly: true,
@@ -92,6 +99,7 @@ func clearAlert(w http.ResponseWriter) {
 
 	level := http.Cookie{
 		Name:     "alert_level",
+		Path:     "/",
 		Value:    "",
 		Expires:  time.Now(),
 		HttpOnly: true,
@@ -99,6 +107,7 @@ func clearAlert(w http.ResponseWriter) {
 
 	message := http.Cookie{
 		Name:     "alert_message",
+		Path:     "/",
 		Value:    "",
 		Expires:  time.Now(),
 		HttpOnly: true,
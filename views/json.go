@@ -0,0 +1,58 @@
+package views
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/csrf"
+	"lenslocked.com/context"
+)
+
+// Every JSON response is wrapped in the same envelope, so that API clients
+// can always look at "data" on success and at "error" otherwise, e.g.
+//
+//	{"data": {"id": 20, "title": "Beach"}}
+//	{"error": {"status": 404, "message": "Gallery not found."}}
+type jsonEnvelope struct {
+	Data  interface{} `json:"data,omitempty"`
+	Error *JSONError  `json:"error,omitempty"`
+}
+
+// JSONError is the error part of the envelope
+type JSONError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// RenderJSON writes data in the envelope with the given status code
+// The CSRF token is sent along in the X-CSRF-Token header, which API clients
+// that log in with the session cookie must send back on POST, PATCH and DELETE requests
+func RenderJSON(w http.ResponseWriter, r *http.Request, status int, data interface{}) {
+	w.Header().Set("X-CSRF-Token", csrf.Token(r))
+	writeJSON(w, status, jsonEnvelope{Data: data})
+}
+
+// RenderJSONError works like Data.SetAlert: the message of a PublicError is shown as it is,
+// any other error is logged and replaced by AlertMsgGeneric
+func RenderJSONError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if pErr, ok := err.(PublicError); ok {
+		RenderJSONMessage(w, status, pErr.Public())
+		return
+	}
+	context.Logger(r.Context()).Error("rendering an error", "err", err)
+	RenderJSONMessage(w, status, AlertMsgGeneric)
+}
+
+// RenderJSONMessage writes an error envelope with the given message, like Data.AlertError
+func RenderJSONMessage(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, jsonEnvelope{Error: &JSONError{Status: status, Message: msg}})
+}
+
+func writeJSON(w http.ResponseWriter, status int, envelope jsonEnvelope) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(envelope); err != nil {
+		slog.Error("encoding json", "err", err)
+	}
+}
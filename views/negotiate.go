@@ -0,0 +1,64 @@
+package views
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// partialHeader names the block of the page to render instead of the whole page, e.g.
+// X-Partial: galleryImages renders only the images of the gallery edit page
+// htmx requests (HX-Request: true) may name the block with hx-target instead
+// Only the blocks a view declares with WithPartials can be asked for, anything else is a 400
+const partialHeader = "X-Partial"
+
+// varyHeaders are the request headers that change what Render sends back
+const varyHeaders = "Accept, HX-Request, HX-Target, " + partialHeader
+
+// wantsJSON reports whether the client prefers JSON to HTML in its Accept header,
+// e.g. a script sending "Accept: application/json"
+// Browsers, and clients that accept anything (*/*), get HTML
+func wantsJSON(r *http.Request) bool {
+	var htmlQ, jsonQ float64
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if k, v, ok := strings.Cut(strings.TrimSpace(param), "="); ok && k == "q" {
+				q, _ = strconv.ParseFloat(v, 64)
+			}
+		}
+
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case "application/json":
+			jsonQ = max(jsonQ, q)
+		case "text/html", "text/*", "*/*":
+			htmlQ = max(htmlQ, q)
+		}
+	}
+	return jsonQ > htmlQ
+}
+
+// partial returns the name of the block the request asks for, or "" for the whole page
+func partial(r *http.Request) string {
+	if block := r.Header.Get(partialHeader); block != "" {
+		return block
+	}
+	if r.Header.Get("HX-Request") == "true" {
+		return r.Header.Get("HX-Target")
+	}
+	return ""
+}
+
+// executePartial renders the alert, if there is one, followed by the block
+// The block gets the Yield, like the blocks that the yield template of a page calls
+func executePartial(tpl *template.Template, buf *bytes.Buffer, block string, vd Data) error {
+	if vd.Alert != nil {
+		if err := tpl.ExecuteTemplate(buf, "alert", vd.Alert); err != nil {
+			return err
+		}
+	}
+	return tpl.ExecuteTemplate(buf, block, vd.Yield)
+}
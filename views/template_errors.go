@@ -0,0 +1,158 @@
+package views
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"lenslocked.com/context"
+)
+
+// showErrors renders the details of a broken template instead of a generic message, see ShowErrors
+var showErrors bool
+
+// ShowErrors makes Render send a page with the template, line and error when a template fails,
+// instead of the generic message. For development only, since it shows the source of the templates
+func ShowErrors(show bool) {
+	showErrors = show
+}
+
+// Validate parses every view made by NewView and checks that its layout and partials are defined,
+// so that a broken template is found when the app starts instead of by the first user to see it
+// Every broken view is reported at once
+func Validate() error {
+	var errs []error
+	for _, v := range views {
+		t, err := v.template()
+		if err == nil && t.Lookup(v.Layout) == nil {
+			err = fmt.Errorf("the layout %q is not defined", v.Layout)
+		}
+		for block := range v.partials {
+			if err == nil && t.Lookup(block) == nil {
+				err = fmt.Errorf("the partial %q is not defined", block)
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("view %s: %w", v.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// TemplateError is a failed template with where it failed, as far as the error tells
+type TemplateError struct {
+	Name   string // the template file, e.g. new.gohtml
+	Line   int    // 0 when unknown
+	Err    string
+	Source []SourceLine
+}
+
+// SourceLine is a line of the template around the error
+type SourceLine struct {
+	Number int
+	Text   string
+	Error  bool
+}
+
+// templateErrorRegex finds the location in the errors of text/template and html/template, e.g.
+// template: new.gohtml:12:5: executing "yield" at <.Foo>: can't evaluate field Foo
+// html/template:new.gohtml:20: ends in a non-text context
+var templateErrorRegex = regexp.MustCompile(`^(?:html/)?template: ?([^:\s]+):(\d+):(?:\d+:)? (.*)$`)
+
+// newTemplateError finds the template and line of err, and the source lines around it
+func (v *View) newTemplateError(err error) TemplateError {
+	te := TemplateError{Err: err.Error()}
+
+	// The message comes first: an html/template error often has no Line of its own
+	// (e.g. {{if}} branches ending in different contexts), even though its message has one
+	var htmlErr *template.Error
+	if m := templateErrorRegex.FindStringSubmatch(err.Error()); m != nil {
+		te.Name, te.Err = m[1], m[3]
+		te.Line, _ = strconv.Atoi(m[2])
+	} else if errors.As(err, &htmlErr) && htmlErr.Name != "" {
+		te.Name, te.Line, te.Err = htmlErr.Name, htmlErr.Line, htmlErr.Description
+	}
+
+	if te.Line > 0 {
+		te.Source = v.source(te.Name, te.Line)
+	}
+	return te
+}
+
+// sourceContext is how many lines are shown before and after the line of the error
+const sourceContext = 3
+
+func (v *View) source(name string, line int) []SourceLine {
+	for _, f := range v.files {
+		if path.Base(f) != name {
+			continue
+		}
+		b, err := fs.ReadFile(templateFS, f)
+		if err != nil {
+			return nil
+		}
+
+		var lines []SourceLine
+		for i, text := range strings.Split(string(b), "\n") {
+			n := i + 1
+			if n >= line-sourceContext && n <= line+sourceContext {
+				lines = append(lines, SourceLine{Number: n, Text: text, Error: n == line})
+			}
+		}
+		return lines
+	}
+	return nil
+}
+
+// renderError logs a failed template and tells the user something went wrong,
+// in development with the details of the error (see ShowErrors)
+func (v *View) renderError(w http.ResponseWriter, r *http.Request, err error) {
+	te := v.newTemplateError(err)
+	context.Logger(r.Context()).Error("rendering the template",
+		"template", te.Name, "line", te.Line, "err", err)
+
+	if !showErrors {
+		http.Error(w, "Something went wrong. If the problem persisits, please email support@lenslocked.com", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(http.StatusInternalServerError)
+	errorPage.Execute(w, struct {
+		TemplateError
+		View  string
+		Nonce string
+	}{te, v.name, context.CSPNonce(r.Context())})
+}
+
+// errorPage stands on its own, since the layout may well be the template that is broken
+var errorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html lang="en">
+  <head>
+    <title>Template error</title>
+    <style nonce="{{.Nonce}}">
+      body { font-family: sans-serif; margin: 2em; }
+      .err { color: #a94442; white-space: pre-wrap; }
+      .source { background: #f5f5f5; padding: 1em; }
+      .line { display: block; }
+      .error-line { background: #f2dede; }
+    </style>
+  </head>
+  <body>
+    <h1>Template error</h1>
+    <p>View: {{.View}}</p>
+    {{if .Name}}<p><strong>{{.Name}}</strong>{{if .Line}}, line {{.Line}}{{end}}</p>{{end}}
+    <pre class="err">{{.Err}}</pre>
+    {{with .Source}}
+    <pre class="source">{{range .}}<span class="line{{if .Error}} error-line{{end}}">{{printf "%4d" .Number}}  {{.Text}}</span>{{end}}</pre>
+    {{end}}
+    <p>This page is only shown in development.</p>
+  </body>
+</html>
+`))
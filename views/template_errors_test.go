@@ -0,0 +1,208 @@
+package views
+
+import (
+	"errors"
+	"html/template"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// testTemplates are the files that the views of these tests are made of, in place of the embedded ones
+var testTemplates = fstest.MapFS{
+	"layout/bootstrap.gohtml": {Data: []byte(`{{define "bootstrap"}}<body>{{template "yield" .Yield}}</body>{{end}}`)},
+	"pages/ok.gohtml":         {Data: []byte(`{{define "yield"}}<h1>{{.}}</h1>{{end}}`)},
+	"pages/broken.gohtml": {Data: []byte(`{{define "yield"}}
+  <h1>Broken</h1>
+  {{if}}
+  <p>never parsed</p>
+{{end}}`)},
+	"pages/field.gohtml": {Data: []byte(`{{define "yield"}}
+  <h1>Gallery</h1>
+
+  <p>{{.Foo}}</p>
+{{end}}`)},
+	"pages/context.gohtml": {Data: []byte(`{{define "yield"}}
+  {{if .}}<script>{{end}}
+{{end}}`)},
+	"pages/url.gohtml": {Data: []byte(`{{define "yield"}}<a href="{{.}}{{end}}`)},
+}
+
+// useTestTemplates makes NewView read testTemplates and Validate only see the views of the test
+func useTestTemplates(t *testing.T) {
+	oldFS, oldViews := templateFS, views
+	templateFS, views = testTemplates, nil
+	t.Cleanup(func() { templateFS, views = oldFS, oldViews })
+}
+
+// executeError returns the error of rendering the view with data
+func executeError(t *testing.T, v *View, data interface{}) error {
+	t.Helper()
+	tpl, err := v.template()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tpl.ExecuteTemplate(io.Discard, v.Layout, Data{Yield: data})
+	if err == nil {
+		t.Fatal("the view rendered without an error")
+	}
+	return err
+}
+
+func TestValidate(t *testing.T) {
+	useTestTemplates(t)
+	NewView("bootstrap", "pages/ok").WithPartials("yield")
+	if err := Validate(); err != nil {
+		t.Fatalf("Validate() of a working view = %v", err)
+	}
+
+	NewView("bootstrap", "pages/broken")
+	NewView("navbar", "pages/ok")
+	NewView("bootstrap", "pages/ok").WithPartials("images")
+	err := Validate()
+	if err == nil {
+		t.Fatal("Validate() of the broken views = nil")
+	}
+	for _, want := range []string{
+		`view pages/broken.gohtml: template: broken.gohtml:3: missing value for if`,
+		`view pages/ok.gohtml: the layout "navbar" is not defined`,
+		`view pages/ok.gohtml: the partial "images" is not defined`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() = %v\nwant it to report %s", err, want)
+		}
+	}
+}
+
+func TestNewTemplateError(t *testing.T) {
+	useTestTemplates(t)
+
+	broken := NewView("bootstrap", "pages/broken")
+	field := NewView("bootstrap", "pages/field")
+	branches := NewView("bootstrap", "pages/context")
+	url := NewView("bootstrap", "pages/url")
+
+	tests := []struct {
+		name      string
+		view      *View
+		err       error
+		wantName  string
+		wantLine  int
+		wantErr   string
+		wantLines []int // the lines of Source
+	}{
+		{
+			name:      "parse error",
+			view:      broken,
+			err:       broken.err,
+			wantName:  "broken.gohtml",
+			wantLine:  3,
+			wantErr:   "missing value for if",
+			wantLines: []int{1, 2, 3, 4, 5},
+		},
+		{
+			name:      "execute error",
+			view:      field,
+			err:       executeError(t, field, struct{ Bar string }{}),
+			wantName:  "field.gohtml",
+			wantLine:  4,
+			wantErr:   `executing "yield" at <.Foo>: can't evaluate field Foo`,
+			wantLines: []int{1, 2, 3, 4, 5},
+		},
+		{
+			name:      "escape error with a line in the message only",
+			view:      branches,
+			err:       executeError(t, branches, true),
+			wantName:  "context.gohtml",
+			wantLine:  2,
+			wantErr:   "{{if}} branches end in different contexts",
+			wantLines: []int{1, 2, 3},
+		},
+		{
+			name:     "escape error without a line",
+			view:     url,
+			err:      executeError(t, url, "/"),
+			wantName: "bootstrap", // the template being executed, since there is no node to point at
+			wantErr:  "ends in a non-text context",
+		},
+		{
+			name:    "not a template error",
+			view:    field,
+			err:     errors.New("out of memory"),
+			wantErr: "out of memory",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			te := tt.view.newTemplateError(tt.err)
+			if te.Name != tt.wantName || te.Line != tt.wantLine {
+				t.Errorf("the error is at %s:%d, want %s:%d (%v)", te.Name, te.Line, tt.wantName, tt.wantLine, tt.err)
+			}
+			if !strings.HasPrefix(te.Err, tt.wantErr) {
+				t.Errorf("Err = %q, want it to start with %q", te.Err, tt.wantErr)
+			}
+
+			var lines []int
+			for _, l := range te.Source {
+				lines = append(lines, l.Number)
+				if l.Error != (l.Number == tt.wantLine) {
+					t.Errorf("line %d is marked as the error: %t", l.Number, l.Error)
+				}
+			}
+			if len(lines) != len(tt.wantLines) {
+				t.Fatalf("Source has the lines %v, want %v", lines, tt.wantLines)
+			}
+			for i := range lines {
+				if lines[i] != tt.wantLines[i] {
+					t.Fatalf("Source has the lines %v, want %v", lines, tt.wantLines)
+				}
+			}
+		})
+	}
+}
+
+func TestSource(t *testing.T) {
+	useTestTemplates(t)
+	v := NewView("bootstrap", "pages/field")
+
+	lines := v.source("field.gohtml", 4)
+	if len(lines) != 5 || lines[0].Number != 1 || lines[4].Number != 5 {
+		t.Fatalf("source() = %+v, want the lines 1 to 5", lines)
+	}
+	if lines[3].Text != "  <p>{{.Foo}}</p>" || !lines[3].Error {
+		t.Errorf("line 4 = %+v, want the line with .Foo marked as the error", lines[3])
+	}
+
+	// the layout is one of the view's files, a file of another view is not
+	if lines := v.source("bootstrap.gohtml", 1); len(lines) != 1 {
+		t.Errorf("source() of the layout = %+v, want its only line", lines)
+	}
+	if lines := v.source("ok.gohtml", 1); lines != nil {
+		t.Errorf("source() of a file outside the view = %+v, want nil", lines)
+	}
+}
+
+func TestRenderTemplateError(t *testing.T) {
+	useTestTemplates(t)
+	t.Cleanup(func() { ShowErrors(false) })
+	v := NewView("bootstrap", "pages/field")
+
+	for _, show := range []bool{false, true} {
+		ShowErrors(show)
+		w := httptest.NewRecorder()
+		v.Render(w, httptest.NewRequest("GET", "/", nil), struct{ Bar string }{})
+
+		if w.Code != 500 {
+			t.Errorf("ShowErrors(%t): status = %d, want 500", show, w.Code)
+		}
+		body := w.Body.String()
+		shown := strings.Contains(body, "field.gohtml</strong>, line 4") &&
+			strings.Contains(body, template.HTMLEscapeString("<p>{{.Foo}}</p>"))
+		if shown != show {
+			t.Errorf("ShowErrors(%t): the error page shows the template and line: %t\n%s", show, shown, body)
+		}
+	}
+}
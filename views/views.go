@@ -2,28 +2,54 @@ package views
 
 import (
 	"bytes"
+	"embed"
 	"errors"
+	"fmt"
 	"html/template"
 	"io"
-	"log"
+	"io/fs"
+	"log/slog"
 	"net/http"
-	"path/filepath"
+	"os"
+	"strings"
 
 	"github.com/gorilla/csrf"
 	"lenslocked.com/context"
 )
 
+// The paths below are relative to the root of templateFS
 var (
-	LayoutDir   string = "views/layout/"
-	TemplateDir string = "views/"
+	LayoutDir   string = "layout/"
+	TemplateDir string = ""
 	TemplateExt string = ".gohtml"
 )
 
+// The templates are embedded in the binary, so that it runs from any directory
+//
+//go:embed */*.gohtml
+var embedded embed.FS
+
+// templateFS is where the templates are read from, see UseDir
+// When reload is true, every render parses the templates again
+var (
+	templateFS fs.FS = embedded
+	reload     bool
+)
+
+// UseDir reads the templates from dir (e.g. "views") instead of the copies embedded in the binary,
+// and parses them again for every request so that edits show up without restarting the app
+// For development only; it must be called before the views are created
+func UseDir(dir string) {
+	templateFS = os.DirFS(dir)
+	reload = true
+}
+
 // this function takes in variatic parameters
 func NewView(layout string, files ...string) *View {
 
 	addTemplatePath(files)
 	addTemplateExt(files)
+	name := strings.Join(files, ", ")
 
 	// append the layout file(s) to be used along with the passed-in files,
 	// e.g. bootstrap.gohtml, footer.gohtml and navbar.gohtml
@@ -31,7 +57,7 @@ func NewView(layout string, files ...string) *View {
 	// the 3 dots layoutFiles()... unpacks the slice []string
 	files = append(files, layoutFiles()...)
 
-	// template.Parsefiles will unpack all the individual strings
+	// template.ParseFS will unpack all the individual strings
 	// therefore, there is no need to use a slice type
 	// t, err := template.ParseFiles(files...)
 
@@ -41,33 +67,86 @@ func NewView(layout string, files ...string) *View {
 	// We are writing our own function named "csrfField" and attaching it to our template
 	// so that it can be used
 	// We want the csrfField to include a hidden field to indicate that this is a valid form
-	t, err := template.New("").Funcs(template.FuncMap{
-		"csrfField": func() (template.HTML, error) {
-			return "", errors.New("csrfField not implemented")
-		},
-	}).ParseFiles(files...)
+	// cspNonce is the nonce of the Content-Security-Policy, e.g. <script nonce="{{cspNonce}}">
+	// Both are only placeholders here, Render replaces them with the values of the request
+	v := &View{
+		Layout: layout,
+		name:   name,
+		files:  files,
+	}
 
+	// A view that doesn't parse keeps the error instead of a nil Template:
+	// Validate reports it at start up and Render shows it (see template_errors.go)
+	t, err := v.parse()
 	if err != nil {
-		log.Print(err)
+		slog.Error("parsing templates", "files", files, "err", err)
+		v.err = err
 	}
+	v.Template = t
+
+	views = append(views, v)
 
 	//return the template
-	return &View{
-		Template: t,
-		Layout:   layout,
-	}
+	return v
 }
 
 type View struct {
+	// Template is cloned by Render for every request, and must not be executed directly
 	Template *template.Template
 	Layout   string
+
+	// name is the view's own template files, without the layout, for the errors
+	// files are all of its template files, kept to parse them again when reloading
+	name  string
+	files []string
+	err   error
+
+	// partials are the blocks that a request may ask for on their own, see WithPartials
+	partials map[string]bool
+}
+
+// WithPartials lets requests render the given blocks of the view on their own (see negotiate.go),
+// e.g. NewView("bootstrap", "galleries/edit").WithPartials("galleryImages")
+// Only blocks that render the Yield of the page belong here: any other block,
+// such as those of the layout, would fail on the data it gets
+func (v *View) WithPartials(blocks ...string) *View {
+	if v.partials == nil {
+		v.partials = make(map[string]bool)
+	}
+	for _, block := range blocks {
+		v.partials[block] = true
+	}
+	return v
+}
+
+// views are all the views created by NewView, for Validate
+var views []*View
+
+// template returns the view's templates, parsed again when reloading
+func (v *View) template() (*template.Template, error) {
+	if !reload {
+		return v.Template, v.err
+	}
+	return v.parse()
+}
+
+// parse reads the view's templates from templateFS
+func (v *View) parse() (*template.Template, error) {
+	return template.New("").Funcs(template.FuncMap{
+		"csrfField": func() (template.HTML, error) {
+			return "", errors.New("csrfField not implemented")
+		},
+		"cspNonce": func() (string, error) {
+			return "", errors.New("cspNonce not implemented")
+		},
+	}).ParseFS(templateFS, v.files...)
 }
 
 // layoutFiles returns as slice of strings
 // reprsenting the layout files used in our application
 func layoutFiles() []string {
 
-	files, err := filepath.Glob(LayoutDir + "*" + TemplateExt)
+	files, err := fs.Glob(templateFS, LayoutDir+"*"+TemplateExt)
 
 	if err != nil {
 		panic(err)
@@ -121,6 +200,10 @@ func (v *View) Render(w http.ResponseWriter, r *http.Request, data interface{})
 		}
 	}
 
+	if vd.err != nil {
+		context.Logger(r.Context()).Error("rendering an alert", "err", vd.err)
+	}
+
 	if alert := getAlert(r); alert != nil && vd.Alert == nil {
 		vd.Alert = alert
 		clearAlert(w)
@@ -129,6 +212,14 @@ func (v *View) Render(w http.ResponseWriter, r *http.Request, data interface{})
 	// get the context of the logged in user
 	vd.User = context.User(r.Context())
 
+	// The same page can be sent as JSON, or only a block of it, depending on the request
+	// (see negotiate.go), so that scripts and htmx can use the same controllers as the browser
+	w.Header().Add("Vary", varyHeaders)
+	if wantsJSON(r) {
+		RenderJSON(w, r, http.StatusOK, vd)
+		return
+	}
+
 	// by using a method by reference, it is implicit that
 	// the Layout "bootstrap" is based on the object itself
 	//currently no data is passed to the layout yet
@@ -144,15 +235,43 @@ func (v *View) Render(w http.ResponseWriter, r *http.Request, data interface{})
 	// UPDATE: create a new template based on the existing one
 	// and attached a new function to it, return us a new template and assign it tpl
 	csrfField := csrf.TemplateField(r)
+	cspNonce := context.CSPNonce(r.Context())
 
-	tpl := v.Template.Funcs(template.FuncMap{
+	tpl, err := v.template()
+	if err != nil {
+		v.renderError(w, r, err)
+		return
+	}
+
+	// Funcs changes the template it is called on, so every request gets its own copy:
+	// on the shared template, concurrent requests could render each other's csrfField and cspNonce
+	// The view's Template is never executed itself, since an executed template can no longer be cloned
+	tpl, err = tpl.Clone()
+	if err != nil {
+		v.renderError(w, r, err)
+		return
+	}
+	tpl = tpl.Funcs(template.FuncMap{
 		"csrfField": func() template.HTML {
 			return csrfField
 		},
+		"cspNonce": func() string {
+			return cspNonce
+		},
 	})
 
-	if err := tpl.ExecuteTemplate(&buf, v.Layout, vd); err != nil {
-		http.Error(w, "Something went wrong. If the problem persisits, please email support@lenslocked.com", http.StatusInternalServerError)
+	if block := partial(r); block != "" {
+		// the client picks the name, so only the blocks the view declares are rendered
+		if !v.partials[block] || tpl.Lookup(block) == nil {
+			http.Error(w, fmt.Sprintf("The page has no block named %q.", block), http.StatusBadRequest)
+			return
+		}
+		err = executePartial(tpl, &buf, block, vd)
+	} else {
+		err = tpl.ExecuteTemplate(&buf, v.Layout, vd)
+	}
+	if err != nil {
+		v.renderError(w, r, err)
 		return
 	}
 
@@ -0,0 +1,191 @@
+package views
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"lenslocked.com/context"
+)
+
+// TestRenderConcurrentNonces renders the same view for many requests at once,
+// each of which must get its own nonce back
+func TestRenderConcurrentNonces(t *testing.T) {
+	tpl := template.Must(template.New("").Funcs(template.FuncMap{
+		"csrfField": func() template.HTML { return "" },
+		"cspNonce":  func() string { return "" },
+	}).Parse(`{{define "page"}}<script nonce="{{cspNonce}}"></script>{{csrfField}}{{end}}`))
+	v := &View{Template: tpl, Layout: "page", name: "page"}
+
+	const requests = 50
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(nonce string) {
+			defer wg.Done()
+			r := httptest.NewRequest("GET", "/", nil)
+			r = r.WithContext(context.WithCSPNonce(r.Context(), nonce))
+			w := httptest.NewRecorder()
+			v.Render(w, r, nil)
+
+			if body := w.Body.String(); !strings.Contains(body, `nonce="`+nonce+`"`) {
+				t.Errorf("the request with the nonce %s got %q", nonce, body)
+			}
+		}(fmt.Sprintf("nonce%d", i))
+	}
+	wg.Wait()
+
+	// the view's own template is left alone, so it can still be cloned
+	if _, err := v.Template.Clone(); err != nil {
+		t.Errorf("the view's template can no longer be cloned: %v", err)
+	}
+}
+
+func TestWantsJSON(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"application/json", true},
+		{"Application/JSON", true},
+		{"text/html", false},
+		{"*/*", false},
+		{"application/json, */*", false},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", false},
+		{"application/json, text/html;q=0.9", true},
+		{"application/json;q=0.5, text/html", false},
+		{"application/json;q=0.9, */*;q=0.1", true},
+		{"text/*;q=0.5, application/json;q=0.6", true},
+		{"application/json;q=0", false},
+		{"application/xml", false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		if got := wantsJSON(r); got != tt.want {
+			t.Errorf("wantsJSON(Accept: %q) = %t, want %t", tt.accept, got, tt.want)
+		}
+	}
+}
+
+// testView is a page like those of NewView: a layout, a yield that calls a block, and the alert
+func testView(t *testing.T) *View {
+	t.Helper()
+	tpl := template.Must(template.New("").Funcs(template.FuncMap{
+		"csrfField": func() template.HTML { return "" },
+		"cspNonce":  func() string { return "" },
+	}).Parse(`
+{{define "bootstrap"}}<nav>{{with .User}}{{.Name}}{{end}}</nav>{{with .Alert}}{{template "alert" .}}{{end}}{{template "yield" .Yield}}{{end}}
+{{define "alert"}}<div class="alert-{{.Level}}">{{.Message}}</div>{{end}}
+{{define "yield"}}<h2>{{.Title}}</h2>{{template "images" .}}{{end}}
+{{define "images"}}<ul>{{range .Images}}<li>{{.}}</li>{{end}}</ul>{{end}}
+{{define "title"}}{{.Title}}{{end}}`))
+	return (&View{Template: tpl, Layout: "bootstrap", name: "test"}).WithPartials("images", "missing")
+}
+
+type testGallery struct {
+	Title  string   `json:"title"`
+	Images []string `json:"images"`
+}
+
+func TestRenderJSON(t *testing.T) {
+	v := testView(t)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	v.Render(w, r, Data{
+		Alert: &Alert{Level: AlertLvlSuccess, Message: "Saved"},
+		Yield: testGallery{Title: "Beach", Images: []string{"a.jpg"}},
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	if vary := w.Header().Get("Vary"); !strings.Contains(vary, "Accept") {
+		t.Errorf("Vary = %q, want Accept in it", vary)
+	}
+
+	var got struct {
+		Data struct {
+			Alert *Alert      `json:"alert"`
+			Yield testGallery `json:"yield"`
+		} `json:"data"`
+		Error *JSONError `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("the body is not JSON: %v\n%s", err, w.Body)
+	}
+	if got.Error != nil || got.Data.Alert == nil || got.Data.Alert.Message != "Saved" {
+		t.Errorf("the envelope has the alert %v and the error %v, want the alert Saved", got.Data.Alert, got.Error)
+	}
+	if got.Data.Yield.Title != "Beach" || len(got.Data.Yield.Images) != 1 {
+		t.Errorf("the envelope has the yield %+v, want the gallery", got.Data.Yield)
+	}
+	if strings.Contains(w.Body.String(), "user") {
+		t.Errorf("the envelope has the user in it: %s", w.Body)
+	}
+}
+
+func TestRenderPartial(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		status  int
+		want    string
+	}{
+		{"whole page", nil, http.StatusOK, "<nav></nav><h2>Beach</h2><ul><li>a.jpg</li></ul>"},
+		{"declared block", map[string]string{"X-Partial": "images"}, http.StatusOK, "<ul><li>a.jpg</li></ul>"},
+		{"htmx target", map[string]string{"HX-Request": "true", "HX-Target": "images"}, http.StatusOK, "<ul><li>a.jpg</li></ul>"},
+		{"htmx target without HX-Request", map[string]string{"HX-Target": "images"}, http.StatusOK, "<nav></nav><h2>Beach</h2><ul><li>a.jpg</li></ul>"},
+		{"block of the layout", map[string]string{"X-Partial": "bootstrap"}, http.StatusBadRequest, ""},
+		{"undeclared block", map[string]string{"X-Partial": "title"}, http.StatusBadRequest, ""},
+		{"declared but not defined", map[string]string{"X-Partial": "missing"}, http.StatusBadRequest, ""},
+	}
+
+	v := testView(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			for k, val := range tt.headers {
+				r.Header.Set(k, val)
+			}
+			w := httptest.NewRecorder()
+			v.Render(w, r, testGallery{Title: "Beach", Images: []string{"a.jpg"}})
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.want != "" && w.Body.String() != tt.want {
+				t.Errorf("body = %q, want %q", w.Body, tt.want)
+			}
+		})
+	}
+}
+
+// TestRenderPartialAlert checks that a block comes with the alert, since it replaces the page the alert was on
+func TestRenderPartialAlert(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Partial", "images")
+	w := httptest.NewRecorder()
+	testView(t).Render(w, r, Data{
+		Alert: &Alert{Level: AlertLvlError, Message: "Upload failed"},
+		Yield: testGallery{Images: []string{"a.jpg"}},
+	})
+
+	want := `<div class="alert-danger">Upload failed</div><ul><li>a.jpg</li></ul>`
+	if w.Body.String() != want {
+		t.Errorf("body = %q, want %q", w.Body, want)
+	}
+}